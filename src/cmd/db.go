@@ -38,12 +38,22 @@ func migrateModels() {
 	fmt.Println("Running migrations...")
 	database.Init()
 
-	if err := database.DB.AutoMigrate(&auth.User{}, &auth.UserCredentials{}, &auth.RefreshToken{}); err != nil {
+	if err := auth.MigratePlaintextRefreshTokens(database.DB); err != nil {
+		fmt.Printf("Error invalidating plaintext refresh tokens: %v\n", err)
+		return
+	}
+
+	if err := auth.MigrateEmailVerification(database.DB); err != nil {
+		fmt.Printf("Error marking existing email addresses verified: %v\n", err)
+		return
+	}
+
+	if err := database.DB.AutoMigrate(&auth.User{}, &auth.UserCredentials{}, &auth.RefreshToken{}, &auth.RevokedToken{}, &auth.PasswordResetToken{}, &auth.RecoveryCode{}, &auth.WebAuthnCredential{}, &auth.SecurityEvent{}); err != nil {
 		fmt.Printf("Error migrating User model: %v\n", err)
 		return
 	}
 
-	if err := database.DB.AutoMigrate(&models.Session{}); err != nil {
+	if err := database.DB.AutoMigrate(&models.Session{}, &models.SessionEvent{}, &models.SessionShare{}); err != nil {
 		fmt.Printf("Error migrating Session model: %v\n", err)
 		return
 	}
@@ -0,0 +1,80 @@
+package cmd
+
+import (
+	"fmt"
+	"let-me-in/config"
+	"let-me-in/modules/auth"
+	"os"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// keysCmd is the parent command: "let-me-in keys"
+var keysCmd = &cobra.Command{
+	Use:   "keys",
+	Short: "JWT signing key management",
+	Long:  `Manage the key file access tokens are signed with, named by JWT_KEYS_FILE.`,
+}
+
+// keysRotateCmd represents "let-me-in keys rotate"
+var keysRotateCmd = &cobra.Command{
+	Use:   "rotate",
+	Short: "Generate and promote a new signing key",
+	Long: `Generates a new signing key and makes it the one new access tokens are signed with.
+The new key is published in the JWKS right away, but only signs tokens once every server
+reloaded the file and cached copies of the JWKS expired, after JWT_KEYS_RELOAD_INTERVAL
+plus five minutes. The previous key signs until then, and keeps verifying the tokens it
+signed until they expire, so nobody is logged out.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		path, _ := cmd.Flags().GetString("file")
+		algorithm, _ := cmd.Flags().GetString("alg")
+		rotateKeys(path, algorithm)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(keysCmd)
+	keysCmd.AddCommand(keysRotateCmd)
+
+	keysRotateCmd.Flags().String("file", config.GetEnv("JWT_KEYS_FILE", "jwt-keys.json"), "Key file to rotate")
+	keysRotateCmd.Flags().String("alg", "", "Algorithm of the new key: HS256, RS256 or EdDSA (default: that of the active key, or EdDSA)")
+}
+
+func rotateKeys(path, algorithm string) {
+	file, err := auth.ReadKeyFile(path)
+	if err != nil {
+		fmt.Printf("Error reading key file: %v\n", err)
+		os.Exit(1)
+	}
+
+	if algorithm == "" {
+		algorithm = auth.AlgEdDSA
+		for _, key := range file.Keys {
+			if key.ID == file.Active {
+				algorithm = key.Algorithm
+			}
+		}
+	}
+
+	key, err := file.Rotate(algorithm, config.GetDuration("JWT_KEYS_RELOAD_INTERVAL", time.Minute))
+	if err != nil {
+		fmt.Printf("Error generating key: %v\n", err)
+		os.Exit(1)
+	}
+	if err := file.Write(path); err != nil {
+		fmt.Printf("Error writing key file: %v\n", err)
+		os.Exit(1)
+	}
+
+	if key.ActivatesAt == nil {
+		fmt.Printf("%s key %s is now active\n", key.Algorithm, key.ID)
+		return
+	}
+	fmt.Printf("%s key %s is published and activates at %s\n", key.Algorithm, key.ID, key.ActivatesAt.Format("2006-01-02 15:04:05 MST"))
+	for _, retired := range file.Keys {
+		if retired.ID == file.Previous {
+			fmt.Printf("Key %s signs until then, and stays valid until %s\n", retired.ID, retired.ExpiresAt.Format("2006-01-02 15:04:05 MST"))
+		}
+	}
+}
@@ -1,10 +1,18 @@
 package cmd
 
 import (
+	"context"
 	"fmt"
+	"let-me-in/config"
 	"let-me-in/controllers"
 	"let-me-in/database"
+	"let-me-in/mailer"
+	"let-me-in/models"
 	"let-me-in/modules/auth"
+	"let-me-in/reaper"
+	"let-me-in/terminal"
+	"os"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/spf13/cobra"
@@ -33,16 +41,102 @@ func init() {
 func startServer() {
 	database.Init()
 
+	if err := auth.LoadSigningKeys(); err != nil {
+		fmt.Printf("Error loading JWT signing keys: %v\n", err)
+		os.Exit(1)
+	}
+	// Pick up keys rotated while running
+	auth.WatchSigningKeys(context.Background(), config.GetDuration("JWT_KEYS_RELOAD_INTERVAL", time.Minute))
+
+	// Revoked access tokens are cached, and synced with the ones other instances revoke
+	if err := auth.LoadRevocations(database.DB); err != nil {
+		fmt.Printf("Error loading revoked access tokens: %v\n", err)
+		os.Exit(1)
+	}
+	auth.SyncRevocations(context.Background(), database.DB, config.GetDuration("TOKEN_REVOCATION_SYNC_INTERVAL", 30*time.Second))
+	auth.OnUserDisabled = controllers.TerminateUserSessions
+
+	// Verification links must keep working across restarts when logins depend on them
+	if err := auth.LoadEmailVerificationSecret(); err != nil {
+		fmt.Printf("Error configuring email verification: %v\n", err)
+		os.Exit(1)
+	}
+
+	// Password reset links are emailed through MAILER
+	m, err := mailer.FromEnv()
+	if err != nil {
+		fmt.Printf("Error configuring the mailer: %v\n", err)
+		os.Exit(1)
+	}
+	mailer.Default = m
+
+	// Terminal sessions outlive their WebSocket for SESSION_TIMEOUT
+	terminal.Sessions.Timeout = config.GetDuration("SESSION_TIMEOUT", 5*time.Minute)
+	terminal.Sessions.ScrollbackSize = config.GetInt("SCROLLBACK_KB", terminal.DefaultScrollbackSize/1024) * 1024
+	terminal.Sessions.OnStatusChange = controllers.SyncSessionStatus
+	terminal.Sessions.OnActivity = controllers.TouchSession
+	terminal.Sessions.OnSessionEvent = controllers.LogSessionEvent
+	terminal.Sessions.RecordingsDir = config.GetEnv("RECORDINGS_DIR", "recordings")
+	terminal.Sessions.RecordInput = config.GetBool("RECORD_INPUT", false)
+	terminal.Sessions.OnRecording = controllers.SetSessionRecording
+	terminal.Sessions.Backends[models.BackendContainer] = terminal.NewContainerBackend(config.GetEnv("CONTAINER_ENGINE_SOCKET", "/var/run/docker.sock"))
+
+	// Share links are signed with a random secret unless one is configured
+	if secret := config.GetEnv("SHARE_LINK_SECRET", ""); secret != "" {
+		controllers.ShareLinkSecret = []byte(secret)
+	}
+
+	// Shell profiles sessions can be created with
+	if path := config.GetEnv("SHELL_PROFILES_FILE", ""); path != "" {
+		profiles, err := terminal.LoadProfiles(path)
+		if err != nil {
+			fmt.Printf("Error loading shell profiles: %v\n", err)
+			os.Exit(1)
+		}
+		terminal.ShellProfiles = profiles
+	}
+
+	// Clean up idle and abandoned sessions in the background
+	sessionReaper := &reaper.Reaper{
+		Registry:          terminal.Sessions,
+		Interval:          config.GetDuration("REAPER_INTERVAL", time.Minute),
+		IdleTimeout:       config.GetDuration("SESSION_IDLE_TIMEOUT", time.Hour),
+		DisconnectTimeout: terminal.Sessions.Timeout,
+	}
+	sessionReaper.Start(context.Background())
+
 	router := gin.Default()
 
 	auth.RegisterAuthRoutes(router.Group("/auth"))
+	router.GET("/.well-known/jwks.json", auth.JWKSHandler)
 
 	// Session routes
-	router.POST("/sessions/start", controllers.StartSession)
-	router.GET("/sessions", controllers.ListSessions)
+	sessions := router.Group("/sessions", auth.RequireAuth())
+	sessions.POST("", controllers.CreateSession)
+	sessions.GET("", controllers.ListSessions)
+	sessions.GET("/:id", controllers.GetSession)
+	sessions.POST("/:id/terminate", controllers.TerminateSession)
+	sessions.GET("/:id/recording", controllers.GetSessionRecording)
+	sessions.GET("/:id/playback", controllers.PlaybackSession)
+	sessions.GET("/:id/observe", controllers.ObserveSession)
+	sessions.GET("/:id/events", controllers.ListSessionEvents)
+	sessions.POST("/:id/shares", controllers.CreateShare)
+	sessions.GET("/:id/shares", controllers.ListShares)
+	sessions.DELETE("/:id/shares/:share_id", controllers.RevokeShare)
+
+	// Guests with a share link connect without an account
+	router.GET("/sessions/:id/connect", controllers.RequireAuthOrShareLink(), controllers.ConnectSession)
+
+	router.GET("/profiles", auth.RequireAuth(), controllers.ListProfiles)
+
+	// Admin routes
+	admin := router.Group("/admin", auth.RequireAuth(), auth.RequireAdmin())
+	admin.GET("/sessions", controllers.ListAllSessions)
+	admin.POST("/users/:id/disable", auth.DisableUserHandler)
+	admin.POST("/users/:id/enable", auth.EnableUserHandler)
 
 	// WebSocket route for terminal access
-	router.GET("/ws/terminal", controllers.TerminalWebSocket)
+	router.GET("/ws/terminal", auth.RequireAuth(), controllers.TerminalWebSocket)
 
 	// Serve frontend
 	router.Static("/static", "./static")
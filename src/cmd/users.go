@@ -0,0 +1,123 @@
+package cmd
+
+import (
+	"fmt"
+	"let-me-in/database"
+	"let-me-in/modules/auth"
+	"os"
+
+	"github.com/spf13/cobra"
+)
+
+// usersCmd is the parent command: "let-me-in users"
+var usersCmd = &cobra.Command{
+	Use:   "users",
+	Short: "User management",
+	Long:  `Manage user accounts and their permissions.`,
+}
+
+// usersAdminCmd represents "let-me-in users admin <email>"
+var usersAdminCmd = &cobra.Command{
+	Use:   "admin <email>",
+	Short: "Grant admin access to a user",
+	Long:  `Grants admin access to the user registered with the given email. Pass --revoke to take it away.`,
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		revoke, _ := cmd.Flags().GetBool("revoke")
+		setAdmin(args[0], !revoke)
+	},
+}
+
+// usersDisableCmd represents "let-me-in users disable <email>"
+var usersDisableCmd = &cobra.Command{
+	Use:   "disable <email>",
+	Short: "Disable a user",
+	Long: `Disables the user registered with the given email and revokes all their tokens. Their
+terminal sessions are terminated by the next reaper pass of the server. Pass --enable to
+let them log in again.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		enable, _ := cmd.Flags().GetBool("enable")
+		setDisabled(args[0], !enable)
+	},
+}
+
+// usersVerifyCmd represents "let-me-in users verify <email>"
+var usersVerifyCmd = &cobra.Command{
+	Use:   "verify <email>",
+	Short: "Mark the email address of a user as verified",
+	Long: `Marks the email address of the user registered with it as verified, so they can log in
+when REQUIRE_EMAIL_VERIFICATION is on without following the link they were emailed.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		verifyEmail(args[0])
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(usersCmd)
+	usersCmd.AddCommand(usersAdminCmd)
+	usersCmd.AddCommand(usersDisableCmd)
+	usersCmd.AddCommand(usersVerifyCmd)
+
+	usersAdminCmd.Flags().Bool("revoke", false, "Revoke admin access instead of granting it")
+	usersDisableCmd.Flags().Bool("enable", false, "Enable the user instead of disabling them")
+}
+
+func setAdmin(email string, isAdmin bool) {
+	database.Init()
+
+	var credentials auth.UserCredentials
+	if err := database.DB.Where("email = ?", email).First(&credentials).Error; err != nil {
+		fmt.Printf("User %s not found: %v\n", email, err)
+		os.Exit(1)
+	}
+
+	if err := database.DB.Model(&auth.User{}).Where("id = ?", credentials.UserID).Update("is_admin", isAdmin).Error; err != nil {
+		fmt.Printf("Error updating user: %v\n", err)
+		os.Exit(1)
+	}
+
+	if isAdmin {
+		fmt.Printf("%s is now an admin\n", email)
+	} else {
+		fmt.Printf("%s is no longer an admin\n", email)
+	}
+}
+
+func setDisabled(email string, disabled bool) {
+	database.Init()
+
+	var credentials auth.UserCredentials
+	if err := database.DB.Where("email = ?", email).First(&credentials).Error; err != nil {
+		fmt.Printf("User %s not found: %v\n", email, err)
+		os.Exit(1)
+	}
+
+	if err := auth.SetUserDisabled(database.DB, credentials.UserID, disabled); err != nil {
+		fmt.Printf("Error updating user: %v\n", err)
+		os.Exit(1)
+	}
+
+	if disabled {
+		fmt.Printf("%s is now disabled\n", email)
+	} else {
+		fmt.Printf("%s is enabled again\n", email)
+	}
+}
+
+func verifyEmail(email string) {
+	database.Init()
+
+	result := database.DB.Model(&auth.UserCredentials{}).Where("email = ?", email).Update("email_verified", true)
+	if result.Error != nil {
+		fmt.Printf("Error updating user: %v\n", result.Error)
+		os.Exit(1)
+	}
+	if result.RowsAffected == 0 {
+		fmt.Printf("User %s not found\n", email)
+		os.Exit(1)
+	}
+
+	fmt.Printf("%s is now verified\n", email)
+}
@@ -1,23 +1,35 @@
 package controllers
 
 import (
+	"fmt"
 	"let-me-in/database"
 	"let-me-in/models"
 	"let-me-in/modules/auth"
 	"let-me-in/terminal"
+	"log"
 	"net/http"
+	"os"
+	"strconv"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/gorilla/websocket"
+	"gorm.io/gorm"
 )
 
-// StartSession starts a new terminal session.
-func StartSession(c *gin.Context) {
+// Pagination limits for session listings
+const (
+	defaultPerPage = 20
+	maxPerPage     = 100
+)
+
+// CreateSession creates a new terminal session for the authenticated user. The terminal
+// itself starts when a WebSocket first connects to the session.
+func CreateSession(c *gin.Context) {
 	var input struct {
-		UserID      uint   `json:"user_id" binding:"required"`
-		ContainerID string `json:"container_id" binding:"required"`
-		IPAddress   string `json:"ip_address" binding:"required"`
+		Backend     string `json:"backend"`
+		ContainerID string `json:"container_id"`
+		Profile     string `json:"profile"`
 	}
 
 	if err := c.ShouldBindJSON(&input); err != nil {
@@ -25,38 +37,145 @@ func StartSession(c *gin.Context) {
 		return
 	}
 
-	// Check if the user exists
-	var user auth.User
-	if err := database.DB.First(&user, input.UserID).Error; err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "User not found"})
+	if input.Backend == "" {
+		input.Backend = models.BackendLocal
+	}
+	if _, ok := terminal.Sessions.Backends[input.Backend]; !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown backend"})
+		return
+	}
+	if input.Backend == models.BackendContainer && input.ContainerID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "container_id is required for container sessions"})
+		return
+	}
+
+	if input.Profile == "" {
+		input.Profile = terminal.DefaultProfile
+	}
+	if _, ok := terminal.ShellProfiles[input.Profile]; !ok || !terminal.ValidProfileName(input.Profile) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown shell profile"})
+		return
+	}
+	if !auth.CheckEmailVerified(c) {
 		return
 	}
 
 	session := models.Session{
-		UserID:       input.UserID,
+		UserID:       auth.CurrentUser(c).ID,
+		Backend:      input.Backend,
 		ContainerID:  input.ContainerID,
-		IPAddress:    input.IPAddress,
-		Status:       "active",
+		Profile:      input.Profile,
+		IPAddress:    c.ClientIP(),
+		Status:       models.SessionActive,
 		LastActivity: time.Now(),
 	}
 
 	if err := database.DB.Create(&session).Error; err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to create session"})
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create session"})
 		return
 	}
 
-	c.JSON(http.StatusCreated, gin.H{"message": "Session started successfully", "session_id": session.ID})
+	c.JSON(http.StatusCreated, session)
 }
 
-// ListSessions lists all active sessions.
+// ListSessions lists the authenticated user's sessions.
 func ListSessions(c *gin.Context) {
-	var sessions []models.Session
-	if err := database.DB.Preload("User").Where("status = ?", "active").Find(&sessions).Error; err != nil {
+	listSessions(c, database.DB.Where("user_id = ?", auth.CurrentUser(c).ID))
+}
+
+// ListAllSessions lists the sessions of every user, optionally filtered by user_id. Admins only.
+func ListAllSessions(c *gin.Context) {
+	query := database.DB
+	if userID := c.Query("user_id"); userID != "" {
+		query = query.Where("user_id = ?", userID)
+	}
+	listSessions(c, query)
+}
+
+// GetSession returns one of the authenticated user's sessions.
+func GetSession(c *gin.Context) {
+	session, ok := findOwnedSession(c, c.Param("id"), auth.CurrentUser(c).ID)
+	if !ok {
+		return
+	}
+
+	c.JSON(http.StatusOK, session)
+}
+
+// TerminateSession kills the terminal behind one of the authenticated user's sessions.
+func TerminateSession(c *gin.Context) {
+	session, ok := findOwnedSession(c, c.Param("id"), auth.CurrentUser(c).ID)
+	if !ok {
+		return
+	}
+
+	if session.Status != models.SessionTerminated {
+		terminal.Sessions.Terminate(session.ID, models.TerminatedByUser)
+		// The terminal may not be running, e.g. after a restart, so update the row ourselves
+		if err := markTerminated(session.ID, models.TerminatedByUser); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to terminate session"})
+			return
+		}
+		database.DB.First(session, session.ID)
+	}
+
+	c.JSON(http.StatusOK, session)
+}
+
+// ListProfiles lists the shell profiles sessions can be created with.
+func ListProfiles(c *gin.Context) {
+	profiles := []gin.H{}
+	for _, name := range terminal.ShellProfiles.Names() {
+		profiles = append(profiles, gin.H{
+			"name":        name,
+			"description": terminal.ShellProfiles[name].Description,
+		})
+	}
+
+	c.JSON(http.StatusOK, profiles)
+}
+
+// listSessions responds with a page of the sessions matched by query, filtered by the
+// status, page and per_page query parameters.
+func listSessions(c *gin.Context, query *gorm.DB) {
+	if status := c.Query("status"); status != "" {
+		if status != models.SessionActive && status != models.SessionDisconnected && status != models.SessionTerminated {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid status filter"})
+			return
+		}
+		query = query.Where("status = ?", status)
+	}
+
+	page, err := strconv.Atoi(c.DefaultQuery("page", "1"))
+	if err != nil || page < 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid page"})
+		return
+	}
+
+	perPage, err := strconv.Atoi(c.DefaultQuery("per_page", strconv.Itoa(defaultPerPage)))
+	if err != nil || perPage < 1 || perPage > maxPerPage {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "per_page must be between 1 and " + strconv.Itoa(maxPerPage)})
+		return
+	}
+
+	var total int64
+	if err := query.Model(&models.Session{}).Count(&total).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch sessions"})
+		return
+	}
+
+	sessions := []models.Session{}
+	if err := query.Order("created_at DESC").Offset((page - 1) * perPage).Limit(perPage).Find(&sessions).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch sessions"})
 		return
 	}
 
-	c.JSON(http.StatusOK, sessions)
+	c.JSON(http.StatusOK, gin.H{
+		"sessions": sessions,
+		"page":     page,
+		"per_page": perPage,
+		"total":    total,
+	})
 }
 
 // Upgrader for WebSocket connections
@@ -64,14 +183,230 @@ var upgrader = websocket.Upgrader{
 	CheckOrigin: func(r *http.Request) bool {
 		return true // Allow all origins (adjust for production)
 	},
+	Subprotocols: []string{terminal.Subprotocol},
 }
 
+// TerminalWebSocket attaches the caller to their most recently active session, starting
+// one only if they have none, so reconnecting doesn't leave a session behind every time.
+// Passing a session_id reattaches to that one of the caller's sessions instead.
 func TerminalWebSocket(c *gin.Context) {
-	token := c.Query("token") // Get token from query parameter
+	if !auth.CheckEmailVerified(c) {
+		return
+	}
+	userID := auth.CurrentUser(c).ID
+
+	if sessionID := c.Query("session_id"); sessionID != "" {
+		session, ok := findOwnedSession(c, sessionID, userID)
+		if !ok {
+			return
+		}
+		attachTerminal(c, session)
+		return
+	}
+
+	var session models.Session
+	err := database.DB.Where("user_id = ? AND status <> ?", userID, models.SessionTerminated).
+		Order("last_activity DESC").First(&session).Error
+	if err == nil {
+		attachTerminal(c, &session)
+		return
+	} else if err != gorm.ErrRecordNotFound {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch sessions"})
+		return
+	}
+
+	session = models.Session{
+		UserID:       userID,
+		Backend:      models.BackendLocal,
+		Profile:      terminal.DefaultProfile,
+		IPAddress:    c.ClientIP(),
+		Status:       models.SessionActive,
+		LastActivity: time.Now(),
+	}
+	if err := database.DB.Create(&session).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create session"})
+		return
+	}
+
+	attachTerminal(c, &session)
+}
+
+// ConnectSession attaches a WebSocket to one of the caller's sessions. Guests holding a
+// share token for the session join it as observers instead.
+func ConnectSession(c *gin.Context) {
+	if token := c.Query("share"); token != "" {
+		connectShared(c, token)
+		return
+	}
 
-	_, err := auth.ValidateJWT(token)
+	if !auth.CheckEmailVerified(c) {
+		return
+	}
+	session, ok := findOwnedSession(c, c.Param("id"), auth.CurrentUser(c).ID)
+	if !ok {
+		return
+	}
+
+	attachTerminal(c, session)
+}
+
+// GetSessionRecording downloads the asciicast recording of a session. Admins may
+// download the recording of any session, for audits.
+func GetSessionRecording(c *gin.Context) {
+	session, ok := findRecordedSession(c)
+	if !ok {
+		return
+	}
+
+	c.Header("Content-Type", "application/x-asciicast")
+	c.FileAttachment(session.RecordingPath, fmt.Sprintf("session-%d.cast", session.ID))
+}
+
+// PlaybackSession replays the recording of a session over a WebSocket with its
+// original timing. The optional speed and at query parameters set the initial speed
+// multiplier and position in seconds.
+func PlaybackSession(c *gin.Context) {
+	speed, err := strconv.ParseFloat(c.DefaultQuery("speed", "1"), 64)
+	if err != nil || speed <= 0 || speed > terminal.MaxPlaybackSpeed {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("speed must be greater than 0 and at most %d", terminal.MaxPlaybackSpeed)})
+		return
+	}
+	at, err := strconv.ParseFloat(c.DefaultQuery("at", "0"), 64)
+	if err != nil || at < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "at must be a non-negative number of seconds"})
+		return
+	}
+
+	session, ok := findRecordedSession(c)
+	if !ok {
+		return
+	}
+
+	recording, err := terminal.LoadRecording(session.RecordingPath)
 	if err != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read recording"})
+		return
+	}
+
+	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		log.Println("WebSocket upgrade error:", err)
+		return
+	}
+	defer conn.Close()
+
+	recording.Play(conn, speed, at)
+}
+
+// ObserveSession attaches another WebSocket to a running session, so its owner or an
+// admin can watch it live alongside the owner's own connection. Observers are read-only
+// until they are handed control.
+func ObserveSession(c *gin.Context) {
+	session, ok := findVisibleSession(c)
+	if !ok {
+		return
+	}
+
+	observeTerminal(c, session, terminal.Observer{UserID: auth.CurrentUser(c).ID})
+}
+
+// ListSessionEvents returns the audit trail of a session, oldest first.
+func ListSessionEvents(c *gin.Context) {
+	session, ok := findVisibleSession(c)
+	if !ok {
+		return
+	}
+
+	var events []models.SessionEvent
+	if err := database.DB.Where("session_id = ?", session.ID).Order("created_at, id").Find(&events).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch session events"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"events": events})
+}
+
+// findVisibleSession loads the session in the id parameter if the caller may look into
+// it: its owner, or an admin. It writes the error response and returns false otherwise.
+func findVisibleSession(c *gin.Context) (*models.Session, bool) {
+	session, ok := findSession(c, c.Param("id"))
+	if !ok {
+		return nil, false
+	}
+
+	user := auth.CurrentUser(c)
+	if session.UserID != user.ID && !user.IsAdmin {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Session belongs to another user"})
+		return nil, false
+	}
+	return session, true
+}
+
+// findRecordedSession loads the session in the id parameter if the caller may read its
+// recording, see findVisibleSession. It writes the error response and returns false
+// otherwise, or if the recording is missing.
+func findRecordedSession(c *gin.Context) (*models.Session, bool) {
+	session, ok := findVisibleSession(c)
+	if !ok {
+		return nil, false
+	}
+
+	if session.RecordingPath == "" {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Session has no recording"})
+		return nil, false
+	}
+	if _, err := os.Stat(session.RecordingPath); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Recording is no longer available"})
+		return nil, false
+	}
+	return session, true
+}
+
+// findSession loads a session. It writes the error response and returns false if there is none.
+func findSession(c *gin.Context, id string) (*models.Session, bool) {
+	var session models.Session
+	if err := database.DB.First(&session, "id = ?", id).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Session not found"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch session"})
+		}
+		return nil, false
+	}
+	return &session, true
+}
+
+// findOwnedSession loads a session that belongs to userID. It writes the error
+// response and returns false otherwise.
+func findOwnedSession(c *gin.Context, id string, userID uint) (*models.Session, bool) {
+	session, ok := findSession(c, id)
+	if !ok {
+		return nil, false
+	}
+
+	if session.UserID != userID {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Session belongs to another user"})
+		return nil, false
+	}
+
+	return session, true
+}
+
+// attachTerminal upgrades the request to a WebSocket and attaches it to the session's
+// terminal, starting the terminal if it isn't running yet.
+func attachTerminal(c *gin.Context, session *models.Session) {
+	if session.Status == models.SessionTerminated {
+		c.JSON(http.StatusGone, gin.H{"error": "Session has been terminated"})
+		return
+	}
+
+	profile, ok := terminal.ShellProfiles[session.Profile]
+	if !ok {
+		c.JSON(http.StatusConflict, gin.H{"error": "Shell profile is no longer available"})
+		return
+	}
+
+	if _, err := terminal.Sessions.Start(session.ID, session.Backend, profile.Spec(session.ContainerID)); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start terminal session"})
 		return
 	}
 
@@ -82,6 +417,109 @@ func TerminalWebSocket(c *gin.Context) {
 	}
 	defer conn.Close()
 
-	// Start terminal session for the authenticated user
-	terminal.StartTerminalSession(conn, "bash")
+	// The terminal keeps running after the WebSocket closes
+	terminal.Sessions.Attach(session.ID, auth.CurrentUser(c).ID, conn)
+}
+
+// observeTerminal upgrades the request to a WebSocket and attaches it to the session's
+// running terminal as an observer.
+func observeTerminal(c *gin.Context, session *models.Session, observer terminal.Observer) {
+	if !observable(c, session) {
+		return
+	}
+
+	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		log.Println("WebSocket upgrade error:", err)
+		return
+	}
+	defer conn.Close()
+
+	if err := terminal.Sessions.Observe(session.ID, observer, conn); err != nil {
+		log.Printf("Failed to observe session %d: %v", session.ID, err)
+	}
+}
+
+// observable tells whether a session's terminal is running, so it can be observed. It
+// writes the error response otherwise.
+func observable(c *gin.Context, session *models.Session) bool {
+	if session.Status == models.SessionTerminated {
+		c.JSON(http.StatusGone, gin.H{"error": "Session has been terminated"})
+		return false
+	}
+	// Observers never start a terminal, there would be nothing to watch
+	if terminal.Sessions.Get(session.ID) == nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "Session is not running"})
+		return false
+	}
+	return true
+}
+
+// TouchSession records traffic on a session.
+func TouchSession(id uint) {
+	if err := database.DB.Model(&models.Session{}).Where("id = ?", id).Update("last_activity", time.Now()).Error; err != nil {
+		log.Printf("Failed to update activity of session %d: %v", id, err)
+	}
+}
+
+// SetSessionRecording links a session to the file its terminal is recorded to.
+func SetSessionRecording(id uint, path string) {
+	if err := database.DB.Model(&models.Session{}).Where("id = ?", id).UpdateColumn("recording_path", path).Error; err != nil {
+		log.Printf("Failed to store recording of session %d: %v", id, err)
+	}
+}
+
+// SyncSessionStatus mirrors the status of a running terminal onto its session row.
+func SyncSessionStatus(id uint, status, reason string) {
+	var err error
+	switch status {
+	case models.SessionTerminated:
+		err = markTerminated(id, reason)
+	case models.SessionDisconnected:
+		// The disconnect grace period starts now, however long the session was idle before
+		err = database.DB.Model(&models.Session{}).Where("id = ?", id).
+			Updates(map[string]interface{}{"status": status, "disconnected_at": time.Now()}).Error
+	default:
+		err = database.DB.Model(&models.Session{}).Where("id = ?", id).
+			Updates(map[string]interface{}{"status": status, "disconnected_at": nil}).Error
+	}
+	if err != nil {
+		log.Printf("Failed to update status of session %d: %v", id, err)
+	}
+}
+
+// LogSessionEvent adds an event to the audit trail of a session.
+func LogSessionEvent(id, userID, shareID uint, event string) {
+	entry := models.SessionEvent{SessionID: id, UserID: userID, Type: event}
+	if shareID != 0 {
+		entry.ShareID = &shareID
+	}
+	if err := database.DB.Create(&entry).Error; err != nil {
+		log.Printf("Failed to log %s event of session %d: %v", event, id, err)
+	}
+}
+
+// TerminateUserSessions kills the terminals of every session of a user, e.g. once they
+// were disabled.
+func TerminateUserSessions(userID uint) {
+	var sessions []models.Session
+	if err := database.DB.Where("user_id = ? AND status <> ?", userID, models.SessionTerminated).Find(&sessions).Error; err != nil {
+		log.Printf("Failed to fetch sessions of user %d: %v", userID, err)
+		return
+	}
+
+	for _, session := range sessions {
+		terminal.Sessions.Terminate(session.ID, models.TerminatedUserDisabled)
+		if err := markTerminated(session.ID, models.TerminatedUserDisabled); err != nil {
+			log.Printf("Failed to terminate session %d: %v", session.ID, err)
+		}
+	}
+}
+
+// markTerminated records why and when a session ended. A session that is already
+// terminated keeps its original reason.
+func markTerminated(id uint, reason string) error {
+	return database.DB.Model(&models.Session{}).
+		Where("id = ? AND status <> ?", id, models.SessionTerminated).
+		Updates(models.TerminatedColumns(reason)).Error
 }
@@ -0,0 +1,234 @@
+package controllers
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"let-me-in/database"
+	"let-me-in/models"
+	"let-me-in/modules/auth"
+	"let-me-in/terminal"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// Lifetime of share links
+const (
+	defaultShareTTL = time.Hour
+	maxShareTTL     = 7 * 24 * time.Hour
+)
+
+// ShareLinkSecret signs share tokens. It is random unless configured; random secrets
+// invalidate links issued before a restart.
+var ShareLinkSecret = randomSecret()
+
+func randomSecret() []byte {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		panic(err)
+	}
+	return secret
+}
+
+// RequireAuthOrShareLink is auth.RequireAuth, except that requests carrying a share
+// token are let through for the handler to check.
+func RequireAuthOrShareLink() gin.HandlerFunc {
+	requireAuth := auth.RequireAuth()
+	return func(c *gin.Context) {
+		if c.Query("share") != "" {
+			c.Next()
+			return
+		}
+		requireAuth(c)
+	}
+}
+
+// CreateShare issues a share link for one of the caller's sessions. The token is only
+// ever returned here.
+func CreateShare(c *gin.Context) {
+	var input struct {
+		Mode      string `json:"mode"`
+		ExpiresIn int    `json:"expires_in"` // seconds
+		SingleUse bool   `json:"single_use"`
+	}
+
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if input.Mode == "" {
+		input.Mode = models.ShareReadOnly
+	}
+	if input.Mode != models.ShareReadOnly && input.Mode != models.ShareReadWrite {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "mode must be read_only or read_write"})
+		return
+	}
+
+	ttl := time.Duration(input.ExpiresIn) * time.Second
+	if input.ExpiresIn == 0 {
+		ttl = defaultShareTTL
+	}
+	if ttl <= 0 || ttl > maxShareTTL {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("expires_in must be between 1 and %d seconds", int(maxShareTTL.Seconds()))})
+		return
+	}
+
+	session, ok := findOwnedSession(c, c.Param("id"), auth.CurrentUser(c).ID)
+	if !ok {
+		return
+	}
+	if session.Status == models.SessionTerminated {
+		c.JSON(http.StatusGone, gin.H{"error": "Session has been terminated"})
+		return
+	}
+
+	share := models.SessionShare{
+		SessionID: session.ID,
+		Mode:      input.Mode,
+		SingleUse: input.SingleUse,
+		ExpiresAt: time.Now().Add(ttl).Truncate(time.Second),
+	}
+	if err := database.DB.Create(&share).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create share link"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"share": share, "token": signShare(&share)})
+}
+
+// ListShares lists the share links of one of the caller's sessions, newest first.
+func ListShares(c *gin.Context) {
+	session, ok := findOwnedSession(c, c.Param("id"), auth.CurrentUser(c).ID)
+	if !ok {
+		return
+	}
+
+	var shares []models.SessionShare
+	if err := database.DB.Where("session_id = ?", session.ID).Order("created_at DESC, id DESC").Find(&shares).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch share links"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"shares": shares})
+}
+
+// RevokeShare stops a share link of one of the caller's sessions from working, and
+// disconnects the guests connected through it.
+func RevokeShare(c *gin.Context) {
+	session, ok := findOwnedSession(c, c.Param("id"), auth.CurrentUser(c).ID)
+	if !ok {
+		return
+	}
+
+	var share models.SessionShare
+	if err := database.DB.First(&share, "id = ? AND session_id = ?", c.Param("share_id"), session.ID).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Share link not found"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch share link"})
+		}
+		return
+	}
+
+	if share.RevokedAt == nil {
+		now := time.Now()
+		share.RevokedAt = &now
+		if err := database.DB.Model(&share).Update("revoked_at", now).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke share link"})
+			return
+		}
+	}
+	terminal.Sessions.DisconnectShare(session.ID, share.ID)
+
+	c.JSON(http.StatusOK, share)
+}
+
+// connectShared attaches a guest holding a share token to the session in the id
+// parameter, as an observer, until the link expires.
+func connectShared(c *gin.Context, token string) {
+	share, ok := findShare(token)
+	if !ok || strconv.FormatUint(uint64(share.SessionID), 10) != c.Param("id") {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid share link"})
+		return
+	}
+	if share.RevokedAt != nil || time.Now().After(share.ExpiresAt) {
+		c.JSON(http.StatusGone, gin.H{"error": "Share link has expired"})
+		return
+	}
+
+	session, ok := findSession(c, c.Param("id"))
+	// Links die with their session. Check before using up a single-use link
+	if !ok || !observable(c, session) {
+		return
+	}
+
+	used := database.DB.Model(share).Where("id = ?", share.ID)
+	if share.SingleUse {
+		used = used.Where("used_at IS NULL")
+	}
+	result := used.Update("used_at", time.Now())
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to use share link"})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusGone, gin.H{"error": "Share link has already been used"})
+		return
+	}
+
+	expiry := time.AfterFunc(time.Until(share.ExpiresAt), func() {
+		terminal.Sessions.DisconnectShare(session.ID, share.ID)
+	})
+	defer expiry.Stop()
+
+	// Guests have no user, the audit trail shows them as user 0 with their share link.
+	// They are observers, so one that stops reading is disconnected without holding up
+	// the terminal
+	observeTerminal(c, session, terminal.Observer{ShareID: share.ID, ReadOnly: share.Mode == models.ShareReadOnly})
+}
+
+// signShare returns the token of a share link: the share's ID, session and expiry,
+// followed by their signature.
+func signShare(share *models.SessionShare) string {
+	payload := fmt.Sprintf("%d.%d.%d", share.ID, share.SessionID, share.ExpiresAt.Unix())
+	return payload + "." + shareSignature(payload)
+}
+
+// findShare loads the share link a token was issued for, if its signature is valid.
+func findShare(token string) (*models.SessionShare, bool) {
+	payload, signature, ok := cutLast(token, ".")
+	if !ok || !hmac.Equal([]byte(signature), []byte(shareSignature(payload))) {
+		return nil, false
+	}
+
+	id, _, _ := strings.Cut(payload, ".")
+	var share models.SessionShare
+	if err := database.DB.First(&share, "id = ?", id).Error; err != nil {
+		return nil, false
+	}
+	// The signature covers the whole payload, so it must match the share exactly
+	if signShare(&share) != token {
+		return nil, false
+	}
+	return &share, true
+}
+
+func shareSignature(payload string) string {
+	mac := hmac.New(sha256.New, ShareLinkSecret)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func cutLast(s, sep string) (before, after string, found bool) {
+	if i := strings.LastIndex(s, sep); i >= 0 {
+		return s[:i], s[i+len(sep):], true
+	}
+	return s, "", false
+}
@@ -0,0 +1,391 @@
+package controllers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"let-me-in/controllers"
+	"let-me-in/database"
+	"let-me-in/models"
+	"let-me-in/modules/auth"
+	"let-me-in/terminal"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+func newRouter() *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	router := gin.Default()
+	auth.RegisterAuthRoutes(router.Group("/auth"))
+
+	sessions := router.Group("/sessions", auth.RequireAuth())
+	sessions.POST("", controllers.CreateSession)
+	sessions.GET("", controllers.ListSessions)
+	sessions.GET("/:id", controllers.GetSession)
+	sessions.POST("/:id/terminate", controllers.TerminateSession)
+	sessions.GET("/:id/observe", controllers.ObserveSession)
+	sessions.GET("/:id/events", controllers.ListSessionEvents)
+	sessions.GET("/:id/recording", controllers.GetSessionRecording)
+	sessions.GET("/:id/playback", controllers.PlaybackSession)
+	sessions.POST("/:id/shares", controllers.CreateShare)
+	sessions.GET("/:id/shares", controllers.ListShares)
+	sessions.DELETE("/:id/shares/:share_id", controllers.RevokeShare)
+	router.GET("/sessions/:id/connect", controllers.RequireAuthOrShareLink(), controllers.ConnectSession)
+
+	admin := router.Group("/admin", auth.RequireAuth(), auth.RequireAdmin())
+	admin.GET("/sessions", controllers.ListAllSessions)
+	return router
+}
+
+func performRequest(r *gin.Engine, method, path, token string, body interface{}) *httptest.ResponseRecorder {
+	jsonBody, _ := json.Marshal(body)
+	req, _ := http.NewRequest(method, path, bytes.NewBuffer(jsonBody))
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+// login registers a user and returns its access token and ID.
+func login(t *testing.T, router *gin.Engine, email string) (string, uint) {
+	registerBody := map[string]string{
+		"display_name": "testuser",
+		"email":        email,
+		"password":     "testpassword",
+	}
+	wRegister := performRequest(router, "POST", "/auth/register", "", registerBody)
+	assert.Equal(t, http.StatusOK, wRegister.Code)
+
+	loginBody := map[string]string{
+		"email":    email,
+		"password": "testpassword",
+	}
+	wLogin := performRequest(router, "POST", "/auth/login", "", loginBody)
+	assert.Equal(t, http.StatusOK, wLogin.Code)
+
+	var loginResponse map[string]string
+	json.Unmarshal(wLogin.Body.Bytes(), &loginResponse)
+	claims, err := auth.ValidateJWT(loginResponse["access_token"])
+	assert.NoError(t, err)
+	return loginResponse["access_token"], claims.UserID
+}
+
+func createSession(t *testing.T, router *gin.Engine, token string) models.Session {
+	w := performRequest(router, "POST", "/sessions", token, map[string]string{})
+	assert.Equal(t, http.StatusCreated, w.Code)
+
+	var session models.Session
+	json.Unmarshal(w.Body.Bytes(), &session)
+	return session
+}
+
+type sessionPage struct {
+	Sessions []models.Session `json:"sessions"`
+	Page     int              `json:"page"`
+	PerPage  int              `json:"per_page"`
+	Total    int64            `json:"total"`
+}
+
+func listSessions(t *testing.T, router *gin.Engine, path, token string) sessionPage {
+	w := performRequest(router, "GET", path, token, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var page sessionPage
+	json.Unmarshal(w.Body.Bytes(), &page)
+	return page
+}
+
+func TestSessionLifecycle(t *testing.T) {
+	database.InitTestDB()
+	router := newRouter()
+	token, userID := login(t, router, "sessions1@example.com")
+
+	session := createSession(t, router, token)
+	assert.Equal(t, userID, session.UserID)
+	assert.Equal(t, models.SessionActive, session.Status)
+
+	w := performRequest(router, "GET", fmt.Sprintf("/sessions/%d", session.ID), token, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = performRequest(router, "POST", fmt.Sprintf("/sessions/%d/terminate", session.ID), token, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var terminated models.Session
+	database.DB.First(&terminated, session.ID)
+	assert.Equal(t, models.SessionTerminated, terminated.Status)
+
+	database.ResetTestDB()
+}
+
+func TestSessionsAreScopedToTheirOwner(t *testing.T) {
+	database.InitTestDB()
+	router := newRouter()
+	ownerToken, _ := login(t, router, "sessions2@example.com")
+	otherToken, _ := login(t, router, "sessions3@example.com")
+
+	session := createSession(t, router, ownerToken)
+
+	w := performRequest(router, "GET", fmt.Sprintf("/sessions/%d", session.ID), otherToken, nil)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	w = performRequest(router, "POST", fmt.Sprintf("/sessions/%d/terminate", session.ID), otherToken, nil)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	w = performRequest(router, "GET", "/sessions/999999", ownerToken, nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	page := listSessions(t, router, "/sessions", otherToken)
+	assert.Empty(t, page.Sessions)
+
+	database.ResetTestDB()
+}
+
+func TestConnectSessionChecksAccess(t *testing.T) {
+	database.InitTestDB()
+	router := newRouter()
+	ownerToken, _ := login(t, router, "sessions15@example.com")
+	otherToken, _ := login(t, router, "sessions16@example.com")
+	session := createSession(t, router, ownerToken)
+	path := fmt.Sprintf("/sessions/%d/connect", session.ID)
+
+	w := performRequest(router, "GET", path, otherToken, nil)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	w = performRequest(router, "GET", "/sessions/999999/connect", ownerToken, nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	performRequest(router, "POST", fmt.Sprintf("/sessions/%d/terminate", session.ID), ownerToken, nil)
+	w = performRequest(router, "GET", path, ownerToken, nil)
+	assert.Equal(t, http.StatusGone, w.Code)
+
+	database.ResetTestDB()
+}
+
+func TestTerminalsRequireVerifiedEmail(t *testing.T) {
+	database.InitTestDB()
+	router := newRouter()
+	token, userID := login(t, router, "sessions20@example.com")
+	session := createSession(t, router, token)
+
+	// Access tokens from before verification was required still work, but not for terminals
+	t.Setenv("REQUIRE_EMAIL_VERIFICATION", "true")
+	w := performRequest(router, "POST", "/sessions", token, map[string]string{})
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	w = performRequest(router, "GET", fmt.Sprintf("/sessions/%d/connect", session.ID), token, nil)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	w = performRequest(router, "GET", "/sessions", token, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	database.DB.Model(&auth.UserCredentials{}).Where("user_id = ?", userID).Update("email_verified", true)
+	createSession(t, router, token)
+
+	database.ResetTestDB()
+}
+
+func TestListSessionsFiltersAndPaginates(t *testing.T) {
+	database.InitTestDB()
+	router := newRouter()
+	token, _ := login(t, router, "sessions4@example.com")
+
+	for i := 0; i < 3; i++ {
+		createSession(t, router, token)
+	}
+	terminated := createSession(t, router, token)
+	performRequest(router, "POST", fmt.Sprintf("/sessions/%d/terminate", terminated.ID), token, nil)
+
+	page := listSessions(t, router, "/sessions?status=active&per_page=2", token)
+	assert.Equal(t, int64(3), page.Total)
+	assert.Len(t, page.Sessions, 2)
+
+	page = listSessions(t, router, "/sessions?status=active&per_page=2&page=2", token)
+	assert.Len(t, page.Sessions, 1)
+
+	page = listSessions(t, router, "/sessions?status=terminated", token)
+	assert.Equal(t, int64(1), page.Total)
+	assert.Equal(t, terminated.ID, page.Sessions[0].ID)
+
+	w := performRequest(router, "GET", "/sessions?status=bogus", token, nil)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = performRequest(router, "GET", "/sessions?per_page=1000", token, nil)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	database.ResetTestDB()
+}
+
+func TestAdminListsSessionsAcrossUsers(t *testing.T) {
+	database.InitTestDB()
+	router := newRouter()
+	userToken, userID := login(t, router, "sessions5@example.com")
+	adminToken, adminID := login(t, router, "sessions6@example.com")
+	database.DB.Model(&auth.User{}).Where("id = ?", adminID).Update("is_admin", true)
+
+	createSession(t, router, userToken)
+
+	w := performRequest(router, "GET", "/admin/sessions", userToken, nil)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	page := listSessions(t, router, fmt.Sprintf("/admin/sessions?user_id=%d", userID), adminToken)
+	assert.Equal(t, int64(1), page.Total)
+	assert.Equal(t, userID, page.Sessions[0].UserID)
+
+	database.ResetTestDB()
+}
+
+func TestCreateSessionValidatesShellProfile(t *testing.T) {
+	database.InitTestDB()
+	router := newRouter()
+	token, _ := login(t, router, "sessions7@example.com")
+
+	w := performRequest(router, "POST", "/sessions", token, map[string]string{"profile": "bash"})
+	assert.Equal(t, http.StatusCreated, w.Code)
+
+	for _, profile := range []string{"does-not-exist", "/bin/sh", "../bash"} {
+		w := performRequest(router, "POST", "/sessions", token, map[string]string{"profile": profile})
+		assert.Equal(t, http.StatusBadRequest, w.Code, profile)
+	}
+
+	database.ResetTestDB()
+}
+
+func TestObserveSessionChecksAccess(t *testing.T) {
+	database.InitTestDB()
+	router := newRouter()
+
+	ownerToken, _ := login(t, router, "sessions9@example.com")
+	otherToken, _ := login(t, router, "sessions10@example.com")
+	adminToken, adminID := login(t, router, "sessions11@example.com")
+	assert.NoError(t, database.DB.Model(&auth.User{}).Where("id = ?", adminID).Update("is_admin", true).Error)
+	session := createSession(t, router, ownerToken)
+	path := fmt.Sprintf("/sessions/%d", session.ID)
+
+	w := performRequest(router, "GET", path+"/observe", otherToken, nil)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	// Nothing to watch until the owner connects
+	w = performRequest(router, "GET", path+"/observe", adminToken, nil)
+	assert.Equal(t, http.StatusConflict, w.Code)
+
+	controllers.LogSessionEvent(session.ID, adminID, 0, models.SessionEventObserverAttached)
+	controllers.LogSessionEvent(session.ID, adminID, 0, models.SessionEventObserverDetached)
+	controllers.LogSessionEvent(session.ID, 0, 5, models.SessionEventObserverAttached)
+
+	w = performRequest(router, "GET", path+"/events", otherToken, nil)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	w = performRequest(router, "GET", path+"/events", ownerToken, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var response struct{ Events []models.SessionEvent }
+	json.Unmarshal(w.Body.Bytes(), &response)
+	if assert.Len(t, response.Events, 3) {
+		assert.Equal(t, models.SessionEventObserverAttached, response.Events[0].Type)
+		assert.Equal(t, models.SessionEventObserverDetached, response.Events[1].Type)
+		assert.Equal(t, adminID, response.Events[1].UserID)
+		assert.Nil(t, response.Events[1].ShareID)
+		// Guests are told apart by their share link
+		assert.Equal(t, uint(0), response.Events[2].UserID)
+		if assert.NotNil(t, response.Events[2].ShareID) {
+			assert.Equal(t, uint(5), *response.Events[2].ShareID)
+		}
+	}
+
+	database.ResetTestDB()
+}
+
+// recordSession gives a session a short recording, as if it was recorded while it ran.
+func recordSession(t *testing.T, sessionID uint) {
+	path := filepath.Join(t.TempDir(), "session.cast")
+	cast := `{"version": 2, "width": 80, "height": 24}` + "\n" + `[0.1, "o", "hello"]` + "\n"
+	assert.NoError(t, os.WriteFile(path, []byte(cast), 0600))
+	assert.NoError(t, database.DB.Model(&models.Session{}).Where("id = ?", sessionID).Update("recording_path", path).Error)
+}
+
+func TestGetSessionRecordingChecksAccess(t *testing.T) {
+	database.InitTestDB()
+	router := newRouter()
+	ownerToken, _ := login(t, router, "sessions17@example.com")
+	otherToken, _ := login(t, router, "sessions18@example.com")
+	adminToken, adminID := login(t, router, "sessions19@example.com")
+	assert.NoError(t, database.DB.Model(&auth.User{}).Where("id = ?", adminID).Update("is_admin", true).Error)
+	session := createSession(t, router, ownerToken)
+	path := fmt.Sprintf("/sessions/%d/recording", session.ID)
+
+	w := performRequest(router, "GET", path, ownerToken, nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	recordSession(t, session.ID)
+
+	w = performRequest(router, "GET", path, otherToken, nil)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	for _, token := range []string{ownerToken, adminToken} {
+		w = performRequest(router, "GET", path, token, nil)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "application/x-asciicast", w.Header().Get("Content-Type"))
+		assert.Contains(t, w.Header().Get("Content-Disposition"), fmt.Sprintf("session-%d.cast", session.ID))
+		assert.Contains(t, w.Body.String(), `"hello"`)
+	}
+
+	database.ResetTestDB()
+}
+
+func TestPlaybackSessionChecksAccess(t *testing.T) {
+	database.InitTestDB()
+	router := newRouter()
+	ownerToken, _ := login(t, router, "sessions12@example.com")
+	otherToken, _ := login(t, router, "sessions13@example.com")
+	adminToken, adminID := login(t, router, "sessions14@example.com")
+	assert.NoError(t, database.DB.Model(&auth.User{}).Where("id = ?", adminID).Update("is_admin", true).Error)
+	session := createSession(t, router, ownerToken)
+	path := fmt.Sprintf("/sessions/%d/playback", session.ID)
+
+	// Nothing to play back before anything was recorded
+	w := performRequest(router, "GET", path, ownerToken, nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	recordSession(t, session.ID)
+
+	w = performRequest(router, "GET", path, otherToken, nil)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	w = performRequest(router, "GET", path+"?speed=100", ownerToken, nil)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = performRequest(router, "GET", "/sessions/999999/playback", ownerToken, nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	server := httptest.NewServer(router)
+	defer server.Close()
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + path
+	dialer := websocket.Dialer{Subprotocols: []string{terminal.Subprotocol}}
+	for _, token := range []string{ownerToken, adminToken} {
+		conn, _, err := dialer.Dial(url, http.Header{"Authorization": {"Bearer " + token}})
+		if !assert.NoError(t, err) {
+			continue
+		}
+		// The recorded output is played back
+		var output strings.Builder
+		for !strings.Contains(output.String(), "hello") {
+			_, msg, err := conn.ReadMessage()
+			if !assert.NoError(t, err) {
+				break
+			}
+			frame, _ := terminal.DecodeFrame(msg)
+			output.Write(frame.Payload)
+		}
+		conn.Close()
+	}
+
+	database.ResetTestDB()
+}
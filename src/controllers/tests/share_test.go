@@ -0,0 +1,178 @@
+package controllers
+
+import (
+	"encoding/json"
+	"fmt"
+	"let-me-in/database"
+	"let-me-in/models"
+	"let-me-in/terminal"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+type shareResponse struct {
+	Share models.SessionShare `json:"share"`
+	Token string              `json:"token"`
+}
+
+func createShare(t *testing.T, router *gin.Engine, token string, sessionID uint, body interface{}) shareResponse {
+	w := performRequest(router, "POST", fmt.Sprintf("/sessions/%d/shares", sessionID), token, body)
+	assert.Equal(t, http.StatusCreated, w.Code)
+
+	var response shareResponse
+	json.Unmarshal(w.Body.Bytes(), &response)
+	return response
+}
+
+func TestCreateShareValidatesInput(t *testing.T) {
+	database.InitTestDB()
+	router := newRouter()
+	ownerToken, _ := login(t, router, "shares1@example.com")
+	otherToken, _ := login(t, router, "shares2@example.com")
+	session := createSession(t, router, ownerToken)
+	path := fmt.Sprintf("/sessions/%d/shares", session.ID)
+
+	w := performRequest(router, "POST", path, ownerToken, map[string]interface{}{"mode": "admin"})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = performRequest(router, "POST", path, ownerToken, map[string]interface{}{"expires_in": 30 * 24 * 3600})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = performRequest(router, "POST", path, otherToken, map[string]interface{}{})
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	share := createShare(t, router, ownerToken, session.ID, map[string]interface{}{})
+	assert.Equal(t, models.ShareReadOnly, share.Share.Mode)
+	assert.False(t, share.Share.SingleUse)
+	assert.NotEmpty(t, share.Token)
+
+	database.ResetTestDB()
+}
+
+func TestShareLinkChecks(t *testing.T) {
+	database.InitTestDB()
+	router := newRouter()
+	ownerToken, _ := login(t, router, "shares3@example.com")
+	session := createSession(t, router, ownerToken)
+	other := createSession(t, router, ownerToken)
+	share := createShare(t, router, ownerToken, session.ID, map[string]interface{}{"mode": models.ShareReadWrite})
+	connect := fmt.Sprintf("/sessions/%d/connect?share=", session.ID)
+
+	// A valid link gets past authentication, but there is nothing running to join yet
+	w := performRequest(router, "GET", connect+share.Token, "", nil)
+	assert.Equal(t, http.StatusConflict, w.Code)
+
+	w = performRequest(router, "GET", connect+share.Token+"x", "", nil)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	w = performRequest(router, "GET", fmt.Sprintf("/sessions/%d/connect?share=%s", other.ID, share.Token), "", nil)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	// Without a link, connecting still requires an account
+	w = performRequest(router, "GET", fmt.Sprintf("/sessions/%d/connect", session.ID), "", nil)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	w = performRequest(router, "DELETE", fmt.Sprintf("/sessions/%d/shares/%d", session.ID, share.Share.ID), ownerToken, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = performRequest(router, "GET", connect+share.Token, "", nil)
+	assert.Equal(t, http.StatusGone, w.Code)
+
+	w = performRequest(router, "GET", fmt.Sprintf("/sessions/%d/shares", session.ID), ownerToken, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var list struct{ Shares []models.SessionShare }
+	json.Unmarshal(w.Body.Bytes(), &list)
+	if assert.Len(t, list.Shares, 1) {
+		assert.NotNil(t, list.Shares[0].RevokedAt)
+	}
+
+	// Terminating a session kills its links
+	share = createShare(t, router, ownerToken, session.ID, map[string]interface{}{})
+	performRequest(router, "POST", fmt.Sprintf("/sessions/%d/terminate", session.ID), ownerToken, nil)
+	w = performRequest(router, "GET", connect+share.Token, "", nil)
+	assert.Equal(t, http.StatusGone, w.Code)
+
+	database.ResetTestDB()
+}
+
+func TestSingleUseShareLink(t *testing.T) {
+	database.InitTestDB()
+	router := newRouter()
+	ownerToken, _ := login(t, router, "shares4@example.com")
+	session := createSession(t, router, ownerToken)
+	share := createShare(t, router, ownerToken, session.ID, map[string]interface{}{"single_use": true})
+
+	_, err := terminal.Sessions.Start(session.ID, models.BackendLocal, terminal.DefaultProfiles()[terminal.DefaultProfile].Spec(""))
+	assert.NoError(t, err)
+	defer terminal.Sessions.Terminate(session.ID, models.TerminatedByUser)
+
+	server := httptest.NewServer(router)
+	defer server.Close()
+	url := fmt.Sprintf("ws%s/sessions/%d/connect?share=%s", strings.TrimPrefix(server.URL, "http"), session.ID, share.Token)
+
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if assert.NoError(t, err) {
+		conn.Close()
+	}
+
+	_, resp, err := websocket.DefaultDialer.Dial(url, nil)
+	assert.Error(t, err)
+	if assert.NotNil(t, resp) {
+		assert.Equal(t, http.StatusGone, resp.StatusCode)
+	}
+
+	database.ResetTestDB()
+}
+
+func TestGuestsAreDisconnectedWhenTheirLinkEnds(t *testing.T) {
+	database.InitTestDB()
+	router := newRouter()
+	ownerToken, _ := login(t, router, "shares5@example.com")
+	session := createSession(t, router, ownerToken)
+	revoked := createShare(t, router, ownerToken, session.ID, map[string]interface{}{})
+	expiring := createShare(t, router, ownerToken, session.ID, map[string]interface{}{"expires_in": 2})
+
+	_, err := terminal.Sessions.Start(session.ID, models.BackendLocal, terminal.DefaultProfiles()[terminal.DefaultProfile].Spec(""))
+	assert.NoError(t, err)
+	defer terminal.Sessions.Terminate(session.ID, models.TerminatedByUser)
+
+	server := httptest.NewServer(router)
+	defer server.Close()
+	connect := func(token string) *websocket.Conn {
+		url := fmt.Sprintf("ws%s/sessions/%d/connect?share=%s", strings.TrimPrefix(server.URL, "http"), session.ID, token)
+		conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+		if err != nil {
+			t.Fatalf("failed to connect: %v", err)
+		}
+		return conn
+	}
+	// waitClosed waits for the server to close conn
+	waitClosed := func(conn *websocket.Conn) {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				assert.NotContains(t, err.Error(), "timeout")
+				return
+			}
+		}
+	}
+
+	guest := connect(revoked.Token)
+	defer guest.Close()
+	w := performRequest(router, "DELETE", fmt.Sprintf("/sessions/%d/shares/%d", session.ID, revoked.Share.ID), ownerToken, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	waitClosed(guest)
+
+	guest = connect(expiring.Token)
+	defer guest.Close()
+	waitClosed(guest)
+	assert.False(t, time.Now().Before(expiring.Share.ExpiresAt))
+
+	database.ResetTestDB()
+}
@@ -0,0 +1,125 @@
+package mailer
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"mime"
+	"net"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"let-me-in/config"
+)
+
+// Message is a plain text email.
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer delivers emails.
+type Mailer interface {
+	Send(msg Message) error
+}
+
+// Default is the mailer the application sends through. It writes to the outbox
+// directory until serve configures it from the environment.
+var Default Mailer = &FileMailer{Dir: "outbox", From: "let-me-in@localhost"}
+
+// FromEnv returns the mailer MAILER selects: "smtp" for SMTPMailer, or "file" (the
+// default) for FileMailer.
+func FromEnv() (Mailer, error) {
+	from := config.GetEnv("MAIL_FROM", "let-me-in@localhost")
+
+	switch kind := config.GetEnv("MAILER", "file"); kind {
+	case "file":
+		return &FileMailer{Dir: config.GetEnv("MAIL_OUTBOX_DIR", "outbox"), From: from}, nil
+	case "smtp":
+		host := config.GetEnv("SMTP_HOST", "")
+		if host == "" {
+			return nil, fmt.Errorf("SMTP_HOST is required for the smtp mailer")
+		}
+		return &SMTPMailer{
+			Addr:     net.JoinHostPort(host, config.GetEnv("SMTP_PORT", "587")),
+			Username: config.GetEnv("SMTP_USERNAME", ""),
+			Password: config.GetEnv("SMTP_PASSWORD", ""),
+			From:     from,
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown MAILER %q, expected smtp or file", kind)
+	}
+}
+
+// SMTPMailer delivers emails through an SMTP server, upgrading to TLS when the server
+// supports it.
+type SMTPMailer struct {
+	Addr     string // host:port
+	Username string // no authentication when empty
+	Password string
+	From     string
+}
+
+func (m *SMTPMailer) Send(msg Message) error {
+	var auth smtp.Auth
+	if m.Username != "" {
+		host, _, _ := net.SplitHostPort(m.Addr)
+		auth = smtp.PlainAuth("", m.Username, m.Password, host)
+	}
+	data, err := format(m.From, msg)
+	if err != nil {
+		return err
+	}
+	return smtp.SendMail(m.Addr, auth, m.From, []string{msg.To}, data)
+}
+
+// FileMailer writes every email to its own file in Dir instead of delivering it, for
+// development and tests.
+type FileMailer struct {
+	Dir  string
+	From string
+}
+
+func (m *FileMailer) Send(msg Message) error {
+	data, err := format(m.From, msg)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(m.Dir, 0o700); err != nil {
+		return err
+	}
+
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return err
+	}
+	// Named so that listing the directory sorts them oldest first
+	name := fmt.Sprintf("%s-%s.eml", time.Now().UTC().Format("20060102T150405.000000000"), hex.EncodeToString(suffix))
+	return os.WriteFile(filepath.Join(m.Dir, name), data, 0o600)
+}
+
+// format renders msg as an RFC 5322 message.
+func format(from string, msg Message) ([]byte, error) {
+	// Line breaks would let the values add headers of their own
+	for _, header := range []string{from, msg.To, msg.Subject} {
+		if strings.ContainsAny(header, "\r\n") {
+			return nil, errors.New("line break in email header")
+		}
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", msg.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", msg.Subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("\r\n")
+	b.WriteString(strings.ReplaceAll(strings.ReplaceAll(msg.Body, "\r\n", "\n"), "\n", "\r\n"))
+	return []byte(b.String()), nil
+}
@@ -0,0 +1,120 @@
+package mailer
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"let-me-in/mailer"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var message = mailer.Message{To: "user@example.com", Subject: "Hello", Body: "First line\nSecond line\n"}
+
+func TestFileMailerWritesOneFilePerMessage(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "outbox")
+	m := &mailer.FileMailer{Dir: dir, From: "noreply@example.com"}
+
+	assert.NoError(t, m.Send(message))
+	assert.NoError(t, m.Send(mailer.Message{To: "other@example.com", Subject: "Again"}))
+
+	entries, err := os.ReadDir(dir)
+	assert.NoError(t, err)
+	if assert.Len(t, entries, 2) {
+		data, err := os.ReadFile(filepath.Join(dir, entries[0].Name()))
+		assert.NoError(t, err)
+		assert.Contains(t, string(data), "From: noreply@example.com\r\n")
+		assert.Contains(t, string(data), "To: user@example.com\r\n")
+		assert.Contains(t, string(data), "Subject: Hello\r\n")
+		assert.True(t, strings.HasSuffix(string(data), "\r\n\r\nFirst line\r\nSecond line\r\n"))
+	}
+}
+
+func TestMailerRejectsHeaderInjection(t *testing.T) {
+	m := &mailer.FileMailer{Dir: t.TempDir(), From: "noreply@example.com"}
+	assert.Error(t, m.Send(mailer.Message{To: "user@example.com\r\nBcc: everyone@example.com", Subject: "Hello"}))
+	assert.Error(t, m.Send(mailer.Message{To: "user@example.com", Subject: "Hello\nBcc: everyone@example.com"}))
+}
+
+// startSMTPServer accepts a single SMTP session and sends the message data it received.
+func startSMTPServer(t *testing.T) (string, <-chan string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	received := make(chan string, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		r := bufio.NewReader(conn)
+		reply := func(line string) { conn.Write([]byte(line + "\r\n")) }
+		reply("220 localhost ESMTP")
+		var data strings.Builder
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			switch command := strings.ToUpper(strings.TrimSpace(line)); {
+			case strings.HasPrefix(command, "EHLO"):
+				reply("250 localhost")
+			case command == "DATA":
+				reply("354 go ahead")
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil || line == ".\r\n" {
+						break
+					}
+					data.WriteString(line)
+				}
+				received <- data.String()
+				reply("250 queued")
+			case command == "QUIT":
+				reply("221 bye")
+				return
+			default: // MAIL, RCPT
+				reply("250 ok")
+			}
+		}
+	}()
+	return listener.Addr().String(), received
+}
+
+func TestSMTPMailerDelivers(t *testing.T) {
+	addr, received := startSMTPServer(t)
+	m := &mailer.SMTPMailer{Addr: addr, From: "noreply@example.com"}
+
+	assert.NoError(t, m.Send(message))
+	data := <-received
+	assert.Contains(t, data, "To: user@example.com\r\n")
+	assert.Contains(t, data, "\r\n\r\nFirst line\r\nSecond line\r\n")
+}
+
+func TestFromEnv(t *testing.T) {
+	t.Setenv("MAILER", "file")
+	t.Setenv("MAIL_OUTBOX_DIR", "/tmp/outbox")
+	m, err := mailer.FromEnv()
+	assert.NoError(t, err)
+	assert.Equal(t, "/tmp/outbox", m.(*mailer.FileMailer).Dir)
+
+	t.Setenv("MAILER", "smtp")
+	_, err = mailer.FromEnv()
+	assert.Error(t, err, "SMTP_HOST is required")
+
+	t.Setenv("SMTP_HOST", "mail.example.com")
+	m, err = mailer.FromEnv()
+	assert.NoError(t, err)
+	assert.Equal(t, "mail.example.com:587", m.(*mailer.SMTPMailer).Addr)
+
+	t.Setenv("MAILER", "pigeon")
+	_, err = mailer.FromEnv()
+	assert.Error(t, err)
+}
@@ -4,13 +4,68 @@ import (
 	"time"
 )
 
+// Session status values.
+const (
+	SessionActive       = "active"       // a WebSocket is attached to the terminal
+	SessionDisconnected = "disconnected" // the terminal is running but nobody is attached
+	SessionTerminated   = "terminated"   // the terminal process is gone
+)
+
+// Backends a session can run on.
+const (
+	BackendLocal     = "local"     // a PTY on the server itself
+	BackendContainer = "container" // an exec instance inside Session.ContainerID
+)
+
+// Reasons a session was terminated.
+const (
+	TerminatedByUser        = "user_request"       // the owner terminated it through the API
+	TerminatedProcessExited = "process_exited"     // the shell exited on its own
+	TerminatedDisconnected  = "disconnect_timeout" // nobody reattached within SESSION_TIMEOUT
+	TerminatedIdle          = "idle_timeout"       // no traffic for SESSION_IDLE_TIMEOUT
+	TerminatedUserDisabled  = "user_disabled"      // its owner was disabled
+)
+
+// Types of SessionEvent.
+const (
+	SessionEventObserverAttached = "observer_attached" // someone started watching the session
+	SessionEventObserverDetached = "observer_detached" // an observer went away
+	SessionEventControlGranted   = "control_granted"   // someone other than the owner was handed control
+	SessionEventControlRevoked   = "control_revoked"   // they lost it, to the owner or someone else
+)
+
 // Session represents a terminal session.
 type Session struct {
-	ID           uint      `gorm:"primaryKey"`
-	UserID       uint      `gorm:"not null"`
-	Status       string    `gorm:"default:active"` // active, inactive, terminated
-	ContainerID  string    `gorm:"not null"`
-	IPAddress    string    `gorm:"not null"`
-	LastActivity time.Time `gorm:"autoUpdateTime"`
-	CreatedAt    time.Time
+	ID                uint       `gorm:"primaryKey"`
+	UserID            uint       `gorm:"not null"`
+	Status            string     `gorm:"default:active"`         // active, disconnected, terminated
+	Backend           string     `gorm:"not null;default:local"` // local, container
+	Profile           string     `gorm:"not null;default:bash"`  // name of the shell profile
+	ContainerID       string     `gorm:"not null"`
+	IPAddress         string     `gorm:"not null"`
+	LastActivity      time.Time  `gorm:"autoUpdateTime"`
+	DisconnectedAt    *time.Time // set while nobody is attached, from when the last WebSocket went away
+	RecordingPath     string     `json:"-"` // asciicast file the terminal is recorded to
+	TerminationReason string     // set once the session is terminated
+	EndedAt           *time.Time // set once the session is terminated
+	CreatedAt         time.Time
+}
+
+// TerminatedColumns returns the column updates that mark a session as terminated for reason.
+func TerminatedColumns(reason string) map[string]interface{} {
+	return map[string]interface{}{
+		"status":             SessionTerminated,
+		"termination_reason": reason,
+		"ended_at":           time.Now(),
+	}
+}
+
+// SessionEvent is an entry of the audit trail of a session.
+type SessionEvent struct {
+	ID        uint   `gorm:"primaryKey"`
+	SessionID uint   `gorm:"not null;index"`
+	UserID    uint   `gorm:"not null"` // who caused the event, 0 for guests
+	ShareID   *uint  // the share link a guest connected through
+	Type      string `gorm:"not null"`
+	CreatedAt time.Time
 }
@@ -0,0 +1,24 @@
+package models
+
+import (
+	"time"
+)
+
+// Modes of a share link.
+const (
+	ShareReadOnly  = "read_only"  // guests can only watch
+	ShareReadWrite = "read_write" // guests can be handed control of the terminal
+)
+
+// SessionShare is a link that lets someone without an account join a session. The token
+// itself is never stored: it is signed, and names the share it was issued for.
+type SessionShare struct {
+	ID        uint       `gorm:"primaryKey"`
+	SessionID uint       `gorm:"not null;index"`
+	Mode      string     `gorm:"not null"` // read_only, read_write
+	SingleUse bool       `gorm:"not null;default:false"`
+	ExpiresAt time.Time  `gorm:"not null"`
+	UsedAt    *time.Time // last time a guest joined with the link
+	RevokedAt *time.Time
+	CreatedAt time.Time
+}
@@ -0,0 +1,160 @@
+package auth
+
+import (
+	"errors"
+	"math"
+)
+
+// maxCBORDepth bounds the nesting of CBOR items, so hostile input can't exhaust the stack.
+const maxCBORDepth = 16
+
+var errInvalidCBOR = errors.New("invalid CBOR")
+
+// decodeCBOR decodes the first CBOR (RFC 8949) item of data and returns it with the
+// number of bytes it took. It covers what WebAuthn attestation objects and COSE keys
+// use: integers become int64, byte strings []byte, text strings string, arrays
+// []interface{}, maps map[interface{}]interface{}, and simple values bool or nil.
+// Floats and indefinite lengths aren't supported; tags are skipped.
+func decodeCBOR(data []byte) (interface{}, int, error) {
+	d := cborDecoder{data: data}
+	item, err := d.item(0)
+	return item, d.pos, err
+}
+
+type cborDecoder struct {
+	data []byte
+	pos  int
+}
+
+func (d *cborDecoder) item(depth int) (interface{}, error) {
+	if depth > maxCBORDepth {
+		return nil, errInvalidCBOR
+	}
+
+	major, arg, err := d.head()
+	if err != nil {
+		return nil, err
+	}
+
+	switch major {
+	case 0: // unsigned integer
+		if arg > math.MaxInt64 {
+			return nil, errInvalidCBOR
+		}
+		return int64(arg), nil
+	case 1: // negative integer
+		if arg > math.MaxInt64 {
+			return nil, errInvalidCBOR
+		}
+		return -1 - int64(arg), nil
+	case 2: // byte string
+		b, err := d.bytes(arg)
+		if err != nil {
+			return nil, err
+		}
+		return append([]byte(nil), b...), nil
+	case 3: // text string
+		b, err := d.bytes(arg)
+		if err != nil {
+			return nil, err
+		}
+		return string(b), nil
+	case 4: // array
+		if arg > uint64(len(d.data)-d.pos) {
+			return nil, errInvalidCBOR
+		}
+		array := make([]interface{}, 0, arg)
+		for i := uint64(0); i < arg; i++ {
+			element, err := d.item(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			array = append(array, element)
+		}
+		return array, nil
+	case 5: // map
+		if arg > uint64(len(d.data)-d.pos) {
+			return nil, errInvalidCBOR
+		}
+		m := make(map[interface{}]interface{}, arg)
+		for i := uint64(0); i < arg; i++ {
+			key, err := d.item(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			switch key.(type) {
+			case int64, string:
+			default:
+				return nil, errInvalidCBOR
+			}
+			value, err := d.item(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			m[key] = value
+		}
+		return m, nil
+	case 6: // tag, only its content matters here
+		return d.item(depth + 1)
+	default: // simple values
+		switch arg {
+		case 20:
+			return false, nil
+		case 21:
+			return true, nil
+		case 22, 23:
+			return nil, nil
+		}
+		return nil, errInvalidCBOR
+	}
+}
+
+// head reads the initial byte of an item and its argument.
+func (d *cborDecoder) head() (byte, uint64, error) {
+	if d.pos >= len(d.data) {
+		return 0, 0, errInvalidCBOR
+	}
+	initial := d.data[d.pos]
+	d.pos++
+	major, info := initial>>5, initial&0x1f
+
+	if info < 24 {
+		return major, uint64(info), nil
+	}
+	if major == 7 && info > 24 {
+		return 0, 0, errInvalidCBOR // floats
+	}
+
+	var size int
+	switch info {
+	case 24:
+		size = 1
+	case 25:
+		size = 2
+	case 26:
+		size = 4
+	case 27:
+		size = 8
+	default:
+		return 0, 0, errInvalidCBOR // indefinite lengths and reserved values
+	}
+	b, err := d.bytes(uint64(size))
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var arg uint64
+	for _, c := range b {
+		arg = arg<<8 | uint64(c)
+	}
+	return major, arg, nil
+}
+
+func (d *cborDecoder) bytes(n uint64) ([]byte, error) {
+	if n > uint64(len(d.data)-d.pos) {
+		return nil, errInvalidCBOR
+	}
+	b := d.data[d.pos : d.pos+int(n)]
+	d.pos += int(n)
+	return b, nil
+}
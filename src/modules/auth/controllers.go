@@ -1,9 +1,11 @@
 package auth
 
 import (
+	"log"
 	"net/http"
 	"net/mail"
 	"regexp"
+	"strconv"
 	"time"
 
 	"let-me-in/database"
@@ -102,11 +104,13 @@ func RegisterUserHandler(c *gin.Context) {
 	}
 
 	// Create UserCredentials entry
+	now := time.Now()
 	userCredentials := UserCredentials{
-		Email:    input.Email,
-		Password: hashedPassword,
-		Salt:     salt,
-		UserID:   user.ID,
+		Email:              input.Email,
+		Password:           hashedPassword,
+		Salt:               salt,
+		UserID:             user.ID,
+		VerificationSentAt: &now,
 	}
 
 	if err := db.Create(&userCredentials).Error; err != nil {
@@ -114,8 +118,14 @@ func RegisterUserHandler(c *gin.Context) {
 		return
 	}
 
+	// The account exists either way, the user can ask for another link
+	if err := sendVerificationEmail(&userCredentials); err != nil {
+		log.Printf("Failed to send verification email to user %d: %v", user.ID, err)
+	}
+
 	c.JSON(http.StatusOK, gin.H{
-		"user": user,
+		"user":                        user,
+		"email_verification_required": RequireEmailVerification(),
 	})
 }
 
@@ -150,31 +160,71 @@ func LoginUserHandler(c *gin.Context) {
 		return
 	}
 
-	// Generate Access Token (JWT)
-	accessToken, err := GenerateJWT(userCredentials.UserID)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate access token: " + err.Error()})
+	// Disabled users keep their credentials, but can't use them
+	var user User
+	if err := db.First(&user, userCredentials.UserID).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch user data"})
+		return
+	}
+	if user.DisabledAt != nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Account is disabled"})
+		return
+	}
+	if emailUnverified(&userCredentials) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Email address is not verified"})
 		return
 	}
 
-	// Generate Refresh Token
-	refreshToken, err := GenerateRefreshToken()
+	// With two-factor authentication, the tokens are only handed out once the second
+	// factor was verified too
+	methods, err := mfaMethods(db, &userCredentials)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate refresh token: " + err.Error()})
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch second factors"})
+		return
+	}
+	if len(methods) > 0 {
+		mfaToken, err := generateToken(Claims{UserID: userCredentials.UserID, Purpose: PurposeMFA}, mfaTokenTTL)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate MFA token: " + err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"mfa_required": true, "mfa_token": mfaToken, "mfa_methods": methods})
 		return
 	}
 
-	expiresAt := time.Now().Add(1 * 24 * time.Hour).Unix() // 1 day expiration
+	logIn(c, userCredentials.UserID)
+}
 
-	// Store Refresh Token
-	refreshTokenModel := RefreshToken{
-		Token:     refreshToken,
-		UserID:    userCredentials.UserID,
-		ExpiresAt: expiresAt,
-		Active:    true,
+// logIn responds with an access token and a refresh token starting a new family.
+// Users who have to verify their email address first are refused, whichever way they
+// logged in.
+func logIn(c *gin.Context, userID uint) {
+	var credentials UserCredentials
+	if err := database.DB.Where("user_id = ?", userID).First(&credentials).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch user credentials"})
+		return
+	}
+	if emailUnverified(&credentials) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Email address is not verified"})
+		return
+	}
+
+	// Generate Access Token (JWT)
+	accessToken, err := GenerateJWT(userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate access token: " + err.Error()})
+		return
 	}
 
-	if err := db.Create(&refreshTokenModel).Error; err != nil {
+	// Generate Refresh Token, starting a new family
+	now := time.Now()
+	refreshToken, err := issueRefreshToken(database.DB, userID, "", device{
+		UserAgent:  c.Request.UserAgent(),
+		IPAddress:  c.ClientIP(),
+		SignedInAt: now,
+		LastUsedAt: now,
+	})
+	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store refresh token: " + err.Error()})
 		return
 	}
@@ -201,7 +251,7 @@ func RefreshTokenHandler(c *gin.Context) {
 
 	// Find the refresh token in the database
 	var refreshTokenModel RefreshToken
-	if err := db.Where("token = ?", input.RefreshToken).First(&refreshTokenModel).Error; err != nil {
+	if err := db.Where("token_hash = ?", HashRefreshToken(input.RefreshToken)).First(&refreshTokenModel).Error; err != nil {
 		if err == gorm.ErrRecordNotFound {
 			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid refresh token"})
 		} else {
@@ -210,6 +260,13 @@ func RefreshTokenHandler(c *gin.Context) {
 		return
 	}
 
+	// A token that was already rotated must have been copied: revoke the whole family,
+	// so neither the thief nor the user can go on with it
+	if refreshTokenModel.RotatedAt != nil {
+		refreshTokenReused(c, &refreshTokenModel)
+		return
+	}
+
 	// Check if the refresh token is active and not expired
 	if !refreshTokenModel.Active || time.Now().Unix() > refreshTokenModel.ExpiresAt {
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "Refresh token is expired or inactive"})
@@ -222,6 +279,11 @@ func RefreshTokenHandler(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch user data"})
 		return
 	}
+	// Logins from before verification was required don't get around it
+	if emailUnverified(&userCredentials) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Email address is not verified"})
+		return
+	}
 
 	// Generate new Access Token
 	accessToken, err := GenerateJWT(userCredentials.UserID)
@@ -237,18 +299,65 @@ func RefreshTokenHandler(c *gin.Context) {
 		return
 	}
 
-	// (Optional) Rotate refresh token
-	newRefreshToken, err := GenerateRefreshToken()
+	// Rotate the refresh token: retire the old one and issue a new one in the same family
+	var newRefreshToken string
+	reused, inactive := false, false
+	err = db.Transaction(func(tx *gorm.DB) error {
+		familyID := refreshTokenModel.FamilyID
+		retire := map[string]interface{}{"active": false, "rotated_at": time.Now()}
+		// Tokens issued before families existed start one now
+		if familyID == "" {
+			var err error
+			if familyID, err = generateFamilyID(); err != nil {
+				return err
+			}
+			retire["family_id"] = familyID
+		}
+
+		retired := tx.Model(&RefreshToken{}).
+			Where("id = ? AND rotated_at IS NULL AND active = ?", refreshTokenModel.ID, true).
+			Updates(retire)
+		if retired.Error != nil {
+			return retired.Error
+		}
+		// Something changed the token in the meantime. Only another rotation means it was
+		// copied, logging out deactivates it too
+		if retired.RowsAffected == 0 {
+			var current RefreshToken
+			if err := tx.First(&current, refreshTokenModel.ID).Error; err != nil && err != gorm.ErrRecordNotFound {
+				return err
+			}
+			if current.RotatedAt != nil {
+				reused = true
+			} else {
+				inactive = true
+			}
+			return nil
+		}
+
+		var err error
+		signedInAt := refreshTokenModel.SignedInAt
+		if signedInAt.IsZero() {
+			signedInAt = refreshTokenModel.CreatedAt
+		}
+		newRefreshToken, err = issueRefreshToken(tx, refreshTokenModel.UserID, familyID, device{
+			UserAgent:  c.Request.UserAgent(),
+			IPAddress:  c.ClientIP(),
+			SignedInAt: signedInAt,
+			LastUsedAt: time.Now(),
+		})
+		return err
+	})
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to rotate refresh token"})
 		return
 	}
-
-	// Deactivate old refresh token and store new one
-	refreshTokenModel.Token = newRefreshToken
-	refreshTokenModel.ExpiresAt = time.Now().Add(7 * 24 * time.Hour).Unix() // Extend expiry
-	if err := db.Save(&refreshTokenModel).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update refresh token"})
+	if reused {
+		refreshTokenReused(c, &refreshTokenModel)
+		return
+	}
+	if inactive {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Refresh token is expired or inactive"})
 		return
 	}
 
@@ -259,3 +368,166 @@ func RefreshTokenHandler(c *gin.Context) {
 		"refresh_token": newRefreshToken,
 	})
 }
+
+// LogoutHandler revokes the refresh token of the current device, and the access token
+// the request was made with.
+func LogoutHandler(c *gin.Context) {
+	var input struct {
+		RefreshToken string `json:"refresh_token" binding:"required"`
+	}
+
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
+		return
+	}
+
+	var refreshToken RefreshToken
+	err := database.DB.Where("token_hash = ? AND user_id = ?", HashRefreshToken(input.RefreshToken), CurrentUser(c).ID).First(&refreshToken).Error
+	if err == gorm.ErrRecordNotFound {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid refresh token"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to query refresh token"})
+		return
+	}
+
+	if err := revokeTokenFamily(database.DB, &refreshToken); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke refresh token"})
+		return
+	}
+
+	if err := RevokeAccessToken(database.DB, CurrentClaims(c)); err != nil && err != ErrTokenAlreadyRevoked {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke access token"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Logged out"})
+}
+
+// LogoutAllHandler revokes every access and refresh token of the current user, logging
+// all their devices out.
+func LogoutAllHandler(c *gin.Context) {
+	revoked, err := RevokeUserTokens(database.DB, CurrentUser(c).ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke tokens"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Logged out everywhere", "revoked": revoked})
+}
+
+// Device is a device the current user is logged in on, as listed by ListDevicesHandler.
+type Device struct {
+	ID         uint      `json:"id"`
+	UserAgent  string    `json:"user_agent"`
+	IPAddress  string    `json:"ip_address"`
+	SignedInAt time.Time `json:"signed_in_at"`
+	LastUsedAt time.Time `json:"last_used_at"` // when it last logged in or refreshed its tokens
+	ExpiresAt  time.Time `json:"expires_at"`
+}
+
+// ListDevicesHandler lists the devices the current user is logged in on: their active
+// refresh tokens, most recently used first.
+func ListDevicesHandler(c *gin.Context) {
+	var tokens []RefreshToken
+	err := database.DB.Where("user_id = ? AND active = ? AND expires_at > ?", CurrentUser(c).ID, true, time.Now().Unix()).
+		Order("COALESCE(last_used_at, created_at) DESC").Find(&tokens).Error
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch devices"})
+		return
+	}
+
+	devices := make([]Device, 0, len(tokens))
+	for _, token := range tokens {
+		signedInAt := token.SignedInAt
+		if signedInAt.IsZero() {
+			signedInAt = token.CreatedAt
+		}
+		// Tokens from before last use was tracked were issued on their last use
+		lastUsedAt := token.CreatedAt
+		if token.LastUsedAt != nil {
+			lastUsedAt = *token.LastUsedAt
+		}
+		devices = append(devices, Device{
+			ID:         token.ID,
+			UserAgent:  token.UserAgent,
+			IPAddress:  token.IPAddress,
+			SignedInAt: signedInAt,
+			LastUsedAt: lastUsedAt,
+			ExpiresAt:  time.Unix(token.ExpiresAt, 0),
+		})
+	}
+
+	c.JSON(http.StatusOK, gin.H{"devices": devices})
+}
+
+// RevokeDeviceHandler logs one of the current user's devices out. The ID may also be
+// that of a token the device has since rotated.
+func RevokeDeviceHandler(c *gin.Context) {
+	var refreshToken RefreshToken
+	err := database.DB.Where("id = ? AND user_id = ?", c.Param("id"), CurrentUser(c).ID).First(&refreshToken).Error
+	if err == gorm.ErrRecordNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Device not found"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch device"})
+		return
+	}
+
+	if err := revokeTokenFamily(database.DB, &refreshToken); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke device"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Device logged out"})
+}
+
+// DisableUserHandler disables a user, revoking all their tokens. Admins only.
+func DisableUserHandler(c *gin.Context) {
+	setUserDisabled(c, true)
+}
+
+// EnableUserHandler lets a disabled user log in again. Admins only.
+func EnableUserHandler(c *gin.Context) {
+	setUserDisabled(c, false)
+}
+
+func setUserDisabled(c *gin.Context, disabled bool) {
+	userID, err := strconv.ParseUint(c.Param("id"), 10, 0)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+	if uint(userID) == CurrentUser(c).ID {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "You can't disable or enable yourself"})
+		return
+	}
+
+	err = SetUserDisabled(database.DB, uint(userID), disabled)
+	if err == gorm.ErrRecordNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update user"})
+		return
+	}
+
+	var user User
+	database.DB.First(&user, userID)
+	c.JSON(http.StatusOK, gin.H{"user": user})
+}
+
+// refreshTokenReused revokes the family of a refresh token presented after it was
+// rotated, and records a security event for its user.
+func refreshTokenReused(c *gin.Context, token *RefreshToken) {
+	db := database.DB
+
+	if err := revokeTokenFamily(db, token); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke refresh tokens"})
+		return
+	}
+
+	recordSecurityEvent(c, token.UserID, SecurityEventRefreshTokenReuse, "refresh token family "+token.FamilyID+" revoked")
+
+	c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid refresh token"})
+}
@@ -0,0 +1,114 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"errors"
+	"math/big"
+)
+
+// COSE algorithms (RFC 9053) passkeys may use, in order of preference
+const (
+	coseAlgES256 = -7
+	coseAlgEdDSA = -8
+	coseAlgRS256 = -257
+)
+
+var coseAlgorithms = []int64{coseAlgES256, coseAlgEdDSA, coseAlgRS256}
+
+// COSE key parameters (RFC 9052)
+const (
+	coseKeyType   = 1
+	coseKeyAlg    = 3
+	coseKeyCurve  = -1 // EC2 and OKP keys
+	coseKeyX      = -2 // EC2 and OKP keys
+	coseKeyY      = -3 // EC2 keys
+	coseKeyRSAN   = -1 // RSA keys
+	coseKeyRSAE   = -2 // RSA keys
+	coseKeyOKP    = 1
+	coseKeyEC2    = 2
+	coseKeyRSA    = 3
+	coseCurveP256 = 1
+	coseCurveEd   = 6
+)
+
+var errUnsupportedKey = errors.New("unsupported credential public key")
+
+// coseKey is the public key of a WebAuthn credential.
+type coseKey struct {
+	alg    int64
+	public crypto.PublicKey
+}
+
+// parseCOSEKey decodes a COSE_Key and returns it with the number of bytes it took.
+func parseCOSEKey(data []byte) (*coseKey, int, error) {
+	item, n, err := decodeCBOR(data)
+	if err != nil {
+		return nil, 0, err
+	}
+	params, ok := item.(map[interface{}]interface{})
+	if !ok {
+		return nil, 0, errUnsupportedKey
+	}
+	kty, _ := params[int64(coseKeyType)].(int64)
+	alg, _ := params[int64(coseKeyAlg)].(int64)
+
+	key := &coseKey{alg: alg}
+	switch {
+	case kty == coseKeyEC2 && alg == coseAlgES256:
+		crv, _ := params[int64(coseKeyCurve)].(int64)
+		x, _ := params[int64(coseKeyX)].([]byte)
+		y, _ := params[int64(coseKeyY)].([]byte)
+		if crv != coseCurveP256 || len(x) != 32 || len(y) != 32 {
+			return nil, 0, errUnsupportedKey
+		}
+		// Rejects points that aren't on the curve
+		if _, err := ecdh.P256().NewPublicKey(append(append([]byte{4}, x...), y...)); err != nil {
+			return nil, 0, errUnsupportedKey
+		}
+		key.public = &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+	case kty == coseKeyOKP && alg == coseAlgEdDSA:
+		crv, _ := params[int64(coseKeyCurve)].(int64)
+		x, _ := params[int64(coseKeyX)].([]byte)
+		if crv != coseCurveEd || len(x) != ed25519.PublicKeySize {
+			return nil, 0, errUnsupportedKey
+		}
+		key.public = ed25519.PublicKey(x)
+	case kty == coseKeyRSA && alg == coseAlgRS256:
+		modulus, _ := params[int64(coseKeyRSAN)].([]byte)
+		e, _ := params[int64(coseKeyRSAE)].([]byte)
+		exponent := new(big.Int).SetBytes(e)
+		// 2048 to 4096 bits, larger keys would only make verifying slow
+		if len(modulus) < 256 || len(modulus) > 512 || !exponent.IsInt64() || exponent.Int64() < 3 || exponent.Int64() > 1<<31-1 {
+			return nil, 0, errUnsupportedKey
+		}
+		key.public = &rsa.PublicKey{N: new(big.Int).SetBytes(modulus), E: int(exponent.Int64())}
+	default:
+		return nil, 0, errUnsupportedKey
+	}
+	return key, n, nil
+}
+
+// verify checks the signature of data made with the private key.
+func (k *coseKey) verify(data, signature []byte) error {
+	digest := sha256.Sum256(data)
+
+	var valid bool
+	switch public := k.public.(type) {
+	case *ecdsa.PublicKey:
+		valid = ecdsa.VerifyASN1(public, digest[:], signature)
+	case ed25519.PublicKey:
+		valid = ed25519.Verify(public, data, signature)
+	case *rsa.PublicKey:
+		valid = rsa.VerifyPKCS1v15(public, crypto.SHA256, digest[:], signature) == nil
+	}
+	if !valid {
+		return errors.New("invalid signature")
+	}
+	return nil
+}
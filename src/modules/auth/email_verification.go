@@ -0,0 +1,281 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"let-me-in/config"
+	"let-me-in/database"
+	"let-me-in/mailer"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// defaultEmailVerificationTTL is how long verification links work unless
+// EMAIL_VERIFICATION_TTL says otherwise.
+const defaultEmailVerificationTTL = 24 * time.Hour
+
+// defaultVerificationResendInterval is how long a user waits between two verification
+// emails unless EMAIL_VERIFICATION_RESEND_INTERVAL says otherwise.
+const defaultVerificationResendInterval = time.Minute
+
+// Verification emails may be asked for EMAIL_VERIFICATION_RESEND_IP_LIMIT times per IP
+// address within verificationResendIPWindow.
+const (
+	verificationResendIPWindow       = time.Hour
+	defaultVerificationResendIPLimit = 10
+)
+
+var (
+	verificationResendsByAddress = newRateLimiter()
+	verificationResendsByIP      = newRateLimiter()
+)
+
+// verificationEmails tracks the verification emails being resent in the background.
+var verificationEmails sync.WaitGroup
+
+// WaitForVerificationEmails blocks until the verification emails asked for so far were
+// sent, or failed to.
+func WaitForVerificationEmails() {
+	verificationEmails.Wait()
+}
+
+// RequireEmailVerification tells whether users have to verify their email address before
+// they can log in, as REQUIRE_EMAIL_VERIFICATION says.
+func RequireEmailVerification() bool {
+	return config.GetBool("REQUIRE_EMAIL_VERIFICATION", false)
+}
+
+// emailVerificationSecret signs verification links. It is random unless configured;
+// random secrets invalidate links issued before a restart.
+var emailVerificationSecret = mustRandomSecret()
+
+func mustRandomSecret() []byte {
+	secret := make([]byte, minSecretLength)
+	if _, err := rand.Read(secret); err != nil {
+		panic(err)
+	}
+	return secret
+}
+
+// LoadEmailVerificationSecret sets up the secret verification links are signed with from
+// EMAIL_VERIFICATION_SECRET. It is required when REQUIRE_EMAIL_VERIFICATION is on, as
+// links that stop working on a restart would lock users out.
+func LoadEmailVerificationSecret() error {
+	secret := config.GetEnv("EMAIL_VERIFICATION_SECRET", "")
+	if secret == "" {
+		if RequireEmailVerification() {
+			return errors.New("EMAIL_VERIFICATION_SECRET is required with REQUIRE_EMAIL_VERIFICATION")
+		}
+		return nil
+	}
+	if len(secret) < minSecretLength {
+		return fmt.Errorf("EMAIL_VERIFICATION_SECRET must be at least %d bytes long", minSecretLength)
+	}
+	emailVerificationSecret = []byte(secret)
+	return nil
+}
+
+// MigrateEmailVerification adds the column email verification is recorded in, marking
+// the addresses of existing users verified so they aren't locked out once
+// REQUIRE_EMAIL_VERIFICATION is turned on.
+func MigrateEmailVerification(db *gorm.DB) error {
+	migrator := db.Migrator()
+	if !migrator.HasTable(&UserCredentials{}) || migrator.HasColumn(&UserCredentials{}, "email_verified") {
+		return nil
+	}
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Migrator().AddColumn(&UserCredentials{}, "EmailVerified"); err != nil {
+			return err
+		}
+		return tx.Model(&UserCredentials{}).Where("1 = 1").Update("email_verified", true).Error
+	})
+}
+
+// emailUnverified tells whether a user can't log in until they verified their address.
+func emailUnverified(credentials *UserCredentials) bool {
+	return RequireEmailVerification() && !credentials.EmailVerified
+}
+
+// CheckEmailVerified tells whether the user authenticated by RequireAuth may use the
+// service, which with REQUIRE_EMAIL_VERIFICATION takes a verified address. Access tokens
+// outlive the check at login, so handlers that start terminals check again. It writes
+// the error response and returns false otherwise.
+func CheckEmailVerified(c *gin.Context) bool {
+	if !RequireEmailVerification() {
+		return true
+	}
+
+	credentials, ok := currentCredentials(c)
+	if !ok {
+		return false
+	}
+	if emailUnverified(credentials) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Email address is not verified"})
+		return false
+	}
+	return true
+}
+
+// signEmailVerification returns the token of a verification link: the credentials' ID and
+// the link's expiry, followed by their signature. The signature also covers the address,
+// so the link stops working if it changes.
+func signEmailVerification(credentials *UserCredentials, expiresAt time.Time) string {
+	payload := fmt.Sprintf("%d.%d", credentials.ID, expiresAt.Unix())
+	return payload + "." + emailVerificationSignature(payload, credentials.Email)
+}
+
+func emailVerificationSignature(payload, email string) string {
+	mac := hmac.New(sha256.New, emailVerificationSecret)
+	mac.Write([]byte(payload + "." + email))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// findEmailVerification loads the credentials a verification token was issued for, if
+// its signature is valid and it didn't expire.
+func findEmailVerification(db *gorm.DB, token string) (*UserCredentials, bool) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, false
+	}
+	id, err := strconv.ParseUint(parts[0], 10, 64)
+	if err != nil {
+		return nil, false
+	}
+	expiresAt, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || time.Now().Unix() >= expiresAt {
+		return nil, false
+	}
+
+	var credentials UserCredentials
+	if err := db.First(&credentials, id).Error; err != nil {
+		return nil, false
+	}
+	if !hmac.Equal([]byte(parts[2]), []byte(emailVerificationSignature(parts[0]+"."+parts[1], credentials.Email))) {
+		return nil, false
+	}
+	return &credentials, true
+}
+
+// sendVerificationEmail emails a verification link to the address of credentials.
+func sendVerificationEmail(credentials *UserCredentials) error {
+	ttl := config.GetDuration("EMAIL_VERIFICATION_TTL", defaultEmailVerificationTTL)
+	token := signEmailVerification(credentials, time.Now().Add(ttl))
+
+	return mailer.Default.Send(mailer.Message{
+		To:      credentials.Email,
+		Subject: "Verify your email address",
+		Body: fmt.Sprintf("Confirm this is your email address by opening this link:\n\n%s\n\n"+
+			"The link works for %s. If you didn't create an account, ignore this email.\n",
+			appLink("/verify-email", url.Values{"token": {token}}), ttl),
+	})
+}
+
+// VerifyEmailHandler marks the address a verification link was sent to as verified.
+func VerifyEmailHandler(c *gin.Context) {
+	var input struct {
+		Token string `json:"token" binding:"required"`
+	}
+
+	db := database.DB
+
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
+		return
+	}
+
+	credentials, ok := findEmailVerification(db, input.Token)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired verification link"})
+		return
+	}
+	if err := db.Model(credentials).Update("email_verified", true).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify email"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Email verified"})
+}
+
+// ResendVerificationEmailHandler emails another verification link. Like
+// ForgotPasswordHandler it responds the same for every address, registered, verified or
+// not, before anything is looked up or sent. Requests are limited to one per
+// EMAIL_VERIFICATION_RESEND_INTERVAL per address, and EMAIL_VERIFICATION_RESEND_IP_LIMIT
+// per hour per IP address.
+func ResendVerificationEmailHandler(c *gin.Context) {
+	var input struct {
+		Email string `json:"email" binding:"required"`
+	}
+
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
+		return
+	}
+
+	address := strings.ToLower(strings.TrimSpace(input.Email))
+	interval := config.GetDuration("EMAIL_VERIFICATION_RESEND_INTERVAL", defaultVerificationResendInterval)
+	allowed, wait := verificationResendsByIP.allow(c.ClientIP(), config.GetInt("EMAIL_VERIFICATION_RESEND_IP_LIMIT", defaultVerificationResendIPLimit), verificationResendIPWindow)
+	if allowed {
+		allowed, wait = verificationResendsByAddress.allow(address, 1, interval)
+	}
+	if !allowed {
+		c.Header("Retry-After", strconv.Itoa(max(1, int(math.Ceil(wait.Seconds())))))
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": "Too many verification email requests, try again later"})
+		return
+	}
+
+	verificationEmails.Add(1)
+	go func() {
+		defer verificationEmails.Done()
+		resendVerificationEmail(input.Email, interval)
+	}()
+	c.JSON(http.StatusOK, gin.H{"message": "If the address is registered and unverified, a verification link was sent to it"})
+}
+
+// resendVerificationEmail emails a verification link to the user with the given address,
+// unless there is none, it is verified, or one was sent less than interval ago, by this
+// instance or another. Failures are only logged, the caller can't tell them apart.
+func resendVerificationEmail(email string, interval time.Duration) {
+	db := database.DB
+
+	var credentials UserCredentials
+	if err := db.Where("email = ?", email).First(&credentials).Error; err != nil {
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			log.Println("Failed to look up verification address:", err)
+		}
+		return
+	}
+	if credentials.EmailVerified {
+		return
+	}
+
+	// Claiming the send first means concurrent requests can't both send
+	now := time.Now()
+	result := db.Model(&UserCredentials{}).
+		Where("id = ? AND (verification_sent_at IS NULL OR verification_sent_at <= ?)", credentials.ID, now.Add(-interval)).
+		Update("verification_sent_at", now)
+	if result.Error != nil {
+		log.Printf("Failed to claim verification email of user %d: %v", credentials.UserID, result.Error)
+		return
+	}
+	if result.RowsAffected != 1 {
+		return
+	}
+
+	if err := sendVerificationEmail(&credentials); err != nil {
+		log.Printf("Failed to send verification email to user %d: %v", credentials.UserID, err)
+	}
+}
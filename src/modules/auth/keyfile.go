@@ -0,0 +1,229 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// KeyFile is the JSON file signing keys are kept in, so they can be rotated.
+type KeyFile struct {
+	Active   string         `json:"active"`             // ID of the key new tokens are signed with
+	Previous string         `json:"previous,omitempty"` // ID of the key that signs until Active activates
+	Keys     []KeyFileEntry `json:"keys"`
+}
+
+// KeyFileEntry is a signing key in a KeyFile.
+type KeyFileEntry struct {
+	ID          string     `json:"kid"`
+	Algorithm   string     `json:"alg"`
+	Secret      string     `json:"secret,omitempty"`      // base64, for HS256
+	PrivateKey  string     `json:"private_key,omitempty"` // PEM, for RS256 and EdDSA
+	CreatedAt   time.Time  `json:"created_at"`
+	ActivatesAt *time.Time `json:"activates_at,omitempty"` // when it starts signing, it is only published before
+	ExpiresAt   *time.Time `json:"expires_at,omitempty"`   // set once the key is retired
+}
+
+// ReadKeyFile reads a key file. A missing file reads as an empty one, which has no
+// active key until it is rotated.
+func ReadKeyFile(path string) (*KeyFile, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return &KeyFile{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var file KeyFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return &file, nil
+}
+
+// Write saves the key file, readable by its owner only. It is replaced in one go, so
+// servers reloading it never see half a file.
+func (f *KeyFile) Write(path string) error {
+	data, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".keys-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	// CreateTemp already makes the file private
+	return os.Rename(tmp.Name(), path)
+}
+
+// KeySet returns the keys of the file that haven't expired. Until the active key
+// activates, the previous one keeps signing.
+func (f *KeyFile) KeySet() (*KeySet, error) {
+	var active, previous *SigningKey
+	var retired []*SigningKey
+	for _, entry := range f.Keys {
+		if entry.ExpiresAt != nil && time.Now().After(*entry.ExpiresAt) {
+			continue
+		}
+		key, err := entry.SigningKey()
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %w", entry.ID, err)
+		}
+		if entry.ID == f.Active {
+			active = key
+		} else {
+			if entry.ID == f.Previous {
+				previous = key
+			}
+			retired = append(retired, key)
+		}
+	}
+
+	if active == nil {
+		return nil, errors.New("no active key, run \"let-me-in keys rotate\"")
+	}
+	if !active.ExpiresAt.IsZero() {
+		return nil, fmt.Errorf("active key %q is retired", active.ID)
+	}
+	set := NewKeySet(active, retired...)
+	set.previous = previous
+	return set, nil
+}
+
+// Rotate generates a new key for algorithm and makes it the active key. Servers reload
+// the file every reloadInterval and others may cache the JWKS for JWKSMaxAge, so the new
+// key is only published at first, and activates once everyone can verify it. Until then
+// the key signing now keeps signing. It is then retired: it keeps verifying the tokens it
+// signed until they expire, after AccessTokenTTL, plus reloadInterval for the servers
+// that reload late. Keys that already expired are dropped.
+func (f *KeyFile) Rotate(algorithm string, reloadInterval time.Duration) (*KeyFileEntry, error) {
+	entry, err := generateKeyFileEntry(algorithm)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	// The key signing now, unless the active one is still waiting to activate
+	signing := f.Active
+	for _, key := range f.Keys {
+		if key.ID == f.Active && key.ActivatesAt != nil && now.Before(*key.ActivatesAt) {
+			signing = f.Previous
+		}
+	}
+	// Nothing to wait for on the first rotation
+	if signing != "" {
+		activatesAt := now.Add(reloadInterval + JWKSMaxAge).UTC().Truncate(time.Second)
+		entry.ActivatesAt = &activatesAt
+	}
+
+	keys := []KeyFileEntry{*entry}
+	for _, key := range f.Keys {
+		switch {
+		case key.ID == signing:
+			retiredUntil := entry.ActivatesAt.Add(AccessTokenTTL + reloadInterval)
+			key.ExpiresAt = &retiredUntil
+		case key.ID == f.Active:
+			// Replaced before it ever signed, it is only kept until the file was reloaded
+			retiredUntil := now.Add(reloadInterval).UTC().Truncate(time.Second)
+			key.ExpiresAt = &retiredUntil
+		}
+		if key.ExpiresAt != nil && now.After(*key.ExpiresAt) {
+			continue
+		}
+		keys = append(keys, key)
+	}
+
+	f.Active = entry.ID
+	f.Previous = signing
+	f.Keys = keys
+	return entry, nil
+}
+
+// SigningKey parses the key of the entry.
+func (e *KeyFileEntry) SigningKey() (*SigningKey, error) {
+	var key *SigningKey
+	var err error
+	switch e.Algorithm {
+	case AlgHS256:
+		var secret []byte
+		if secret, err = base64.StdEncoding.DecodeString(e.Secret); err == nil {
+			key, err = NewHMACKey(e.ID, secret)
+		}
+	case AlgRS256, AlgEdDSA:
+		if key, err = ParsePrivateKey(e.ID, []byte(e.PrivateKey)); err == nil && key.Algorithm != e.Algorithm {
+			err = fmt.Errorf("not a %s key", e.Algorithm)
+		}
+	default:
+		err = fmt.Errorf("unsupported algorithm %q", e.Algorithm)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if e.ActivatesAt != nil {
+		key.ActivatesAt = *e.ActivatesAt
+	}
+	if e.ExpiresAt != nil {
+		key.ExpiresAt = *e.ExpiresAt
+	}
+	return key, nil
+}
+
+func generateKeyFileEntry(algorithm string) (*KeyFileEntry, error) {
+	entry := &KeyFileEntry{Algorithm: algorithm, CreatedAt: time.Now().UTC().Truncate(time.Second)}
+
+	var key *SigningKey
+	var err error
+	switch algorithm {
+	case AlgHS256:
+		secret := make([]byte, minSecretLength)
+		if _, err := rand.Read(secret); err != nil {
+			return nil, err
+		}
+		entry.Secret = base64.StdEncoding.EncodeToString(secret)
+		key, err = NewHMACKey("", secret)
+	case AlgRS256, AlgEdDSA:
+		var private crypto.Signer
+		if algorithm == AlgRS256 {
+			private, err = rsa.GenerateKey(rand.Reader, 2048)
+		} else {
+			_, private, err = ed25519.GenerateKey(rand.Reader)
+		}
+		if err != nil {
+			return nil, err
+		}
+		var der []byte
+		if der, err = x509.MarshalPKCS8PrivateKey(private); err != nil {
+			return nil, err
+		}
+		entry.PrivateKey = string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+		key, err = NewPrivateKey("", private)
+	default:
+		return nil, fmt.Errorf("unsupported algorithm %q", algorithm)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	entry.ID = key.ID
+	return entry, nil
+}
@@ -0,0 +1,365 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"let-me-in/config"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Supported JWT signing algorithms
+const (
+	AlgHS256 = "HS256"
+	AlgRS256 = "RS256"
+	AlgEdDSA = "EdDSA"
+)
+
+// minSecretLength is the shortest JWT_SECRET accepted for HS256, in bytes.
+const minSecretLength = 32
+
+// SigningKey signs and verifies access tokens. Its ID goes into the kid header of the
+// tokens it signs.
+type SigningKey struct {
+	ID        string
+	Algorithm string
+	// ExpiresAt is zero until the key is retired. A retired key signs until the key
+	// replacing it activates, and then only verifies tokens, until ExpiresAt.
+	ExpiresAt time.Time
+	// ActivatesAt, when set, is when the key starts signing tokens. It only verifies
+	// them before.
+	ActivatesAt time.Time
+
+	private interface{} // []byte for HS256, crypto.Signer otherwise
+	public  interface{} // []byte for HS256, crypto.PublicKey otherwise
+}
+
+// KeySet holds the keys access tokens are signed and verified with: the active key signs
+// new tokens, and retired keys keep verifying the tokens they signed until they expire.
+type KeySet struct {
+	active   *SigningKey
+	previous *SigningKey // signs until active activates
+	keys     map[string]*SigningKey
+}
+
+// NewKeySet creates a key set signing with active.
+func NewKeySet(active *SigningKey, retired ...*SigningKey) *KeySet {
+	set := &KeySet{active: active, keys: map[string]*SigningKey{active.ID: active}}
+	for _, key := range retired {
+		set.keys[key.ID] = key
+	}
+	return set
+}
+
+// Active returns the key new tokens are signed with.
+func (s *KeySet) Active() *SigningKey {
+	if s.previous != nil && time.Now().Before(s.active.ActivatesAt) {
+		return s.previous
+	}
+	return s.active
+}
+
+// Key returns the key with the given ID, unless there is none or it expired.
+func (s *KeySet) Key(id string) (*SigningKey, bool) {
+	key, ok := s.keys[id]
+	if !ok || (!key.ExpiresAt.IsZero() && time.Now().After(key.ExpiresAt)) {
+		return nil, false
+	}
+	return key, true
+}
+
+// JWKS returns the public keys tokens can currently be verified with.
+func (s *KeySet) JWKS() JSONWebKeySet {
+	set := JSONWebKeySet{Keys: []JSONWebKey{}}
+	ids := make([]string, 0, len(s.keys))
+	for id := range s.keys {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		key, ok := s.Key(id)
+		if !ok {
+			continue
+		}
+		if jwk, ok := key.JWK(); ok {
+			set.Keys = append(set.Keys, jwk)
+		}
+	}
+	return set
+}
+
+// signingKeys are the keys access tokens are signed with. Until LoadSigningKeys runs there
+// is a random HS256 key, so tokens don't survive a restart.
+var signingKeys atomic.Pointer[KeySet]
+
+func init() {
+	signingKeys.Store(NewKeySet(mustRandomKey()))
+}
+
+func mustRandomKey() *SigningKey {
+	secret := make([]byte, minSecretLength)
+	if _, err := rand.Read(secret); err != nil {
+		panic(err)
+	}
+	key, err := NewHMACKey("", secret)
+	if err != nil {
+		panic(err)
+	}
+	return key
+}
+
+// NewHMACKey creates an HS256 key. Without an ID, one is derived from the secret.
+func NewHMACKey(id string, secret []byte) (*SigningKey, error) {
+	if len(secret) < minSecretLength {
+		return nil, fmt.Errorf("HS256 secrets must be at least %d bytes long", minSecretLength)
+	}
+	if id == "" {
+		sum := sha256.Sum256(secret)
+		id = "hs-" + hex.EncodeToString(sum[:8])
+	}
+	return &SigningKey{ID: id, Algorithm: AlgHS256, private: secret, public: secret}, nil
+}
+
+// NewPrivateKey creates an RS256 key from an *rsa.PrivateKey or an EdDSA key from an
+// ed25519.PrivateKey. Without an ID, the key's JWK thumbprint is used.
+func NewPrivateKey(id string, private crypto.Signer) (*SigningKey, error) {
+	key := &SigningKey{ID: id, private: private, public: private.Public()}
+	switch k := private.(type) {
+	case *rsa.PrivateKey:
+		if k.N.BitLen() < 2048 {
+			return nil, errors.New("RSA keys must be at least 2048 bits long")
+		}
+		key.Algorithm = AlgRS256
+	case ed25519.PrivateKey:
+		key.Algorithm = AlgEdDSA
+	default:
+		return nil, fmt.Errorf("unsupported private key type %T", private)
+	}
+
+	if key.ID == "" {
+		key.ID = key.thumbprint()
+	}
+	return key, nil
+}
+
+// ParsePrivateKey parses a PEM encoded RSA or Ed25519 private key, in PKCS #8 or, for
+// RSA, PKCS #1 form.
+func ParsePrivateKey(id string, data []byte) (*SigningKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM data found")
+	}
+
+	var private interface{}
+	var err error
+	switch block.Type {
+	case "PRIVATE KEY":
+		private, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		private, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported PEM block %q", block.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	signer, ok := private.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported private key type %T", private)
+	}
+	return NewPrivateKey(id, signer)
+}
+
+// LoadSigningKeys sets up the keys access tokens are signed with from the environment.
+// JWT_KEYS_FILE names a key file, as maintained by "let-me-in keys rotate". Without it,
+// a single key is used: JWT_ALGORITHM picks the algorithm, JWT_SECRET holds the HS256
+// secret and JWT_PRIVATE_KEY_FILE the PEM encoded RS256 or EdDSA key. JWT_KEY_ID
+// overrides the derived key ID.
+func LoadSigningKeys() error {
+	if path := config.GetEnv("JWT_KEYS_FILE", ""); path != "" {
+		file, err := ReadKeyFile(path)
+		if err != nil {
+			return err
+		}
+		set, err := file.KeySet()
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		SetKeySet(set)
+		return nil
+	}
+
+	id := config.GetEnv("JWT_KEY_ID", "")
+
+	var key *SigningKey
+	var err error
+	switch algorithm := config.GetEnv("JWT_ALGORITHM", AlgHS256); algorithm {
+	case AlgHS256:
+		secret := config.GetEnv("JWT_SECRET", "")
+		if secret == "" {
+			return errors.New("JWT_SECRET is required for HS256")
+		}
+		key, err = NewHMACKey(id, []byte(secret))
+	case AlgRS256, AlgEdDSA:
+		path := config.GetEnv("JWT_PRIVATE_KEY_FILE", "")
+		if path == "" {
+			return fmt.Errorf("JWT_PRIVATE_KEY_FILE is required for %s", algorithm)
+		}
+		var data []byte
+		if data, err = os.ReadFile(path); err != nil {
+			return err
+		}
+		if key, err = ParsePrivateKey(id, data); err == nil && key.Algorithm != algorithm {
+			err = fmt.Errorf("%s is not a %s key", path, algorithm)
+		}
+	default:
+		return fmt.Errorf("unsupported JWT_ALGORITHM %q", algorithm)
+	}
+	if err != nil {
+		return err
+	}
+
+	SetKeySet(NewKeySet(key))
+	return nil
+}
+
+// SetKeySet replaces the keys access tokens are signed and verified with.
+func SetKeySet(set *KeySet) {
+	signingKeys.Store(set)
+}
+
+// WatchSigningKeys reloads JWT_KEYS_FILE whenever it changes, checking every interval
+// until ctx is done, so rotated keys are picked up without a restart. It does nothing
+// without a key file.
+func WatchSigningKeys(ctx context.Context, interval time.Duration) {
+	path := config.GetEnv("JWT_KEYS_FILE", "")
+	if path == "" {
+		return
+	}
+
+	var modified time.Time
+	if info, err := os.Stat(path); err == nil {
+		modified = info.ModTime()
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			info, err := os.Stat(path)
+			if err != nil || info.ModTime().Equal(modified) {
+				continue
+			}
+			modified = info.ModTime()
+			// A broken file leaves the current keys in place
+			if err := LoadSigningKeys(); err != nil {
+				log.Printf("Failed to reload signing keys: %v", err)
+			} else {
+				log.Printf("Reloaded signing keys, signing with %s", signingKeys.Load().Active().ID)
+			}
+		}
+	}()
+}
+
+func (k *SigningKey) method() jwt.SigningMethod {
+	return jwt.GetSigningMethod(k.Algorithm)
+}
+
+// JSONWebKey is the public part of a signing key, as published in the JWKS.
+type JSONWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n,omitempty"`   // RSA modulus
+	E   string `json:"e,omitempty"`   // RSA exponent
+	Crv string `json:"crv,omitempty"` // OKP curve
+	X   string `json:"x,omitempty"`   // OKP public key
+}
+
+// JSONWebKeySet is the document served at /.well-known/jwks.json.
+type JSONWebKeySet struct {
+	Keys []JSONWebKey `json:"keys"`
+}
+
+// JWK returns the public JSON Web Key of k. HS256 keys are secret and have none.
+func (k *SigningKey) JWK() (JSONWebKey, bool) {
+	jwk := JSONWebKey{Kid: k.ID, Use: "sig", Alg: k.Algorithm}
+	switch public := k.public.(type) {
+	case *rsa.PublicKey:
+		jwk.Kty = "RSA"
+		jwk.N = base64.RawURLEncoding.EncodeToString(public.N.Bytes())
+		jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes())
+	case ed25519.PublicKey:
+		jwk.Kty = "OKP"
+		jwk.Crv = "Ed25519"
+		jwk.X = base64.RawURLEncoding.EncodeToString(public)
+	default:
+		return jwk, false
+	}
+	return jwk, true
+}
+
+// thumbprint returns the RFC 7638 thumbprint of the public key of k.
+func (k *SigningKey) thumbprint() string {
+	jwk, _ := k.JWK()
+	var members interface{}
+	if jwk.Kty == "RSA" {
+		members = struct {
+			E   string `json:"e"`
+			Kty string `json:"kty"`
+			N   string `json:"n"`
+		}{jwk.E, jwk.Kty, jwk.N}
+	} else {
+		members = struct {
+			Crv string `json:"crv"`
+			Kty string `json:"kty"`
+			X   string `json:"x"`
+		}{jwk.Crv, jwk.Kty, jwk.X}
+	}
+	data, _ := json.Marshal(members)
+	sum := sha256.Sum256(data)
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// JWKS returns the public keys access tokens can currently be verified with.
+func JWKS() JSONWebKeySet {
+	return signingKeys.Load().JWKS()
+}
+
+// JWKSMaxAge is how long others may cache the JWKS.
+const JWKSMaxAge = 300 * time.Second
+
+// JWKSHandler publishes the public keys access tokens can be verified with, so other
+// services can check them without calling us.
+func JWKSHandler(c *gin.Context) {
+	c.Header("Cache-Control", fmt.Sprintf("public, max-age=%d", int(JWKSMaxAge.Seconds())))
+	c.JSON(http.StatusOK, JWKS())
+}
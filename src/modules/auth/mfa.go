@@ -0,0 +1,347 @@
+package auth
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"let-me-in/config"
+	"let-me-in/database"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// mfaTokenTTL is how long the second factor may take after the password was checked.
+const mfaTokenTTL = 5 * time.Minute
+
+// maxMFAFailures is how many wrong codes a login may see before it has to start over.
+const maxMFAFailures = 5
+
+// Every maxMFAFailures wrong codes in a row lock the second factor of the account for
+// mfaLockout, doubling each time up to maxMFALockout.
+const (
+	mfaLockout    = 5 * time.Minute
+	maxMFALockout = 24 * time.Hour
+)
+
+// EnrollTOTPHandler generates a TOTP secret for the current user. It is only used once
+// ConfirmTOTPHandler saw a first code generated from it; enrolling again before that
+// replaces it.
+func EnrollTOTPHandler(c *gin.Context) {
+	credentials, ok := currentCredentials(c)
+	if !ok {
+		return
+	}
+	if credentials.TOTPEnabled {
+		c.JSON(http.StatusConflict, gin.H{"error": "Two-factor authentication is already enabled"})
+		return
+	}
+
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate TOTP secret"})
+		return
+	}
+	if err := database.DB.Model(credentials).Update("totp_secret", secret).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store TOTP secret"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"secret": secret,
+		"uri":    totpURI(config.GetEnv("MFA_ISSUER", "Let Me In"), credentials.Email, secret),
+	})
+}
+
+// ConfirmTOTPHandler enables two-factor authentication once the current user proved
+// their authenticator app generates the right codes. It responds with the recovery codes,
+// which are never shown again.
+func ConfirmTOTPHandler(c *gin.Context) {
+	var input struct {
+		Code string `json:"code" binding:"required"`
+	}
+
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
+		return
+	}
+
+	credentials, ok := currentCredentials(c)
+	if !ok {
+		return
+	}
+	if credentials.TOTPEnabled {
+		c.JSON(http.StatusConflict, gin.H{"error": "Two-factor authentication is already enabled"})
+		return
+	}
+	if credentials.TOTPSecret == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Enroll before confirming"})
+		return
+	}
+
+	counter, valid := validateTOTP(credentials.TOTPSecret, input.Code, time.Now(), 0)
+	if !valid {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid code"})
+		return
+	}
+
+	// Two-factor authentication is never enabled without recovery codes
+	var codes []string
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(credentials).Updates(map[string]interface{}{
+			"totp_enabled":      true,
+			"totp_last_counter": counter,
+			"mfa_failures":      0,
+			"mfa_locked_until":  nil,
+		}).Error
+		if err != nil {
+			return err
+		}
+		codes, err = generateRecoveryCodes(tx, credentials.ID)
+		return err
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to enable two-factor authentication"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Two-factor authentication enabled", "recovery_codes": codes})
+}
+
+// DisableTOTPHandler turns two-factor authentication off for the current user, given a
+// second factor.
+func DisableTOTPHandler(c *gin.Context) {
+	var input secondFactor
+
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
+		return
+	}
+
+	credentials, ok := currentCredentials(c)
+	if !ok {
+		return
+	}
+	if !credentials.TOTPEnabled {
+		c.JSON(http.StatusConflict, gin.H{"error": "Two-factor authentication is not enabled"})
+		return
+	}
+	if !input.valid() {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Provide either a code or a recovery code"})
+		return
+	}
+	if !input.verify(c, credentials, nil) {
+		return
+	}
+
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(credentials).Updates(map[string]interface{}{
+			"totp_enabled":      false,
+			"totp_secret":       "",
+			"totp_last_counter": 0,
+		}).Error
+		if err != nil {
+			return err
+		}
+		return tx.Unscoped().Where("user_credentials_id = ?", credentials.ID).Delete(&RecoveryCode{}).Error
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to disable two-factor authentication"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Two-factor authentication disabled"})
+}
+
+// VerifyMFAHandler completes a login of a user with two-factor authentication: it
+// exchanges the MFA token LoginUserHandler returned and a code, or a recovery code, for
+// the access and refresh tokens.
+func VerifyMFAHandler(c *gin.Context) {
+	var input struct {
+		MFAToken string `json:"mfa_token" binding:"required"`
+		secondFactor
+	}
+
+	db := database.DB
+
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
+		return
+	}
+	if !input.valid() {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Provide either a code or a recovery code"})
+		return
+	}
+
+	claims, err := validateToken(input.MFAToken, PurposeMFA)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired MFA token, log in again"})
+		return
+	}
+
+	var credentials UserCredentials
+	if err := db.Where("user_id = ?", claims.UserID).First(&credentials).Error; err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired MFA token, log in again"})
+		return
+	}
+	var user User
+	if err := db.First(&user, claims.UserID).Error; err != nil || user.DisabledAt != nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Account is disabled"})
+		return
+	}
+
+	if !input.verify(c, &credentials, claims) {
+		return
+	}
+
+	// The MFA token only logs in once, even if two requests came with different codes
+	if err := RevokeAccessToken(db, claims); err == ErrTokenAlreadyRevoked {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired MFA token, log in again"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke MFA token"})
+		return
+	}
+
+	logIn(c, claims.UserID)
+}
+
+// Second factors, as listed by mfaMethods
+const (
+	MFAMethodTOTP     = "totp"     // a TOTP or recovery code, see VerifyMFAHandler
+	MFAMethodWebAuthn = "webauthn" // a passkey, see BeginWebAuthnLoginHandler
+)
+
+// mfaMethods lists the second factors a user set up. Users with none log in with their
+// password alone.
+func mfaMethods(db *gorm.DB, credentials *UserCredentials) ([]string, error) {
+	methods := []string{}
+	if credentials.TOTPEnabled {
+		methods = append(methods, MFAMethodTOTP)
+	}
+
+	var passkeys int64
+	if err := db.Model(&WebAuthnCredential{}).Where("user_id = ?", credentials.UserID).Count(&passkeys).Error; err != nil {
+		return nil, err
+	}
+	if passkeys > 0 {
+		methods = append(methods, MFAMethodWebAuthn)
+	}
+	return methods, nil
+}
+
+// secondFactor is the input of requests that take either a TOTP code or a recovery code.
+type secondFactor struct {
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recovery_code"`
+}
+
+func (f *secondFactor) valid() bool {
+	return (f.Code == "") != (f.RecoveryCode == "")
+}
+
+// use checks the code or recovery code of a user with two-factor authentication and
+// marks it used.
+func (f *secondFactor) use(c *gin.Context, credentials *UserCredentials) bool {
+	if f.RecoveryCode != "" {
+		return useRecoveryCode(c, credentials, f.RecoveryCode)
+	}
+	return useTOTPCode(credentials, f.Code)
+}
+
+// verify is use for a second factor that isn't locked. Wrong codes count towards locking
+// it, see mfaFailed, and a correct one resets the count. mfaToken is the MFA token of the
+// login the code came with, or nil for a user who is logged in already. It writes the
+// error response and returns false unless the code is correct.
+func (f *secondFactor) verify(c *gin.Context, credentials *UserCredentials, mfaToken *Claims) bool {
+	// Checked before the code, so a locked account doesn't even use codes up
+	if credentials.MFALockedUntil != nil && time.Now().Before(*credentials.MFALockedUntil) {
+		mfaLocked(c, *credentials.MFALockedUntil)
+		return false
+	}
+
+	if !f.use(c, credentials) {
+		mfaFailed(c, credentials, mfaToken)
+		return false
+	}
+	if credentials.MFAFailures != 0 || credentials.MFALockedUntil != nil {
+		database.DB.Model(credentials).Updates(map[string]interface{}{"mfa_failures": 0, "mfa_locked_until": nil})
+	}
+	return true
+}
+
+// useTOTPCode checks a code of a user with two-factor authentication and marks it used.
+// Concurrent requests can't both use the same code.
+func useTOTPCode(credentials *UserCredentials, code string) bool {
+	if !credentials.TOTPEnabled {
+		return false
+	}
+	counter, valid := validateTOTP(credentials.TOTPSecret, code, time.Now(), credentials.TOTPLastCounter)
+	if !valid {
+		return false
+	}
+
+	result := database.DB.Model(&UserCredentials{}).
+		Where("id = ? AND totp_last_counter < ?", credentials.ID, counter).
+		Update("totp_last_counter", counter)
+	return result.Error == nil && result.RowsAffected == 1
+}
+
+// mfaFailed counts a wrong code. Every maxMFAFailures of them revoke the MFA token, if
+// the code came with one, and lock the second factor of the account for longer and
+// longer, so guessing codes requires the password again every few attempts, and logging
+// in again doesn't help. Only a correct code resets the count.
+func mfaFailed(c *gin.Context, credentials *UserCredentials, mfaToken *Claims) {
+	db := database.DB
+
+	err := db.Model(credentials).Update("mfa_failures", gorm.Expr("mfa_failures + 1")).Error
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record MFA failure"})
+		return
+	}
+	db.Select("mfa_failures").First(credentials, credentials.ID)
+
+	if credentials.MFAFailures%maxMFAFailures != 0 {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid code"})
+		return
+	}
+
+	if mfaToken != nil {
+		// Another request may have ended the login already
+		if err := RevokeAccessToken(db, mfaToken); err != nil && err != ErrTokenAlreadyRevoked {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke MFA token"})
+			return
+		}
+	}
+	lockout := maxMFALockout
+	if lockouts := credentials.MFAFailures / maxMFAFailures; lockouts <= 10 {
+		lockout = min(mfaLockout<<(lockouts-1), maxMFALockout)
+	}
+	lockedUntil := time.Now().Add(lockout)
+	if err := db.Model(credentials).Update("mfa_locked_until", lockedUntil).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record MFA failure"})
+		return
+	}
+	recordSecurityEvent(c, credentials.UserID, SecurityEventMFALocked, fmt.Sprintf("%d invalid codes, locked for %s", credentials.MFAFailures, lockout))
+	mfaLocked(c, lockedUntil)
+}
+
+// mfaLocked tells a client the second factor of the account is locked until the given time.
+func mfaLocked(c *gin.Context, until time.Time) {
+	c.Header("Retry-After", strconv.Itoa(max(1, int(math.Ceil(time.Until(until).Seconds())))))
+	c.JSON(http.StatusTooManyRequests, gin.H{"error": "Too many invalid codes, try again later"})
+}
+
+// currentCredentials loads the credentials of the current user. It writes the error
+// response and returns false when that fails.
+func currentCredentials(c *gin.Context) (*UserCredentials, bool) {
+	var credentials UserCredentials
+	if err := database.DB.Where("user_id = ?", CurrentUser(c).ID).First(&credentials).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch user credentials"})
+		return nil, false
+	}
+	return &credentials, true
+}
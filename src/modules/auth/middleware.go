@@ -0,0 +1,85 @@
+package auth
+
+import (
+	"net/http"
+	"strings"
+
+	"let-me-in/database"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+// Context keys set by RequireAuth
+const (
+	claimsContextKey = "auth_claims"
+	userContextKey   = "auth_user"
+)
+
+// RequireAuth rejects requests without a valid "Authorization: Bearer" access token and
+// puts the authenticated user into the context. Browsers can't set headers on WebSocket
+// upgrades, so those may pass the token in the token query parameter instead.
+func RequireAuth() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token := bearerToken(c)
+		if token == "" {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Missing access token"})
+			return
+		}
+
+		claims, err := ValidateJWT(token)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
+			return
+		}
+
+		var user User
+		if err := database.DB.First(&user, claims.UserID).Error; err != nil {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
+			return
+		}
+		// Other instances may not know yet that the user's tokens were revoked
+		if user.DisabledAt != nil {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Account is disabled"})
+			return
+		}
+
+		c.Set(claimsContextKey, claims)
+		c.Set(userContextKey, &user)
+		c.Next()
+	}
+}
+
+// RequireAdmin rejects users that aren't admins. It must run after RequireAuth.
+func RequireAdmin() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !CurrentUser(c).IsAdmin {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Admin access required"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// CurrentUser returns the user authenticated by RequireAuth.
+func CurrentUser(c *gin.Context) *User {
+	user, _ := c.MustGet(userContextKey).(*User)
+	return user
+}
+
+// CurrentClaims returns the access token claims of the user authenticated by RequireAuth.
+func CurrentClaims(c *gin.Context) *Claims {
+	claims, _ := c.MustGet(claimsContextKey).(*Claims)
+	return claims
+}
+
+func bearerToken(c *gin.Context) string {
+	header := c.GetHeader("Authorization")
+	if token, ok := strings.CutPrefix(header, "Bearer "); ok {
+		return strings.TrimSpace(token)
+	}
+	if header == "" && websocket.IsWebSocketUpgrade(c.Request) {
+		return c.Query("token")
+	}
+	return ""
+}
@@ -1,6 +1,8 @@
 package auth
 
 import (
+	"time"
+
 	"gorm.io/gorm"
 )
 
@@ -10,18 +12,101 @@ type UserCredentials struct {
 	Password string
 	Salt     string
 	UserID   uint
+
+	// Email verification, see RequireEmailVerification
+	EmailVerified      bool
+	VerificationSentAt *time.Time `json:"-"` // when the last verification email was sent, to throttle resending
+
+	// Two-factor authentication
+	TOTPSecret      string `json:"-"` // set on enrollment, in use once TOTPEnabled
+	TOTPEnabled     bool
+	TOTPLastCounter int64      `json:"-"` // counter of the last accepted code, so it can't be replayed
+	MFAFailures     int        `json:"-"` // failed second factor attempts since the last success, across logins
+	MFALockedUntil  *time.Time `json:"-"` // second factors are refused until then, see mfaFailed
+}
+
+// RecoveryCode is a single-use code that stands in for a TOTP code, for users who lost
+// their authenticator.
+type RecoveryCode struct {
+	gorm.Model
+	UserCredentialsID uint       `gorm:"index"`
+	CodeHash          string     `gorm:"index"` // see hashRecoveryCode, the code itself is never stored
+	UsedAt            *time.Time // set once the code was used
+}
+
+// PasswordResetToken lets the owner of an email address set a new password, once and
+// until it expires.
+type PasswordResetToken struct {
+	gorm.Model
+	UserID    uint       `gorm:"index"`
+	TokenHash string     `gorm:"uniqueIndex;not null"` // see hashPasswordResetToken, the token itself is never stored
+	ExpiresAt time.Time  `gorm:"index"`
+	UsedAt    *time.Time // set once the password was reset with it
 }
 
 type User struct {
 	gorm.Model
 	DisplayName string
+	IsAdmin     bool `gorm:"default:false"`
+
+	DisabledAt      *time.Time `json:"disabled_at,omitempty"` // disabled users can't log in
+	TokensRevokedAt *time.Time `json:"-"`                     // access tokens issued until then are revoked
 }
 
 type RefreshToken struct {
 	gorm.Model
-	Token     string `gorm:"uniqueIndex"`
+	TokenHash string `gorm:"uniqueIndex;not null"` // see HashRefreshToken, the token itself is never stored
 	UserID    uint
-	User      User `gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE,foreignKey:UserID;"`
+	User      User   `gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE,foreignKey:UserID;"`
+	FamilyID  string `gorm:"index"` // shared by the token issued at login and every token it was rotated into
 	ExpiresAt int64
 	Active    bool
+	RotatedAt *time.Time // set once the token was exchanged for a new one
+
+	// The device the token was issued to
+	UserAgent  string
+	IPAddress  string
+	SignedInAt time.Time  // when the family started, at login
+	LastUsedAt *time.Time // when the device last logged in or refreshed its tokens
+}
+
+// WebAuthnCredential is a passkey or security key of a user.
+type WebAuthnCredential struct {
+	gorm.Model
+	UserID       uint       `gorm:"index" json:"-"`
+	User         User       `gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE,foreignKey:UserID;" json:"-"`
+	CredentialID string     `gorm:"uniqueIndex;not null"` // base64url, as authenticators identify it
+	PublicKey    []byte     `json:"-"`                    // COSE_Key
+	SignCount    uint32     `json:"-"`                    // signature counter, going backwards means the key was cloned
+	Transports   string     // comma separated hints on how to reach the authenticator, like "usb" or "internal"
+	Name         string     // given by the user
+	LastUsedAt   *time.Time // set when it was last used to log in
+}
+
+// RevokedToken is an access token revoked before it expired, see RevokeAccessToken.
+type RevokedToken struct {
+	JTI       string    `gorm:"primaryKey"`
+	UserID    uint      `gorm:"index"`
+	ExpiresAt time.Time `gorm:"index"` // the revocation can be forgotten once the token expires
+	CreatedAt time.Time
+}
+
+// Types of SecurityEvent
+const (
+	SecurityEventRefreshTokenReuse        = "refresh_token_reuse"        // a rotated refresh token was presented again
+	SecurityEventRecoveryCodeUsed         = "recovery_code_used"         // a recovery code stood in for a TOTP code
+	SecurityEventRecoveryCodesRegenerated = "recovery_codes_regenerated" // the user replaced their recovery codes
+	SecurityEventWebAuthnSignCount        = "webauthn_sign_count"        // a passkey's signature counter went backwards
+	SecurityEventPasswordReset            = "password_reset"             // the password was reset through an emailed link
+	SecurityEventMFALocked                = "mfa_locked"                 // too many invalid codes locked the second factor for a while
+)
+
+// SecurityEvent records something suspicious that happened to an account.
+type SecurityEvent struct {
+	gorm.Model
+	UserID    uint `gorm:"index"`
+	Type      string
+	IPAddress string
+	UserAgent string
+	Details   string
 }
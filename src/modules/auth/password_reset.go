@@ -0,0 +1,229 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"let-me-in/config"
+	"let-me-in/database"
+	"let-me-in/mailer"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// defaultPasswordResetTTL is how long reset links work unless PASSWORD_RESET_TTL says otherwise.
+const defaultPasswordResetTTL = time.Hour
+
+// Reset links may be asked for PASSWORD_RESET_ADDRESS_LIMIT times per address and
+// PASSWORD_RESET_IP_LIMIT times per IP address within passwordResetLimitWindow.
+const (
+	passwordResetLimitWindow         = time.Hour
+	defaultPasswordResetAddressLimit = 3
+	defaultPasswordResetIPLimit      = 10
+)
+
+var (
+	passwordResetsByAddress = newRateLimiter()
+	passwordResetsByIP      = newRateLimiter()
+)
+
+// passwordResetLinks tracks the reset links being sent in the background.
+var passwordResetLinks sync.WaitGroup
+
+// WaitForPasswordResetLinks blocks until the reset links asked for so far were sent, or
+// failed to.
+func WaitForPasswordResetLinks() {
+	passwordResetLinks.Wait()
+}
+
+// appLink returns the URL of a frontend page, APP_URL being where the frontend is served.
+func appLink(path string, query url.Values) string {
+	base := strings.TrimRight(config.GetEnv("APP_URL", "http://localhost:8080"), "/")
+	return base + path + "?" + query.Encode()
+}
+
+// hashPasswordResetToken returns the keyed hash reset tokens are stored and looked up by.
+func hashPasswordResetToken(token string) string {
+	mac := hmac.New(sha256.New, []byte(pepper()))
+	mac.Write([]byte(token))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// issuePasswordResetToken creates a reset token for a user. The ones they asked for
+// before keep working, so someone asking for links to an address can't make the link its
+// owner is about to use useless.
+func issuePasswordResetToken(db *gorm.DB, userID uint) (string, error) {
+	tokenBytes := make([]byte, 32)
+	if _, err := rand.Read(tokenBytes); err != nil {
+		return "", errors.New("failed to generate password reset token")
+	}
+	token := base64.RawURLEncoding.EncodeToString(tokenBytes)
+
+	err := db.Create(&PasswordResetToken{
+		UserID:    userID,
+		TokenHash: hashPasswordResetToken(token),
+		ExpiresAt: time.Now().Add(config.GetDuration("PASSWORD_RESET_TTL", defaultPasswordResetTTL)),
+	}).Error
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// ForgotPasswordHandler emails a password reset link. It responds the same whether or
+// not the address belongs to a user, and before anything is looked up or sent, so it
+// can't be used to find out who has an account. Requests are limited per address and
+// per IP address, whether or not the address is registered.
+func ForgotPasswordHandler(c *gin.Context) {
+	var input struct {
+		Email string `json:"email" binding:"required"`
+	}
+
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
+		return
+	}
+
+	address := strings.ToLower(strings.TrimSpace(input.Email))
+	allowed, wait := passwordResetsByIP.allow(c.ClientIP(), config.GetInt("PASSWORD_RESET_IP_LIMIT", defaultPasswordResetIPLimit), passwordResetLimitWindow)
+	if allowed {
+		allowed, wait = passwordResetsByAddress.allow(address, config.GetInt("PASSWORD_RESET_ADDRESS_LIMIT", defaultPasswordResetAddressLimit), passwordResetLimitWindow)
+	}
+	if !allowed {
+		c.Header("Retry-After", strconv.Itoa(max(1, int(math.Ceil(wait.Seconds())))))
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": "Too many password reset requests, try again later"})
+		return
+	}
+
+	passwordResetLinks.Add(1)
+	go func() {
+		defer passwordResetLinks.Done()
+		sendPasswordResetLink(input.Email)
+	}()
+	c.JSON(http.StatusOK, gin.H{"message": "If the address is registered, a reset link was sent to it"})
+}
+
+// sendPasswordResetLink emails a reset link to the user with the given address, if there
+// is one. Failures are only logged, the caller can't tell them apart from unknown addresses.
+func sendPasswordResetLink(email string) {
+	db := database.DB
+
+	var credentials UserCredentials
+	if err := db.Where("email = ?", email).First(&credentials).Error; err != nil {
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			log.Println("Failed to look up password reset address:", err)
+		}
+		return
+	}
+
+	token, err := issuePasswordResetToken(db, credentials.UserID)
+	if err != nil {
+		log.Printf("Failed to issue password reset token for user %d: %v", credentials.UserID, err)
+		return
+	}
+
+	ttl := config.GetDuration("PASSWORD_RESET_TTL", defaultPasswordResetTTL)
+	err = mailer.Default.Send(mailer.Message{
+		To:      credentials.Email,
+		Subject: "Reset your password",
+		Body: fmt.Sprintf("Someone asked to reset the password of your account. If it was you, set a new one here:\n\n%s\n\n"+
+			"The link works once, for %s. If you didn't ask for it, ignore this email.\n",
+			appLink("/reset-password", url.Values{"token": {token}}), ttl),
+	})
+	if err != nil {
+		log.Printf("Failed to send password reset email to user %d: %v", credentials.UserID, err)
+	}
+}
+
+// ResetPasswordHandler sets a new password given a reset token. The token is used up, and
+// every device the user was signed in on is signed out.
+func ResetPasswordHandler(c *gin.Context) {
+	var input struct {
+		Token    string `json:"token" binding:"required"`
+		Password string `json:"password" binding:"required"`
+	}
+
+	db := database.DB
+
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
+		return
+	}
+	if len(input.Password) < 8 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Password must be at least 8 characters long"})
+		return
+	}
+
+	salt, err := generateSalt()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate salt"})
+		return
+	}
+	hashedPassword, err := hashPassword(input.Password, salt)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to hash password"})
+		return
+	}
+
+	var token PasswordResetToken
+	err = db.Transaction(func(tx *gorm.DB) error {
+		// Claiming the token first means two requests can't both use it
+		now := time.Now()
+		result := tx.Model(&PasswordResetToken{}).
+			Where("token_hash = ? AND used_at IS NULL AND expires_at > ?", hashPasswordResetToken(input.Token), now).
+			Update("used_at", now)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected != 1 {
+			return gorm.ErrRecordNotFound
+		}
+		if err := tx.Where("token_hash = ?", hashPasswordResetToken(input.Token)).First(&token).Error; err != nil {
+			return err
+		}
+		// The other links of the user stop working with it
+		err := tx.Model(&PasswordResetToken{}).Where("user_id = ? AND used_at IS NULL", token.UserID).Update("used_at", now).Error
+		if err != nil {
+			return err
+		}
+		return tx.Model(&UserCredentials{}).Where("user_id = ?", token.UserID).
+			Updates(map[string]interface{}{"password": hashedPassword, "salt": salt}).Error
+	})
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired reset token"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to reset password"})
+		return
+	}
+
+	// Whoever knew the old password is signed out
+	if _, err := RevokeUserTokens(db, token.UserID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke tokens"})
+		return
+	}
+	recordSecurityEvent(c, token.UserID, SecurityEventPasswordReset, "")
+
+	c.JSON(http.StatusOK, gin.H{"message": "Password reset"})
+}
+
+// PurgePasswordResetTokens permanently deletes password reset tokens that expired, used
+// or not.
+func PurgePasswordResetTokens(db *gorm.DB) (int64, error) {
+	result := db.Unscoped().Where("expires_at < ?", time.Now()).Delete(&PasswordResetToken{})
+	return result.RowsAffected, result.Error
+}
@@ -0,0 +1,49 @@
+package auth
+
+import (
+	"sync"
+	"time"
+)
+
+// rateLimiter counts requests per key, such as an email or IP address, over a sliding
+// window. It is kept in memory, so every instance limits on its own.
+type rateLimiter struct {
+	mu       sync.Mutex
+	requests map[string][]time.Time // key → when its requests within the window were made
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{requests: map[string][]time.Time{}}
+}
+
+// allow records a request for key, unless limit requests were already made within
+// window. Then it returns false and how long until the next request is allowed. A limit
+// of 0 or less allows everything.
+func (l *rateLimiter) allow(key string, limit int, window time.Duration) (bool, time.Duration) {
+	if limit <= 0 {
+		return true, 0
+	}
+	now := time.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	// Keys nobody asked for in a while would otherwise pile up
+	if len(l.requests) > 10000 {
+		for k, times := range l.requests {
+			if now.Sub(times[len(times)-1]) > window {
+				delete(l.requests, k)
+			}
+		}
+	}
+
+	times := l.requests[key]
+	for len(times) > 0 && now.Sub(times[0]) > window {
+		times = times[1:]
+	}
+	if len(times) >= limit {
+		l.requests[key] = times
+		return false, times[len(times)-limit].Add(window).Sub(now)
+	}
+	l.requests[key] = append(times, now)
+	return true, 0
+}
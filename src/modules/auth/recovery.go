@@ -0,0 +1,152 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"let-me-in/database"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// recoveryCodeCount is how many recovery codes a user gets at a time.
+const recoveryCodeCount = 10
+
+// recoveryCodeEncoding spells recovery codes in lower case letters and digits, without
+// the ones easily mistaken for each other.
+var recoveryCodeEncoding = base32.NewEncoding("abcdefghijkmnpqrstuvwxyz23456789").WithPadding(base32.NoPadding)
+
+// generateRecoveryCodes replaces the recovery codes of a user and returns the new ones.
+// Only their hashes are stored.
+func generateRecoveryCodes(db *gorm.DB, credentialsID uint) ([]string, error) {
+	codes := make([]string, recoveryCodeCount)
+	rows := make([]RecoveryCode, recoveryCodeCount)
+	for i := range codes {
+		codeBytes := make([]byte, 5)
+		if _, err := rand.Read(codeBytes); err != nil {
+			return nil, errors.New("failed to generate recovery code")
+		}
+		code := recoveryCodeEncoding.EncodeToString(codeBytes)
+		codes[i] = code[:4] + "-" + code[4:]
+		rows[i] = RecoveryCode{UserCredentialsID: credentialsID, CodeHash: hashRecoveryCode(code)}
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Unscoped().Where("user_credentials_id = ?", credentialsID).Delete(&RecoveryCode{}).Error; err != nil {
+			return err
+		}
+		return tx.Create(&rows).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// hashRecoveryCode returns the keyed hash recovery codes are stored and looked up by.
+// Codes are compared without their dash, whitespace or case.
+func hashRecoveryCode(code string) string {
+	code = strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+	mac := hmac.New(sha256.New, []byte(pepper()))
+	mac.Write([]byte(code))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// useRecoveryCode marks a recovery code of a user as used and records a security event.
+// It reports whether the code was valid and unused.
+func useRecoveryCode(c *gin.Context, credentials *UserCredentials, code string) bool {
+	db := database.DB
+
+	result := db.Model(&RecoveryCode{}).
+		Where("user_credentials_id = ? AND code_hash = ? AND used_at IS NULL", credentials.ID, hashRecoveryCode(code)).
+		Update("used_at", time.Now())
+	if result.Error != nil || result.RowsAffected != 1 {
+		return false
+	}
+
+	remaining, _ := remainingRecoveryCodes(db, credentials.ID)
+	recordSecurityEvent(c, credentials.UserID, SecurityEventRecoveryCodeUsed, fmt.Sprintf("%d recovery codes left", remaining))
+	return true
+}
+
+func remainingRecoveryCodes(db *gorm.DB, credentialsID uint) (int64, error) {
+	var remaining int64
+	err := db.Model(&RecoveryCode{}).Where("user_credentials_id = ? AND used_at IS NULL", credentialsID).Count(&remaining).Error
+	return remaining, err
+}
+
+// GetRecoveryCodesHandler tells the current user how many unused recovery codes they have.
+func GetRecoveryCodesHandler(c *gin.Context) {
+	credentials, ok := currentCredentials(c)
+	if !ok {
+		return
+	}
+
+	remaining, err := remainingRecoveryCodes(database.DB, credentials.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to count recovery codes"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"remaining": remaining})
+}
+
+// RegenerateRecoveryCodesHandler replaces the recovery codes of the current user, given a
+// second factor. The old codes stop working.
+func RegenerateRecoveryCodesHandler(c *gin.Context) {
+	var input secondFactor
+
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
+		return
+	}
+
+	credentials, ok := currentCredentials(c)
+	if !ok {
+		return
+	}
+	if !credentials.TOTPEnabled {
+		c.JSON(http.StatusConflict, gin.H{"error": "Two-factor authentication is not enabled"})
+		return
+	}
+	if !input.valid() {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Provide either a code or a recovery code"})
+		return
+	}
+	if !input.verify(c, credentials, nil) {
+		return
+	}
+
+	codes, err := generateRecoveryCodes(database.DB, credentials.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate recovery codes"})
+		return
+	}
+	recordSecurityEvent(c, credentials.UserID, SecurityEventRecoveryCodesRegenerated, "")
+
+	c.JSON(http.StatusOK, gin.H{"recovery_codes": codes})
+}
+
+// recordSecurityEvent stores a security event of a user, with where the request came from.
+func recordSecurityEvent(c *gin.Context, userID uint, eventType, details string) {
+	event := SecurityEvent{
+		UserID:    userID,
+		Type:      eventType,
+		IPAddress: c.ClientIP(),
+		UserAgent: c.Request.UserAgent(),
+		Details:   details,
+	}
+	if err := database.DB.Create(&event).Error; err != nil {
+		log.Printf("Failed to record security event for user %d: %v", userID, err)
+	}
+}
@@ -0,0 +1,217 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// OnUserDisabled is called after a user was disabled, to end whatever they still have
+// open besides their tokens, like terminal sessions.
+var OnUserDisabled func(userID uint)
+
+// revocationList caches the revoked access tokens, so ValidateJWT doesn't need the
+// database. Revocations made by this process are added right away, those made by
+// others once SyncRevocations picks them up.
+type revocationList struct {
+	mu     sync.RWMutex
+	tokens map[string]time.Time // jti → when the token expires anyway
+	users  map[uint]time.Time   // user → tokens issued until then are revoked
+}
+
+var revocations = &revocationList{
+	tokens: map[string]time.Time{},
+	users:  map[uint]time.Time{},
+}
+
+// revoked reports whether the access token with claims was revoked. Issue times only
+// have a precision of a second, so revoking every token of a user also revokes those
+// issued later in the same second.
+func (l *revocationList) revoked(claims *Claims) bool {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	if claims.ID != "" {
+		if _, ok := l.tokens[claims.ID]; ok {
+			return true
+		}
+	}
+	cutoff, ok := l.users[claims.UserID]
+	return ok && (claims.IssuedAt == nil || !claims.IssuedAt.After(cutoff.Truncate(time.Second)))
+}
+
+func (l *revocationList) revokeToken(jti string, expiresAt time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.tokens[jti] = expiresAt
+}
+
+func (l *revocationList) revokeUser(userID uint, cutoff time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if cutoff.After(l.users[userID]) {
+		l.users[userID] = cutoff
+	}
+}
+
+// merge adds the revocations stored in the database and forgets those that only
+// concern tokens which expired since.
+func (l *revocationList) merge(tokens []RevokedToken, users []User) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, token := range tokens {
+		l.tokens[token.JTI] = token.ExpiresAt
+	}
+	for _, user := range users {
+		if user.TokensRevokedAt.After(l.users[user.ID]) {
+			l.users[user.ID] = *user.TokensRevokedAt
+		}
+	}
+
+	now := time.Now()
+	for jti, expiresAt := range l.tokens {
+		if now.After(expiresAt) {
+			delete(l.tokens, jti)
+		}
+	}
+	for userID, cutoff := range l.users {
+		if now.After(cutoff.Add(AccessTokenTTL)) {
+			delete(l.users, userID)
+		}
+	}
+}
+
+// generateTokenID returns a random jti for an access token.
+func generateTokenID() (string, error) {
+	idBytes := make([]byte, 16)
+	if _, err := rand.Read(idBytes); err != nil {
+		return "", errors.New("failed to generate token ID")
+	}
+	return hex.EncodeToString(idBytes), nil
+}
+
+// ErrTokenAlreadyRevoked is returned by RevokeAccessToken for a token that was revoked
+// before, so that tokens meant to be used once can't be used by two requests at a time.
+var ErrTokenAlreadyRevoked = errors.New("token already revoked")
+
+// RevokeAccessToken revokes a single access token before it expires. Tokens issued
+// before they had a jti can only be revoked along with every other token of their user.
+func RevokeAccessToken(db *gorm.DB, claims *Claims) error {
+	if claims.ID == "" || claims.ExpiresAt == nil {
+		return nil
+	}
+
+	token := RevokedToken{JTI: claims.ID, UserID: claims.UserID, ExpiresAt: claims.ExpiresAt.Time}
+	result := db.Clauses(clause.OnConflict{DoNothing: true}).Create(&token)
+	if result.Error != nil {
+		return result.Error
+	}
+	revocations.revokeToken(token.JTI, token.ExpiresAt)
+	if result.RowsAffected == 0 {
+		return ErrTokenAlreadyRevoked
+	}
+	return nil
+}
+
+// RevokeUserTokens revokes every access token issued to a user so far and deactivates
+// all their refresh tokens. It returns how many refresh tokens were deactivated.
+func RevokeUserTokens(db *gorm.DB, userID uint) (int64, error) {
+	now := time.Now()
+	var revoked int64
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&User{}).Where("id = ?", userID).Update("tokens_revoked_at", now).Error; err != nil {
+			return err
+		}
+		result := tx.Model(&RefreshToken{}).Where("user_id = ? AND active = ?", userID, true).Update("active", false)
+		revoked = result.RowsAffected
+		return result.Error
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	revocations.revokeUser(userID, now)
+	return revoked, nil
+}
+
+// SetUserDisabled disables or re-enables a user. Disabling revokes all their tokens and
+// calls OnUserDisabled; re-enabling lets them log in again.
+func SetUserDisabled(db *gorm.DB, userID uint, disabled bool) error {
+	var disabledAt *time.Time
+	if disabled {
+		now := time.Now()
+		disabledAt = &now
+	}
+
+	result := db.Model(&User{}).Where("id = ?", userID).Update("disabled_at", disabledAt)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	if !disabled {
+		return nil
+	}
+
+	if _, err := RevokeUserTokens(db, userID); err != nil {
+		return err
+	}
+	if OnUserDisabled != nil {
+		OnUserDisabled(userID)
+	}
+	return nil
+}
+
+// LoadRevocations reads the access token revocations from the database.
+func LoadRevocations(db *gorm.DB) error {
+	now := time.Now()
+
+	var tokens []RevokedToken
+	if err := db.Where("expires_at > ?", now).Find(&tokens).Error; err != nil {
+		return err
+	}
+
+	var users []User
+	if err := db.Where("tokens_revoked_at > ?", now.Add(-AccessTokenTTL)).Find(&users).Error; err != nil {
+		return err
+	}
+
+	revocations.merge(tokens, users)
+	return nil
+}
+
+// SyncRevocations reloads the revocations every interval until ctx is done, to pick up
+// those made by other instances.
+func SyncRevocations(ctx context.Context, db *gorm.DB, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := LoadRevocations(db); err != nil {
+					log.Println("Failed to sync access token revocations:", err)
+				}
+			}
+		}
+	}()
+}
+
+// PurgeRevokedTokens permanently deletes the revocations of access tokens that expired
+// since.
+func PurgeRevokedTokens(db *gorm.DB) (int64, error) {
+	result := db.Where("expires_at < ?", time.Now()).Delete(&RevokedToken{})
+	return result.RowsAffected, result.Error
+}
@@ -8,4 +8,26 @@ func RegisterAuthRoutes(router *gin.RouterGroup) {
 	router.POST("/register", RegisterUserHandler)
 	router.POST("/login", LoginUserHandler)
 	router.POST("/refresh", RefreshTokenHandler)
+	router.POST("/password/forgot", ForgotPasswordHandler)
+	router.POST("/password/reset", ResetPasswordHandler)
+	router.POST("/email/verify", VerifyEmailHandler)
+	router.POST("/email/resend", ResendVerificationEmailHandler)
+	router.POST("/mfa/verify", VerifyMFAHandler)
+	router.POST("/webauthn/login/begin", BeginWebAuthnLoginHandler)
+	router.POST("/webauthn/login/finish", FinishWebAuthnLoginHandler)
+
+	authenticated := router.Group("", RequireAuth())
+	authenticated.POST("/logout", LogoutHandler)
+	authenticated.POST("/logout-all", LogoutAllHandler)
+	authenticated.GET("/devices", ListDevicesHandler)
+	authenticated.DELETE("/devices/:id", RevokeDeviceHandler)
+	authenticated.POST("/mfa/totp/enroll", EnrollTOTPHandler)
+	authenticated.POST("/mfa/totp/confirm", ConfirmTOTPHandler)
+	authenticated.DELETE("/mfa/totp", DisableTOTPHandler)
+	authenticated.GET("/mfa/recovery-codes", GetRecoveryCodesHandler)
+	authenticated.POST("/mfa/recovery-codes", RegenerateRecoveryCodesHandler)
+	authenticated.POST("/webauthn/register/begin", BeginWebAuthnRegistrationHandler)
+	authenticated.POST("/webauthn/register/finish", FinishWebAuthnRegistrationHandler)
+	authenticated.GET("/webauthn/credentials", ListWebAuthnCredentialsHandler)
+	authenticated.DELETE("/webauthn/credentials/:id", DeleteWebAuthnCredentialHandler)
 }
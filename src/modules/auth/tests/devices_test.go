@@ -0,0 +1,138 @@
+package auth
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"let-me-in/database"
+	"let-me-in/modules/auth"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+// performUserRequest sends a JSON request as the holder of accessToken, from userAgent.
+func performUserRequest(r *gin.Engine, method, path, accessToken, userAgent string, body interface{}) *httptest.ResponseRecorder {
+	jsonBody, _ := json.Marshal(body)
+	req, _ := http.NewRequest(method, path, bytes.NewBuffer(jsonBody))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	req.Header.Set("User-Agent", userAgent)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+// loginFrom logs an existing user in from userAgent and returns the login response.
+func loginFrom(t *testing.T, router *gin.Engine, email, userAgent string) map[string]string {
+	w := performUserRequest(router, "POST", "/auth/login", "", userAgent, map[string]string{"email": email, "password": "testpassword"})
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var response map[string]string
+	json.Unmarshal(w.Body.Bytes(), &response)
+	return response
+}
+
+func refresh(router *gin.Engine, refreshToken string) int {
+	return performRequest(router, "POST", "/auth/refresh", map[string]string{"refresh_token": refreshToken}).Code
+}
+
+func listDevices(t *testing.T, router *gin.Engine, accessToken string) []auth.Device {
+	w := performUserRequest(router, "GET", "/auth/devices", accessToken, "", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var response struct{ Devices []auth.Device }
+	json.Unmarshal(w.Body.Bytes(), &response)
+	return response.Devices
+}
+
+func TestLogout(t *testing.T) {
+	database.InitTestDB()
+	router := newProtectedRouter()
+	registerAndLogin(t, router, "devices1@example.com")
+	other := registerAndLogin(t, router, "devices2@example.com")
+	session := loginFrom(t, router, "devices1@example.com", "laptop")
+
+	// Only the user's own tokens can be revoked
+	w := performUserRequest(router, "POST", "/auth/logout", other["access_token"].(string), "", map[string]string{"refresh_token": session["refresh_token"]})
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	w = performUserRequest(router, "POST", "/auth/logout", session["access_token"], "", nil)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = performUserRequest(router, "POST", "/auth/logout", session["access_token"], "", map[string]string{"refresh_token": session["refresh_token"]})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, http.StatusUnauthorized, refresh(router, session["refresh_token"]))
+
+	// A token that was logged out was not stolen
+	claims, _ := auth.ValidateJWT(session["access_token"])
+	assert.Equal(t, int64(0), securityEvents(claims.UserID, auth.SecurityEventRefreshTokenReuse))
+
+	database.ResetTestDB()
+}
+
+func TestLogoutAll(t *testing.T) {
+	database.InitTestDB()
+	router := newProtectedRouter()
+	first := registerAndLogin(t, router, "devices3@example.com")
+	second := loginFrom(t, router, "devices3@example.com", "phone")
+	other := registerAndLogin(t, router, "devices4@example.com")
+
+	w := performUserRequest(router, "POST", "/auth/logout-all", second["access_token"], "", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var response map[string]interface{}
+	json.Unmarshal(w.Body.Bytes(), &response)
+	assert.Equal(t, float64(2), response["revoked"])
+
+	assert.Equal(t, http.StatusUnauthorized, refresh(router, first["refresh_token"].(string)))
+	assert.Equal(t, http.StatusUnauthorized, refresh(router, second["refresh_token"]))
+	assert.Equal(t, http.StatusOK, refresh(router, other["refresh_token"].(string)))
+
+	database.ResetTestDB()
+}
+
+func TestDevices(t *testing.T) {
+	database.InitTestDB()
+	router := newProtectedRouter()
+	registerAndLogin(t, router, "devices5@example.com")
+	other := registerAndLogin(t, router, "devices6@example.com")
+	laptop := loginFrom(t, router, "devices5@example.com", "laptop")
+	phone := loginFrom(t, router, "devices5@example.com", "phone")
+
+	// Refreshing keeps the device, and updates its last use
+	assert.Equal(t, http.StatusOK, refresh(router, phone["refresh_token"]))
+
+	devices := listDevices(t, router, laptop["access_token"])
+	assert.Len(t, devices, 3)
+	var phoneDevice, laptopDevice auth.Device
+	for _, device := range devices {
+		switch device.UserAgent {
+		case "phone":
+			phoneDevice = device
+		case "laptop":
+			laptopDevice = device
+		}
+	}
+	assert.NotEmpty(t, phoneDevice.IPAddress)
+	assert.True(t, phoneDevice.LastUsedAt.After(phoneDevice.SignedInAt))
+	assert.False(t, laptopDevice.SignedInAt.IsZero())
+	assert.WithinDuration(t, laptopDevice.SignedInAt, laptopDevice.LastUsedAt, time.Second)
+	// Most recently used first
+	assert.Equal(t, "phone", devices[0].UserAgent)
+
+	// Nobody else can revoke the user's devices
+	path := fmt.Sprintf("/auth/devices/%d", laptopDevice.ID)
+	w := performUserRequest(router, "DELETE", path, other["access_token"].(string), "", nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	w = performUserRequest(router, "DELETE", path, phone["access_token"], "", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, http.StatusUnauthorized, refresh(router, laptop["refresh_token"]))
+	assert.Len(t, listDevices(t, router, phone["access_token"]), 2)
+
+	database.ResetTestDB()
+}
@@ -0,0 +1,142 @@
+package auth
+
+import (
+	"encoding/json"
+	"let-me-in/database"
+	"let-me-in/modules/auth"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func register(t *testing.T, router *gin.Engine, email string) {
+	w := performRequest(router, "POST", "/auth/register", map[string]string{
+		"display_name": "testuser",
+		"email":        email,
+		"password":     "testpassword",
+	})
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func passwordLogin(router *gin.Engine, email string) int {
+	return performRequest(router, "POST", "/auth/login", map[string]string{"email": email, "password": "testpassword"}).Code
+}
+
+func verifyEmail(router *gin.Engine, token string) int {
+	return performRequest(router, "POST", "/auth/email/verify", map[string]string{"token": token}).Code
+}
+
+func TestEmailVerification(t *testing.T) {
+	database.InitTestDB()
+	t.Setenv("REQUIRE_EMAIL_VERIFICATION", "true")
+	outbox := useOutbox(t)
+	router := newProtectedRouter()
+
+	register(t, router, "verify1@example.com")
+	emails := readOutbox(t, outbox)
+	if !assert.Len(t, emails, 1) {
+		return
+	}
+	assert.Contains(t, emails[0], "To: verify1@example.com\r\n")
+	token := linkToken(t, emails[0])
+
+	assert.Equal(t, http.StatusForbidden, passwordLogin(router, "verify1@example.com"))
+
+	assert.Equal(t, http.StatusBadRequest, verifyEmail(router, token+"x"))
+	assert.Equal(t, http.StatusOK, verifyEmail(router, token))
+	assert.Equal(t, http.StatusOK, passwordLogin(router, "verify1@example.com"))
+
+	database.ResetTestDB()
+}
+
+func TestEmailVerificationIsOptional(t *testing.T) {
+	database.InitTestDB()
+	router := newProtectedRouter()
+
+	register(t, router, "verify2@example.com")
+	assert.Equal(t, http.StatusOK, passwordLogin(router, "verify2@example.com"))
+
+	// Requiring it later also stops the logins from before
+	login := performRequest(router, "POST", "/auth/login", map[string]string{"email": "verify2@example.com", "password": "testpassword"})
+	var tokens map[string]string
+	json.Unmarshal(login.Body.Bytes(), &tokens)
+	t.Setenv("REQUIRE_EMAIL_VERIFICATION", "true")
+	assert.Equal(t, http.StatusForbidden, refresh(router, tokens["refresh_token"]))
+
+	database.ResetTestDB()
+}
+
+func TestEmailVerificationSecret(t *testing.T) {
+	t.Setenv("EMAIL_VERIFICATION_SECRET", "")
+	assert.NoError(t, auth.LoadEmailVerificationSecret())
+
+	// Links must survive restarts once logins depend on them
+	t.Setenv("REQUIRE_EMAIL_VERIFICATION", "true")
+	assert.ErrorContains(t, auth.LoadEmailVerificationSecret(), "EMAIL_VERIFICATION_SECRET")
+
+	t.Setenv("EMAIL_VERIFICATION_SECRET", "too short")
+	assert.Error(t, auth.LoadEmailVerificationSecret())
+	t.Setenv("EMAIL_VERIFICATION_SECRET", strings.Repeat("s", 32))
+	assert.NoError(t, auth.LoadEmailVerificationSecret())
+}
+
+func TestEmailVerificationExpires(t *testing.T) {
+	database.InitTestDB()
+	t.Setenv("REQUIRE_EMAIL_VERIFICATION", "true")
+	t.Setenv("EMAIL_VERIFICATION_TTL", "-1s")
+	outbox := useOutbox(t)
+	router := newProtectedRouter()
+
+	register(t, router, "verify3@example.com")
+	emails := readOutbox(t, outbox)
+	if !assert.Len(t, emails, 1) {
+		return
+	}
+	assert.Equal(t, http.StatusBadRequest, verifyEmail(router, linkToken(t, emails[0])))
+
+	database.ResetTestDB()
+}
+
+func TestResendVerificationEmail(t *testing.T) {
+	database.InitTestDB()
+	t.Setenv("REQUIRE_EMAIL_VERIFICATION", "true")
+	t.Setenv("EMAIL_VERIFICATION_RESEND_INTERVAL", "1h")
+	outbox := useOutbox(t)
+	router := newProtectedRouter()
+	register(t, router, "verify4@example.com")
+
+	resend := func(email string) *httptest.ResponseRecorder {
+		w := performRequest(router, "POST", "/auth/email/resend", map[string]string{"email": email})
+		auth.WaitForVerificationEmails()
+		return w
+	}
+
+	// Registering just sent one, which nobody can tell from the response. Unknown
+	// addresses are answered and throttled the same
+	for _, email := range []string{"verify4@example.com", "nobody@example.com"} {
+		first := resend(email)
+		assert.Equal(t, http.StatusOK, first.Code)
+		second := resend(email)
+		assert.Equal(t, http.StatusTooManyRequests, second.Code)
+		assert.NotEmpty(t, second.Header().Get("Retry-After"))
+	}
+	assert.Len(t, readOutbox(t, outbox), 1)
+
+	t.Setenv("EMAIL_VERIFICATION_RESEND_INTERVAL", "0s")
+	assert.Equal(t, http.StatusOK, resend("verify4@example.com").Code)
+	emails := readOutbox(t, outbox)
+	if !assert.Len(t, emails, 2) {
+		return
+	}
+
+	// Verified addresses get the same answer, and no email
+	assert.Equal(t, http.StatusOK, verifyEmail(router, linkToken(t, emails[1])))
+	assert.Equal(t, http.StatusOK, resend("verify4@example.com").Code)
+	assert.Len(t, readOutbox(t, outbox), 2)
+
+	database.ResetTestDB()
+}
@@ -0,0 +1,282 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"let-me-in/modules/auth"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+// jwtEnv are the variables signing keys are configured with.
+var jwtEnv = []string{"JWT_KEYS_FILE", "JWT_ALGORITHM", "JWT_SECRET", "JWT_PRIVATE_KEY_FILE", "JWT_KEY_ID"}
+
+// writePrivateKey writes key to a PEM file in PKCS #8 form.
+func writePrivateKey(t *testing.T, key interface{}) string {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	assert.NoError(t, err)
+	path := filepath.Join(t.TempDir(), "key.pem")
+	assert.NoError(t, os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600))
+	return path
+}
+
+// useSigningKey loads the signing key described by env, and restores a random key afterwards.
+func useSigningKey(t *testing.T, env map[string]string) {
+	for _, key := range jwtEnv {
+		t.Setenv(key, env[key])
+	}
+	assert.NoError(t, auth.LoadSigningKeys())
+	t.Cleanup(func() {
+		secret := make([]byte, 32)
+		rand.Read(secret)
+		key, _ := auth.NewHMACKey("", secret)
+		auth.SetKeySet(auth.NewKeySet(key))
+	})
+}
+
+func fetchJWKS(t *testing.T) auth.JSONWebKeySet {
+	router := gin.New()
+	router.GET("/.well-known/jwks.json", auth.JWKSHandler)
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/.well-known/jwks.json", nil)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var set auth.JSONWebKeySet
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &set))
+	return set
+}
+
+func decodeBase64(t *testing.T, s string) []byte {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	assert.NoError(t, err)
+	return data
+}
+
+func TestHS256SigningKey(t *testing.T) {
+	useSigningKey(t, map[string]string{"JWT_SECRET": "0123456789abcdef0123456789abcdef", "JWT_KEY_ID": "primary"})
+
+	token, err := auth.GenerateJWT(42)
+	assert.NoError(t, err)
+	parsed, _, err := jwt.NewParser().ParseUnverified(token, &auth.Claims{})
+	assert.NoError(t, err)
+	assert.Equal(t, "HS256", parsed.Method.Alg())
+	assert.Equal(t, "primary", parsed.Header["kid"])
+
+	claims, err := auth.ValidateJWT(token)
+	assert.NoError(t, err)
+	assert.Equal(t, uint(42), claims.UserID)
+
+	// Secrets are never published
+	assert.Empty(t, fetchJWKS(t).Keys)
+}
+
+func TestSigningKeyConfigErrors(t *testing.T) {
+	for name, env := range map[string]map[string]string{
+		"missing secret":   {},
+		"short secret":     {"JWT_SECRET": "super-secret-key"},
+		"unknown alg":      {"JWT_ALGORITHM": "none"},
+		"missing key file": {"JWT_ALGORITHM": "RS256"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			for _, key := range jwtEnv {
+				t.Setenv(key, env[key])
+			}
+			assert.Error(t, auth.LoadSigningKeys())
+		})
+	}
+
+	// The key file must match the algorithm
+	_, private, _ := ed25519.GenerateKey(rand.Reader)
+	t.Setenv("JWT_ALGORITHM", "RS256")
+	t.Setenv("JWT_PRIVATE_KEY_FILE", writePrivateKey(t, private))
+	assert.Error(t, auth.LoadSigningKeys())
+}
+
+func TestRS256SigningKeyPublishedInJWKS(t *testing.T) {
+	private, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	useSigningKey(t, map[string]string{"JWT_ALGORITHM": "RS256", "JWT_PRIVATE_KEY_FILE": writePrivateKey(t, private)})
+
+	token, err := auth.GenerateJWT(7)
+	assert.NoError(t, err)
+
+	set := fetchJWKS(t)
+	if !assert.Len(t, set.Keys, 1) {
+		return
+	}
+	jwk := set.Keys[0]
+	assert.Equal(t, "RSA", jwk.Kty)
+	assert.Equal(t, "RS256", jwk.Alg)
+
+	// Another service can verify the token with nothing but the JWKS
+	public := &rsa.PublicKey{
+		N: new(big.Int).SetBytes(decodeBase64(t, jwk.N)),
+		E: int(new(big.Int).SetBytes(decodeBase64(t, jwk.E)).Int64()),
+	}
+	parsed, err := jwt.ParseWithClaims(token, &auth.Claims{}, func(token *jwt.Token) (interface{}, error) {
+		assert.Equal(t, jwk.Kid, token.Header["kid"])
+		return public, nil
+	}, jwt.WithValidMethods([]string{"RS256"}))
+	assert.NoError(t, err)
+	assert.Equal(t, uint(7), parsed.Claims.(*auth.Claims).UserID)
+}
+
+func TestEdDSASigningKeyPublishedInJWKS(t *testing.T) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	useSigningKey(t, map[string]string{"JWT_ALGORITHM": "EdDSA", "JWT_PRIVATE_KEY_FILE": writePrivateKey(t, private)})
+
+	token, err := auth.GenerateJWT(7)
+	assert.NoError(t, err)
+	claims, err := auth.ValidateJWT(token)
+	assert.NoError(t, err)
+	assert.Equal(t, uint(7), claims.UserID)
+
+	set := fetchJWKS(t)
+	if assert.Len(t, set.Keys, 1) {
+		assert.Equal(t, "OKP", set.Keys[0].Kty)
+		assert.Equal(t, "Ed25519", set.Keys[0].Crv)
+		assert.Equal(t, []byte(public), decodeBase64(t, set.Keys[0].X))
+	}
+}
+
+func TestValidateJWTRejectsForeignTokens(t *testing.T) {
+	private, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	useSigningKey(t, map[string]string{"JWT_ALGORITHM": "RS256", "JWT_PRIVATE_KEY_FILE": writePrivateKey(t, private)})
+	kid := fetchJWKS(t).Keys[0].Kid
+	claims := auth.Claims{UserID: 1}
+
+	// A token signed with the public key as an HMAC secret
+	publicDER := x509.MarshalPKCS1PublicKey(&private.PublicKey)
+	forged := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	forged.Header["kid"] = kid
+	forgedToken, _ := forged.SignedString(publicDER)
+	_, err = auth.ValidateJWT(forgedToken)
+	assert.Error(t, err)
+
+	// The old hardcoded secret
+	legacy, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte("super-secret-key"))
+	_, err = auth.ValidateJWT(legacy)
+	assert.Error(t, err)
+
+	// A key we don't know
+	other, _ := rsa.GenerateKey(rand.Reader, 2048)
+	unknown := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	unknown.Header["kid"] = kid
+	unknownToken, _ := unknown.SignedString(other)
+	_, err = auth.ValidateJWT(unknownToken)
+	assert.Error(t, err)
+}
+
+func kidOf(t *testing.T, token string) string {
+	parsed, _, err := jwt.NewParser().ParseUnverified(token, &auth.Claims{})
+	assert.NoError(t, err)
+	kid, _ := parsed.Header["kid"].(string)
+	return kid
+}
+
+func TestKeyRotationKeepsOldTokensValid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.json")
+	file, err := auth.ReadKeyFile(path)
+	assert.NoError(t, err)
+	first, err := file.Rotate(auth.AlgEdDSA, time.Minute)
+	assert.NoError(t, err)
+	assert.Nil(t, first.ActivatesAt)
+	assert.NoError(t, file.Write(path))
+	useSigningKey(t, map[string]string{"JWT_KEYS_FILE": path})
+
+	oldToken, err := auth.GenerateJWT(1)
+	assert.NoError(t, err)
+	assert.Equal(t, first.ID, kidOf(t, oldToken))
+
+	// Rotate to another algorithm. The new key is published, but the old one keeps
+	// signing until everyone can verify the new one
+	file, err = auth.ReadKeyFile(path)
+	assert.NoError(t, err)
+	second, err := file.Rotate(auth.AlgRS256, time.Minute)
+	assert.NoError(t, err)
+	assert.NoError(t, file.Write(path))
+	assert.NoError(t, auth.LoadSigningKeys())
+	if assert.NotNil(t, second.ActivatesAt) {
+		assert.WithinDuration(t, time.Now().Add(time.Minute+auth.JWKSMaxAge), *second.ActivatesAt, 2*time.Second)
+	}
+	assert.Len(t, fetchJWKS(t).Keys, 2)
+
+	pendingToken, err := auth.GenerateJWT(2)
+	assert.NoError(t, err)
+	assert.Equal(t, first.ID, kidOf(t, pendingToken))
+
+	// Once it activates, the new key signs
+	activated := time.Now().Add(-time.Second)
+	file.Keys[0].ActivatesAt = &activated
+	assert.NoError(t, file.Write(path))
+	assert.NoError(t, auth.LoadSigningKeys())
+
+	newToken, err := auth.GenerateJWT(2)
+	assert.NoError(t, err)
+	assert.Equal(t, second.ID, kidOf(t, newToken))
+
+	// Both keys verify, and both are published until the old one expires
+	_, err = auth.ValidateJWT(oldToken)
+	assert.NoError(t, err)
+	_, err = auth.ValidateJWT(newToken)
+	assert.NoError(t, err)
+	assert.Len(t, fetchJWKS(t).Keys, 2)
+
+	if assert.Len(t, file.Keys, 2) && assert.NotNil(t, file.Keys[1].ExpiresAt) {
+		assert.WithinDuration(t, second.ActivatesAt.Add(auth.AccessTokenTTL+time.Minute), *file.Keys[1].ExpiresAt, 2*time.Second)
+	}
+
+	// Once expired, the old key no longer verifies anything
+	past := time.Now().Add(-time.Second)
+	file.Keys[1].ExpiresAt = &past
+	assert.NoError(t, file.Write(path))
+	assert.NoError(t, auth.LoadSigningKeys())
+	_, err = auth.ValidateJWT(oldToken)
+	assert.Error(t, err)
+	_, err = auth.ValidateJWT(newToken)
+	assert.NoError(t, err)
+	assert.Len(t, fetchJWKS(t).Keys, 1)
+
+	// Expired keys are dropped on the next rotation
+	third, err := file.Rotate(auth.AlgHS256, time.Minute)
+	assert.NoError(t, err)
+	assert.Len(t, file.Keys, 2)
+	assert.Equal(t, second.ID, file.Previous)
+
+	// Replacing a key that never activated keeps the one signing now
+	_, err = file.Rotate(auth.AlgEdDSA, time.Minute)
+	assert.NoError(t, err)
+	assert.Equal(t, second.ID, file.Previous)
+	for _, key := range file.Keys {
+		if key.ID == third.ID && assert.NotNil(t, key.ExpiresAt) {
+			assert.WithinDuration(t, time.Now().Add(time.Minute), *key.ExpiresAt, 2*time.Second)
+		}
+	}
+}
+
+func TestKeyFileWithoutActiveKey(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.json")
+	assert.NoError(t, os.WriteFile(path, []byte(`{"active": "", "keys": []}`), 0600))
+	for _, key := range jwtEnv {
+		t.Setenv(key, "")
+	}
+	t.Setenv("JWT_KEYS_FILE", path)
+	assert.ErrorContains(t, auth.LoadSigningKeys(), "keys rotate")
+}
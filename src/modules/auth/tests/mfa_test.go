@@ -0,0 +1,217 @@
+package auth
+
+import (
+	"encoding/json"
+	"let-me-in/database"
+	"let-me-in/modules/auth"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+// enrollTOTP enables two-factor authentication for the holder of accessToken and returns
+// its secret and recovery codes. The code for the current period is used up by the
+// confirmation.
+func enrollTOTP(t *testing.T, router *gin.Engine, accessToken string) (string, []string) {
+	w := performUserRequest(router, "POST", "/auth/mfa/totp/enroll", accessToken, "", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var enrollment map[string]string
+	json.Unmarshal(w.Body.Bytes(), &enrollment)
+	assert.True(t, strings.HasPrefix(enrollment["uri"], "otpauth://totp/"))
+	assert.Contains(t, enrollment["uri"], "secret="+enrollment["secret"])
+
+	w = performUserRequest(router, "POST", "/auth/mfa/totp/confirm", accessToken, "", map[string]string{"code": "000000"})
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	w = performUserRequest(router, "POST", "/auth/mfa/totp/confirm", accessToken, "", map[string]string{"code": totpCode(t, enrollment["secret"], 0)})
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var confirmation struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &confirmation)
+	assert.Len(t, confirmation.RecoveryCodes, 10)
+	return enrollment["secret"], confirmation.RecoveryCodes
+}
+
+// totpCode returns the code of secret for the period offset periods from now.
+func totpCode(t *testing.T, secret string, offset int) string {
+	code, err := auth.GenerateTOTPCode(secret, time.Now().Add(time.Duration(offset)*30*time.Second))
+	assert.NoError(t, err)
+	return code
+}
+
+// mfaChallenge logs in with the password and returns the MFA token.
+func mfaChallenge(t *testing.T, router *gin.Engine, email string) string {
+	w := performRequest(router, "POST", "/auth/login", map[string]string{"email": email, "password": "testpassword"})
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var response map[string]interface{}
+	json.Unmarshal(w.Body.Bytes(), &response)
+	assert.Equal(t, true, response["mfa_required"])
+	assert.NotContains(t, response, "access_token")
+	assert.NotContains(t, response, "refresh_token")
+	mfaToken, _ := response["mfa_token"].(string)
+	return mfaToken
+}
+
+func verifyMFA(router *gin.Engine, mfaToken, code string) (int, map[string]string) {
+	w := performRequest(router, "POST", "/auth/mfa/verify", map[string]string{"mfa_token": mfaToken, "code": code})
+	var response map[string]string
+	json.Unmarshal(w.Body.Bytes(), &response)
+	return w.Code, response
+}
+
+func TestGenerateTOTPCode(t *testing.T) {
+	// RFC 6238 test vectors, truncated to 6 digits
+	secret := "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ" // "12345678901234567890"
+	for unix, want := range map[int64]string{
+		59:         "287082",
+		1111111109: "081804",
+		1234567890: "005924",
+		2000000000: "279037",
+	} {
+		code, err := auth.GenerateTOTPCode(secret, time.Unix(unix, 0))
+		assert.NoError(t, err)
+		assert.Equal(t, want, code, unix)
+	}
+
+	_, err := auth.GenerateTOTPCode("not base32!", time.Now())
+	assert.Error(t, err)
+}
+
+func TestTOTPLogin(t *testing.T) {
+	database.InitTestDB()
+	router := newProtectedRouter()
+	login := registerAndLogin(t, router, "mfa1@example.com")
+	secret, _ := enrollTOTP(t, router, login["access_token"].(string))
+
+	w := performUserRequest(router, "POST", "/auth/mfa/totp/enroll", login["access_token"].(string), "", nil)
+	assert.Equal(t, http.StatusConflict, w.Code)
+
+	mfaToken := mfaChallenge(t, router, "mfa1@example.com")
+	// The MFA token is no access token
+	assert.Equal(t, http.StatusUnauthorized, protected(router, mfaToken))
+
+	code, _ := verifyMFA(router, mfaToken, "000000")
+	assert.Equal(t, http.StatusUnauthorized, code)
+	// The code used for the confirmation can't be replayed
+	code, _ = verifyMFA(router, mfaToken, totpCode(t, secret, 0))
+	assert.Equal(t, http.StatusUnauthorized, code)
+
+	code, tokens := verifyMFA(router, mfaToken, totpCode(t, secret, 1))
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, http.StatusOK, protected(router, tokens["access_token"]))
+	assert.Equal(t, http.StatusOK, refresh(router, tokens["refresh_token"]))
+
+	// The MFA token logs in once
+	code, _ = verifyMFA(router, mfaToken, totpCode(t, secret, -1))
+	assert.Equal(t, http.StatusUnauthorized, code)
+
+	database.ResetTestDB()
+}
+
+func TestTOTPLoginLimitsAttempts(t *testing.T) {
+	database.InitTestDB()
+	router := newProtectedRouter()
+	login := registerAndLogin(t, router, "mfa2@example.com")
+	secret, _ := enrollTOTP(t, router, login["access_token"].(string))
+
+	claims, _ := auth.ValidateJWT(login["access_token"].(string))
+	// lockedUntil returns when the second factor of the user is locked until, ending the
+	// lockout right away
+	lockedUntil := func() time.Time {
+		var credentials auth.UserCredentials
+		database.DB.Where("user_id = ?", claims.UserID).First(&credentials)
+		database.DB.Model(&credentials).Update("mfa_locked_until", time.Now().Add(-time.Second))
+		if credentials.MFALockedUntil == nil {
+			return time.Time{}
+		}
+		return *credentials.MFALockedUntil
+	}
+
+	mfaToken := mfaChallenge(t, router, "mfa2@example.com")
+	for i := 0; i < 4; i++ {
+		code, _ := verifyMFA(router, mfaToken, "000000")
+		assert.Equal(t, http.StatusUnauthorized, code)
+	}
+	code, _ := verifyMFA(router, mfaToken, "000000")
+	assert.Equal(t, http.StatusTooManyRequests, code)
+	assert.Equal(t, int64(1), securityEvents(claims.UserID, auth.SecurityEventMFALocked))
+
+	// Logging in again doesn't lift the lockout, not even with the right code
+	mfaToken = mfaChallenge(t, router, "mfa2@example.com")
+	code, _ = verifyMFA(router, mfaToken, totpCode(t, secret, 1))
+	assert.Equal(t, http.StatusTooManyRequests, code)
+	assert.WithinDuration(t, time.Now().Add(5*time.Minute), lockedUntil(), 5*time.Second)
+
+	// Failing again after the lockout locks for twice as long
+	mfaToken = mfaChallenge(t, router, "mfa2@example.com")
+	for i := 0; i < 5; i++ {
+		verifyMFA(router, mfaToken, "000000")
+	}
+	assert.WithinDuration(t, time.Now().Add(10*time.Minute), lockedUntil(), 5*time.Second)
+
+	// The right code resets the count
+	mfaToken = mfaChallenge(t, router, "mfa2@example.com")
+	code, _ = verifyMFA(router, mfaToken, totpCode(t, secret, 1))
+	assert.Equal(t, http.StatusOK, code)
+	var credentials auth.UserCredentials
+	database.DB.Where("user_id = ?", claims.UserID).First(&credentials)
+	assert.Equal(t, 0, credentials.MFAFailures)
+	assert.Nil(t, credentials.MFALockedUntil)
+
+	database.ResetTestDB()
+}
+
+func TestDisableTOTP(t *testing.T) {
+	database.InitTestDB()
+	router := newProtectedRouter()
+	login := registerAndLogin(t, router, "mfa3@example.com")
+	accessToken := login["access_token"].(string)
+	secret, _ := enrollTOTP(t, router, accessToken)
+
+	w := performUserRequest(router, "DELETE", "/auth/mfa/totp", accessToken, "", map[string]string{"code": "000000"})
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	w = performUserRequest(router, "DELETE", "/auth/mfa/totp", accessToken, "", map[string]string{"code": totpCode(t, secret, 1)})
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// The password is enough again
+	w = performRequest(router, "POST", "/auth/login", map[string]string{"email": "mfa3@example.com", "password": "testpassword"})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "access_token")
+
+	database.ResetTestDB()
+}
+
+func TestTOTPLockoutCoversAccountSettings(t *testing.T) {
+	database.InitTestDB()
+	router := newProtectedRouter()
+	login := registerAndLogin(t, router, "mfa4@example.com")
+	accessToken := login["access_token"].(string)
+	secret, codes := enrollTOTP(t, router, accessToken)
+
+	// Wrong codes count the same wherever they are tried
+	for i := 0; i < 4; i++ {
+		w := performUserRequest(router, "DELETE", "/auth/mfa/totp", accessToken, "", map[string]string{"code": "000000"})
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+	}
+	w := performUserRequest(router, "POST", "/auth/mfa/recovery-codes", accessToken, "", map[string]string{"code": "000000"})
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.NotEmpty(t, w.Header().Get("Retry-After"))
+
+	// While locked, not even the right codes get through
+	w = performUserRequest(router, "DELETE", "/auth/mfa/totp", accessToken, "", map[string]string{"code": totpCode(t, secret, 1)})
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	w = performUserRequest(router, "POST", "/auth/mfa/recovery-codes", accessToken, "", map[string]string{"recovery_code": codes[0]})
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	code, _ := verifyMFA(router, mfaChallenge(t, router, "mfa4@example.com"), totpCode(t, secret, 1))
+	assert.Equal(t, http.StatusTooManyRequests, code)
+
+	database.ResetTestDB()
+}
@@ -0,0 +1,146 @@
+package auth
+
+import (
+	"encoding/json"
+	"let-me-in/database"
+	"let-me-in/modules/auth"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+// registerAndLogin creates a user and returns the login response.
+func registerAndLogin(t *testing.T, router *gin.Engine, email string) map[string]interface{} {
+	registerBody := map[string]string{
+		"display_name": "testuser",
+		"email":        email,
+		"password":     "testpassword",
+	}
+	wRegister := performRequest(router, "POST", "/auth/register", registerBody)
+	assert.Equal(t, http.StatusOK, wRegister.Code)
+
+	loginBody := map[string]string{
+		"email":    email,
+		"password": "testpassword",
+	}
+	wLogin := performRequest(router, "POST", "/auth/login", loginBody)
+	assert.Equal(t, http.StatusOK, wLogin.Code)
+
+	var loginResponse map[string]interface{}
+	json.Unmarshal(wLogin.Body.Bytes(), &loginResponse)
+	return loginResponse
+}
+
+// performAuthorizedRequest sends a request with the given headers and no body.
+func performAuthorizedRequest(r *gin.Engine, method, path string, headers map[string]string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest(method, path, nil)
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func newProtectedRouter() *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	router := gin.Default()
+	auth.RegisterAuthRoutes(router.Group("/auth"))
+	router.GET("/protected", auth.RequireAuth(), func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"user_id": auth.CurrentUser(c).ID})
+	})
+	return router
+}
+
+func TestRequireAuthAcceptsBearerToken(t *testing.T) {
+	database.InitTestDB()
+	router := newProtectedRouter()
+
+	loginResponse := registerAndLogin(t, router, "middleware1@example.com")
+	accessToken := loginResponse["access_token"].(string)
+	claims, err := auth.ValidateJWT(accessToken)
+	assert.NoError(t, err)
+
+	w := performAuthorizedRequest(router, "GET", "/protected", map[string]string{
+		"Authorization": "Bearer " + accessToken,
+	})
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var response map[string]interface{}
+	json.Unmarshal(w.Body.Bytes(), &response)
+	assert.Equal(t, float64(claims.UserID), response["user_id"])
+
+	database.ResetTestDB()
+}
+
+func TestRequireAuthRejectsMissingOrInvalidTokens(t *testing.T) {
+	database.InitTestDB()
+	router := newProtectedRouter()
+
+	loginResponse := registerAndLogin(t, router, "middleware2@example.com")
+	accessToken := loginResponse["access_token"].(string)
+
+	testCases := []struct {
+		name        string
+		path        string
+		headers     map[string]string
+		expectedErr string
+	}{
+		{
+			name:        "Missing header",
+			path:        "/protected",
+			headers:     map[string]string{},
+			expectedErr: "Missing access token",
+		},
+		{
+			name:        "Wrong scheme",
+			path:        "/protected",
+			headers:     map[string]string{"Authorization": "Basic " + accessToken},
+			expectedErr: "Missing access token",
+		},
+		{
+			name:        "Garbage token",
+			path:        "/protected",
+			headers:     map[string]string{"Authorization": "Bearer not-a-jwt"},
+			expectedErr: "Invalid token",
+		},
+		{
+			name:        "Query token outside a WebSocket upgrade",
+			path:        "/protected?token=" + accessToken,
+			headers:     map[string]string{},
+			expectedErr: "Missing access token",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			w := performAuthorizedRequest(router, "GET", tc.path, tc.headers)
+			assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+			var response map[string]string
+			json.Unmarshal(w.Body.Bytes(), &response)
+			assert.Equal(t, tc.expectedErr, response["error"])
+		})
+	}
+
+	database.ResetTestDB()
+}
+
+func TestRequireAuthAcceptsQueryTokenOnWebSocketUpgrade(t *testing.T) {
+	database.InitTestDB()
+	router := newProtectedRouter()
+
+	loginResponse := registerAndLogin(t, router, "middleware3@example.com")
+	accessToken := loginResponse["access_token"].(string)
+
+	w := performAuthorizedRequest(router, "GET", "/protected?token="+accessToken, map[string]string{
+		"Connection": "Upgrade",
+		"Upgrade":    "websocket",
+	})
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	database.ResetTestDB()
+}
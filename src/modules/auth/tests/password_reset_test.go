@@ -0,0 +1,197 @@
+package auth
+
+import (
+	"bytes"
+	"encoding/json"
+	"let-me-in/database"
+	"let-me-in/mailer"
+	"let-me-in/modules/auth"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestMain keeps the emails tests send, registration sending one, out of the source tree.
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "outbox")
+	if err != nil {
+		panic(err)
+	}
+	mailer.Default = &mailer.FileMailer{Dir: dir}
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// useOutbox makes emails go to a directory of the test, and returns it.
+func useOutbox(t *testing.T) string {
+	dir := t.TempDir()
+	previous := mailer.Default
+	mailer.Default = &mailer.FileMailer{Dir: dir, From: "let-me-in@example.com"}
+	t.Cleanup(func() { mailer.Default = previous })
+	return dir
+}
+
+// readOutbox returns the emails written to dir, oldest first.
+func readOutbox(t *testing.T, dir string) []string {
+	entries, err := os.ReadDir(dir)
+	assert.NoError(t, err)
+	emails := make([]string, len(entries))
+	for i, entry := range entries {
+		data, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		assert.NoError(t, err)
+		emails[i] = string(data)
+	}
+	return emails
+}
+
+var linkPattern = regexp.MustCompile(`http\S+`)
+
+// linkToken returns the token of the link in an email.
+func linkToken(t *testing.T, email string) string {
+	link, err := url.Parse(linkPattern.FindString(email))
+	assert.NoError(t, err)
+	return link.Query().Get("token")
+}
+
+// forgotPassword asks for a reset link, and waits for it to be sent.
+func forgotPassword(t *testing.T, router *gin.Engine, email string) {
+	w := performRequest(router, "POST", "/auth/password/forgot", map[string]string{"email": email})
+	assert.Equal(t, http.StatusOK, w.Code)
+	auth.WaitForPasswordResetLinks()
+}
+
+// forgotPasswordFrom asks for a reset link from the given IP address.
+func forgotPasswordFrom(router *gin.Engine, ip, email string) *httptest.ResponseRecorder {
+	body, _ := json.Marshal(map[string]string{"email": email})
+	req, _ := http.NewRequest("POST", "/auth/password/forgot", bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.RemoteAddr = ip + ":1234"
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	auth.WaitForPasswordResetLinks()
+	return w
+}
+
+func resetPassword(router *gin.Engine, token, password string) int {
+	return performRequest(router, "POST", "/auth/password/reset", map[string]string{"token": token, "password": password}).Code
+}
+
+func TestPasswordReset(t *testing.T) {
+	database.InitTestDB()
+	router := newProtectedRouter()
+	login := registerAndLogin(t, router, "reset1@example.com")
+	outbox := useOutbox(t)
+	claims, _ := auth.ValidateJWT(login["access_token"].(string))
+
+	// Unknown addresses get the same answer, and no email
+	forgotPassword(t, router, "nobody@example.com")
+	assert.Empty(t, readOutbox(t, outbox))
+
+	forgotPassword(t, router, "reset1@example.com")
+	emails := readOutbox(t, outbox)
+	if !assert.Len(t, emails, 1) {
+		return
+	}
+	assert.Contains(t, emails[0], "To: reset1@example.com\r\n")
+	token := linkToken(t, emails[0])
+	assert.NotEmpty(t, token)
+
+	assert.Equal(t, http.StatusBadRequest, resetPassword(router, token, "short"))
+	assert.Equal(t, http.StatusBadRequest, resetPassword(router, "not-a-token", "newpassword"))
+	assert.Equal(t, http.StatusOK, resetPassword(router, token, "newpassword"))
+
+	// Every device is signed out
+	assert.Equal(t, http.StatusUnauthorized, refresh(router, login["refresh_token"].(string)))
+	assert.Equal(t, http.StatusUnauthorized, protected(router, login["access_token"].(string)))
+	assert.Equal(t, int64(1), securityEvents(claims.UserID, auth.SecurityEventPasswordReset))
+
+	// Only the new password works
+	w := performRequest(router, "POST", "/auth/login", map[string]string{"email": "reset1@example.com", "password": "testpassword"})
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	w = performRequest(router, "POST", "/auth/login", map[string]string{"email": "reset1@example.com", "password": "newpassword"})
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// Tokens work once
+	assert.Equal(t, http.StatusBadRequest, resetPassword(router, token, "otherpassword"))
+
+	database.ResetTestDB()
+}
+
+func TestPasswordResetKeepsPreviousTokenUntilOneIsUsed(t *testing.T) {
+	database.InitTestDB()
+	router := newProtectedRouter()
+	registerAndLogin(t, router, "reset2@example.com")
+	outbox := useOutbox(t)
+
+	// Asking again doesn't spoil the link that was already sent
+	forgotPassword(t, router, "reset2@example.com")
+	forgotPassword(t, router, "reset2@example.com")
+	emails := readOutbox(t, outbox)
+	if !assert.Len(t, emails, 2) {
+		return
+	}
+	assert.NotEqual(t, linkToken(t, emails[0]), linkToken(t, emails[1]))
+
+	// Using one does
+	assert.Equal(t, http.StatusOK, resetPassword(router, linkToken(t, emails[0]), "newpassword"))
+	assert.Equal(t, http.StatusBadRequest, resetPassword(router, linkToken(t, emails[1]), "otherpassword"))
+
+	database.ResetTestDB()
+}
+
+func TestPasswordResetIsThrottled(t *testing.T) {
+	database.InitTestDB()
+	router := newProtectedRouter()
+	registerAndLogin(t, router, "reset4@example.com")
+	outbox := useOutbox(t)
+	t.Setenv("PASSWORD_RESET_ADDRESS_LIMIT", "2")
+	t.Setenv("PASSWORD_RESET_IP_LIMIT", "4")
+
+	// Per address, whether or not it is registered, and however it is spelled
+	for _, email := range []string{"reset4@example.com", "nobody4@example.com"} {
+		assert.Equal(t, http.StatusOK, forgotPasswordFrom(router, "203.0.113.1", email).Code)
+		assert.Equal(t, http.StatusOK, forgotPasswordFrom(router, "203.0.113.2", email).Code)
+		w := forgotPasswordFrom(router, "203.0.113.3", " "+strings.ToUpper(email))
+		assert.Equal(t, http.StatusTooManyRequests, w.Code)
+		assert.NotEmpty(t, w.Header().Get("Retry-After"))
+	}
+	assert.Len(t, readOutbox(t, outbox), 2)
+
+	// Per IP address
+	assert.Equal(t, http.StatusOK, forgotPasswordFrom(router, "203.0.113.1", "other1@example.com").Code)
+	assert.Equal(t, http.StatusOK, forgotPasswordFrom(router, "203.0.113.1", "other2@example.com").Code)
+	assert.Equal(t, http.StatusTooManyRequests, forgotPasswordFrom(router, "203.0.113.1", "other3@example.com").Code)
+	assert.Equal(t, http.StatusOK, forgotPasswordFrom(router, "203.0.113.4", "other3@example.com").Code)
+
+	database.ResetTestDB()
+}
+
+func TestPasswordResetExpires(t *testing.T) {
+	database.InitTestDB()
+	router := newProtectedRouter()
+	registerAndLogin(t, router, "reset3@example.com")
+	outbox := useOutbox(t)
+
+	t.Setenv("PASSWORD_RESET_TTL", "-1s")
+	forgotPassword(t, router, "reset3@example.com")
+	emails := readOutbox(t, outbox)
+	if !assert.Len(t, emails, 1) {
+		return
+	}
+	assert.Equal(t, http.StatusBadRequest, resetPassword(router, linkToken(t, emails[0]), "newpassword"))
+
+	purged, err := auth.PurgePasswordResetTokens(database.DB)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), purged)
+
+	database.ResetTestDB()
+}
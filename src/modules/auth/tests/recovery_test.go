@@ -0,0 +1,130 @@
+package auth
+
+import (
+	"encoding/json"
+	"let-me-in/database"
+	"let-me-in/modules/auth"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func verifyRecoveryCode(router *gin.Engine, mfaToken, recoveryCode string) int {
+	return performRequest(router, "POST", "/auth/mfa/verify", map[string]string{"mfa_token": mfaToken, "recovery_code": recoveryCode}).Code
+}
+
+func remainingRecoveryCodes(t *testing.T, router *gin.Engine, accessToken string) float64 {
+	w := performUserRequest(router, "GET", "/auth/mfa/recovery-codes", accessToken, "", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var response map[string]float64
+	json.Unmarshal(w.Body.Bytes(), &response)
+	return response["remaining"]
+}
+
+func securityEvents(userID uint, eventType string) int64 {
+	var count int64
+	database.DB.Model(&auth.SecurityEvent{}).Where("user_id = ? AND type = ?", userID, eventType).Count(&count)
+	return count
+}
+
+func TestRecoveryCodeLogin(t *testing.T) {
+	database.InitTestDB()
+	router := newProtectedRouter()
+	login := registerAndLogin(t, router, "recovery1@example.com")
+	accessToken := login["access_token"].(string)
+	claims, _ := auth.ValidateJWT(accessToken)
+	_, codes := enrollTOTP(t, router, accessToken)
+
+	// A code and a recovery code at once is ambiguous
+	mfaToken := mfaChallenge(t, router, "recovery1@example.com")
+	w := performRequest(router, "POST", "/auth/mfa/verify", map[string]string{"mfa_token": mfaToken, "code": "000000", "recovery_code": codes[0]})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	// Recovery codes are forgiving about how they are typed
+	assert.Equal(t, http.StatusOK, verifyRecoveryCode(router, mfaToken, " "+strings.ToUpper(codes[0])))
+	assert.Equal(t, float64(9), remainingRecoveryCodes(t, router, accessToken))
+	assert.Equal(t, int64(1), securityEvents(claims.UserID, auth.SecurityEventRecoveryCodeUsed))
+
+	// But only work once
+	mfaToken = mfaChallenge(t, router, "recovery1@example.com")
+	assert.Equal(t, http.StatusUnauthorized, verifyRecoveryCode(router, mfaToken, codes[0]))
+	assert.Equal(t, http.StatusOK, verifyRecoveryCode(router, mfaToken, codes[1]))
+	assert.Equal(t, int64(2), securityEvents(claims.UserID, auth.SecurityEventRecoveryCodeUsed))
+
+	database.ResetTestDB()
+}
+
+func TestRegenerateRecoveryCodes(t *testing.T) {
+	database.InitTestDB()
+	router := newProtectedRouter()
+	login := registerAndLogin(t, router, "recovery2@example.com")
+	accessToken := login["access_token"].(string)
+	claims, _ := auth.ValidateJWT(accessToken)
+	_, codes := enrollTOTP(t, router, accessToken)
+
+	w := performUserRequest(router, "POST", "/auth/mfa/recovery-codes", accessToken, "", map[string]string{"code": "000000"})
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	// Someone who lost their authenticator can regenerate with a recovery code
+	w = performUserRequest(router, "POST", "/auth/mfa/recovery-codes", accessToken, "", map[string]string{"recovery_code": codes[0]})
+	assert.Equal(t, http.StatusOK, w.Code)
+	var response struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &response)
+	assert.Len(t, response.RecoveryCodes, 10)
+	assert.NotContains(t, response.RecoveryCodes, codes[1])
+	assert.Equal(t, float64(10), remainingRecoveryCodes(t, router, accessToken))
+	assert.Equal(t, int64(1), securityEvents(claims.UserID, auth.SecurityEventRecoveryCodesRegenerated))
+
+	// The old codes are gone
+	mfaToken := mfaChallenge(t, router, "recovery2@example.com")
+	assert.Equal(t, http.StatusUnauthorized, verifyRecoveryCode(router, mfaToken, codes[1]))
+	assert.Equal(t, http.StatusOK, verifyRecoveryCode(router, mfaToken, response.RecoveryCodes[0]))
+
+	// Only hashes are stored
+	var stored []auth.RecoveryCode
+	database.DB.Find(&stored)
+	for _, code := range stored {
+		assert.NotContains(t, response.RecoveryCodes, code.CodeHash)
+	}
+
+	database.ResetTestDB()
+}
+
+func TestMFATokenLogsInOnce(t *testing.T) {
+	database.InitTestDB()
+	router := newProtectedRouter()
+	login := registerAndLogin(t, router, "recovery3@example.com")
+	_, codes := enrollTOTP(t, router, login["access_token"].(string))
+
+	// Every request has a valid recovery code, but only one of them gets the tokens
+	mfaToken := mfaChallenge(t, router, "recovery3@example.com")
+	statuses := make([]int, 5)
+	var wg sync.WaitGroup
+	for i := range statuses {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			statuses[i] = verifyRecoveryCode(router, mfaToken, codes[i])
+		}()
+	}
+	wg.Wait()
+
+	loggedIn := 0
+	for _, status := range statuses {
+		if status == http.StatusOK {
+			loggedIn++
+		} else {
+			assert.Equal(t, http.StatusUnauthorized, status)
+		}
+	}
+	assert.Equal(t, 1, loggedIn)
+
+	database.ResetTestDB()
+}
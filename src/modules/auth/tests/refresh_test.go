@@ -8,6 +8,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/stretchr/testify/assert"
@@ -117,3 +118,96 @@ func TestRefreshTokenCannotBeUsedMoreThanOnce(t *testing.T) {
 
 	database.ResetTestDB()
 }
+
+func TestRefreshTokenReuseRevokesFamily(t *testing.T) {
+	database.InitTestDB()
+	router := newProtectedRouter()
+
+	loginResponse := registerAndLogin(t, router, "refresh1@example.com")
+	stolen := loginResponse["refresh_token"].(string)
+
+	// The thief rotates the token first
+	wRefresh := performRequest(router, "POST", "/auth/refresh", map[string]string{"refresh_token": stolen})
+	assert.Equal(t, http.StatusOK, wRefresh.Code)
+	var refreshResponse map[string]interface{}
+	json.Unmarshal(wRefresh.Body.Bytes(), &refreshResponse)
+	rotated := refreshResponse["refresh_token"].(string)
+
+	// Then the user presents the same token
+	wReuse := performRequest(router, "POST", "/auth/refresh", map[string]string{"refresh_token": stolen})
+	assert.Equal(t, http.StatusUnauthorized, wReuse.Code)
+
+	// The whole family is revoked, including the token the thief got
+	wThief := performRequest(router, "POST", "/auth/refresh", map[string]string{"refresh_token": rotated})
+	assert.Equal(t, http.StatusUnauthorized, wThief.Code)
+
+	var original auth.RefreshToken
+	assert.NoError(t, database.DB.Where("token_hash = ?", auth.HashRefreshToken(stolen)).First(&original).Error)
+	var events []auth.SecurityEvent
+	database.DB.Where("user_id = ?", original.UserID).Find(&events)
+	if assert.Len(t, events, 1) {
+		assert.Equal(t, auth.SecurityEventRefreshTokenReuse, events[0].Type)
+		assert.Contains(t, events[0].Details, original.FamilyID)
+	}
+
+	// Other logins of the user are not affected
+	wLogin := performRequest(router, "POST", "/auth/login", map[string]string{"email": "refresh1@example.com", "password": "testpassword"})
+	var secondLogin map[string]interface{}
+	json.Unmarshal(wLogin.Body.Bytes(), &secondLogin)
+	wOther := performRequest(router, "POST", "/auth/refresh", map[string]string{"refresh_token": secondLogin["refresh_token"].(string)})
+	assert.Equal(t, http.StatusOK, wOther.Code)
+
+	database.ResetTestDB()
+}
+
+func TestRefreshTokensShareExpiry(t *testing.T) {
+	database.InitTestDB()
+	router := newProtectedRouter()
+
+	loginResponse := registerAndLogin(t, router, "refresh2@example.com")
+	first := loginResponse["refresh_token"].(string)
+	wRefresh := performRequest(router, "POST", "/auth/refresh", map[string]string{"refresh_token": first})
+	assert.Equal(t, http.StatusOK, wRefresh.Code)
+	var refreshResponse map[string]interface{}
+	json.Unmarshal(wRefresh.Body.Bytes(), &refreshResponse)
+
+	expected := time.Now().Add(auth.RefreshTokenTTL()).Unix()
+	for _, token := range []string{first, refreshResponse["refresh_token"].(string)} {
+		var stored auth.RefreshToken
+		assert.NoError(t, database.DB.Where("token_hash = ?", auth.HashRefreshToken(token)).First(&stored).Error)
+		assert.InDelta(t, expected, stored.ExpiresAt, 60)
+	}
+
+	database.ResetTestDB()
+}
+
+func TestHashRefreshToken(t *testing.T) {
+	t.Setenv("REFRESH_TOKEN_HASH_KEY", "first-key")
+	hash := auth.HashRefreshToken("token")
+	assert.Len(t, hash, 64)
+	assert.NotContains(t, hash, "token")
+	assert.Equal(t, hash, auth.HashRefreshToken("token"))
+	assert.NotEqual(t, hash, auth.HashRefreshToken("token2"))
+
+	// Without the key, hashes can't be recomputed
+	t.Setenv("REFRESH_TOKEN_HASH_KEY", "second-key")
+	assert.NotEqual(t, hash, auth.HashRefreshToken("token"))
+}
+
+func TestRefreshTokensAreStoredHashed(t *testing.T) {
+	database.InitTestDB()
+	router := newProtectedRouter()
+
+	loginResponse := registerAndLogin(t, router, "refresh3@example.com")
+	token := loginResponse["refresh_token"].(string)
+
+	var stored auth.RefreshToken
+	assert.NoError(t, database.DB.Where("token_hash = ?", auth.HashRefreshToken(token)).First(&stored).Error)
+	assert.NotEqual(t, token, stored.TokenHash)
+
+	var count int64
+	database.DB.Model(&auth.RefreshToken{}).Where("token_hash = ?", token).Count(&count)
+	assert.Zero(t, count)
+
+	database.ResetTestDB()
+}
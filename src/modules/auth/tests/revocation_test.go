@@ -0,0 +1,132 @@
+package auth
+
+import (
+	"fmt"
+	"let-me-in/database"
+	"let-me-in/modules/auth"
+	"net/http"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func newAdminRouter() *gin.Engine {
+	router := newProtectedRouter()
+	admin := router.Group("/admin", auth.RequireAuth(), auth.RequireAdmin())
+	admin.POST("/users/:id/disable", auth.DisableUserHandler)
+	admin.POST("/users/:id/enable", auth.EnableUserHandler)
+	return router
+}
+
+func protected(router *gin.Engine, accessToken string) int {
+	return performUserRequest(router, "GET", "/protected", accessToken, "", nil).Code
+}
+
+func TestAccessTokensHaveUniqueIDs(t *testing.T) {
+	first, err := auth.GenerateJWT(1)
+	assert.NoError(t, err)
+	second, err := auth.GenerateJWT(1)
+	assert.NoError(t, err)
+
+	firstClaims, err := auth.ValidateJWT(first)
+	assert.NoError(t, err)
+	secondClaims, err := auth.ValidateJWT(second)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, firstClaims.ID)
+	assert.NotEqual(t, firstClaims.ID, secondClaims.ID)
+}
+
+func TestLogoutRevokesAccessToken(t *testing.T) {
+	database.InitTestDB()
+	router := newProtectedRouter()
+	registerAndLogin(t, router, "revocation1@example.com")
+	laptop := loginFrom(t, router, "revocation1@example.com", "laptop")
+	phone := loginFrom(t, router, "revocation1@example.com", "phone")
+
+	w := performUserRequest(router, "POST", "/auth/logout", laptop["access_token"], "", map[string]string{"refresh_token": laptop["refresh_token"]})
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	claims, _ := auth.ValidateJWT(phone["access_token"])
+	_, err := auth.ValidateJWT(laptop["access_token"])
+	assert.Error(t, err)
+	assert.Equal(t, http.StatusUnauthorized, protected(router, laptop["access_token"]))
+	assert.Equal(t, http.StatusOK, protected(router, phone["access_token"]))
+
+	var revoked auth.RevokedToken
+	assert.NoError(t, database.DB.Where("user_id = ?", claims.UserID).First(&revoked).Error)
+	assert.True(t, revoked.ExpiresAt.After(claims.IssuedAt.Time))
+
+	database.ResetTestDB()
+}
+
+func TestRevokeAccessTokenReportsReplays(t *testing.T) {
+	database.InitTestDB()
+	token, err := auth.GenerateJWT(1)
+	assert.NoError(t, err)
+	claims, err := auth.ValidateJWT(token)
+	assert.NoError(t, err)
+
+	assert.NoError(t, auth.RevokeAccessToken(database.DB, claims))
+	// Tokens that must be used once are rejected the second time
+	assert.Equal(t, auth.ErrTokenAlreadyRevoked, auth.RevokeAccessToken(database.DB, claims))
+
+	database.ResetTestDB()
+}
+
+func TestLogoutAllRevokesAccessTokens(t *testing.T) {
+	database.InitTestDB()
+	router := newProtectedRouter()
+	first := registerAndLogin(t, router, "revocation2@example.com")
+	second := loginFrom(t, router, "revocation2@example.com", "phone")
+	other := registerAndLogin(t, router, "revocation3@example.com")
+
+	w := performUserRequest(router, "POST", "/auth/logout-all", second["access_token"], "", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	assert.Equal(t, http.StatusUnauthorized, protected(router, first["access_token"].(string)))
+	assert.Equal(t, http.StatusUnauthorized, protected(router, second["access_token"]))
+	assert.Equal(t, http.StatusOK, protected(router, other["access_token"].(string)))
+
+	database.ResetTestDB()
+}
+
+func TestDisablingUserRevokesTokens(t *testing.T) {
+	database.InitTestDB()
+	router := newAdminRouter()
+	var disabled []uint
+	auth.OnUserDisabled = func(userID uint) { disabled = append(disabled, userID) }
+	defer func() { auth.OnUserDisabled = nil }()
+
+	user := registerAndLogin(t, router, "revocation4@example.com")
+	admin := registerAndLogin(t, router, "revocation5@example.com")
+	userClaims, _ := auth.ValidateJWT(user["access_token"].(string))
+	adminClaims, _ := auth.ValidateJWT(admin["access_token"].(string))
+	database.DB.Model(&auth.User{}).Where("id = ?", adminClaims.UserID).Update("is_admin", true)
+
+	path := fmt.Sprintf("/admin/users/%d", userClaims.UserID)
+	w := performUserRequest(router, "POST", path+"/disable", user["access_token"].(string), "", nil)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	w = performUserRequest(router, "POST", fmt.Sprintf("/admin/users/%d/disable", adminClaims.UserID), admin["access_token"].(string), "", nil)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = performUserRequest(router, "POST", "/admin/users/999999/disable", admin["access_token"].(string), "", nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	w = performUserRequest(router, "POST", path+"/disable", admin["access_token"].(string), "", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, []uint{userClaims.UserID}, disabled)
+
+	// Everything the user holds stops working right away
+	assert.Equal(t, http.StatusUnauthorized, protected(router, user["access_token"].(string)))
+	assert.Equal(t, http.StatusUnauthorized, refresh(router, user["refresh_token"].(string)))
+	w = performRequest(router, "POST", "/auth/login", map[string]string{"email": "revocation4@example.com", "password": "testpassword"})
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	w = performUserRequest(router, "POST", path+"/enable", admin["access_token"].(string), "", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = performRequest(router, "POST", "/auth/login", map[string]string{"email": "revocation4@example.com", "password": "testpassword"})
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	database.ResetTestDB()
+}
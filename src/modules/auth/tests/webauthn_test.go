@@ -0,0 +1,368 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"let-me-in/database"
+	"let-me-in/modules/auth"
+	"math/big"
+	"net/http"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+var b64 = base64.RawURLEncoding
+
+// encodeCBOR encodes the few CBOR types an authenticator sends.
+func encodeCBOR(v interface{}) []byte {
+	head := func(major byte, n int) []byte {
+		switch {
+		case n < 24:
+			return []byte{major<<5 | byte(n)}
+		case n < 256:
+			return []byte{major<<5 | 24, byte(n)}
+		default:
+			return []byte{major<<5 | 25, byte(n >> 8), byte(n)}
+		}
+	}
+
+	switch v := v.(type) {
+	case int:
+		if v < 0 {
+			return head(1, -1-v)
+		}
+		return head(0, v)
+	case []byte:
+		return append(head(2, len(v)), v...)
+	case string:
+		return append(head(3, len(v)), v...)
+	case map[interface{}]interface{}:
+		out := head(5, len(v))
+		for key, value := range v {
+			out = append(out, encodeCBOR(key)...)
+			out = append(out, encodeCBOR(value)...)
+		}
+		return out
+	}
+	panic(fmt.Sprintf("can't encode %T", v))
+}
+
+// softAuthenticator is a WebAuthn authenticator holding a single ES256 passkey.
+type softAuthenticator struct {
+	key          *ecdsa.PrivateKey
+	id           []byte
+	signCount    uint32
+	origin       string
+	userVerified bool
+}
+
+func newSoftAuthenticator(t testing.TB) *softAuthenticator {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	id := make([]byte, 16)
+	rand.Read(id)
+	return &softAuthenticator{key: key, id: id, origin: "http://localhost:8080", userVerified: true}
+}
+
+func (a *softAuthenticator) authenticatorData(attested bool) []byte {
+	rpIDHash := sha256.Sum256([]byte("localhost"))
+	data := append([]byte(nil), rpIDHash[:]...)
+
+	flags := byte(0x01)
+	if a.userVerified {
+		flags |= 0x04
+	}
+	if attested {
+		flags |= 0x40
+	}
+	data = append(data, flags)
+	data = binary.BigEndian.AppendUint32(data, a.signCount)
+
+	if attested {
+		ecdhKey, _ := a.key.PublicKey.ECDH()
+		point := ecdhKey.Bytes()
+		coseKey := encodeCBOR(map[interface{}]interface{}{1: 2, 3: -7, -1: 1, -2: point[1:33], -3: point[33:]})
+
+		data = append(data, make([]byte, 16)...) // AAGUID
+		data = binary.BigEndian.AppendUint16(data, uint16(len(a.id)))
+		data = append(data, a.id...)
+		data = append(data, coseKey...)
+	}
+	return data
+}
+
+func (a *softAuthenticator) clientData(ceremony, challenge string) []byte {
+	clientData, _ := json.Marshal(map[string]string{"type": ceremony, "challenge": challenge, "origin": a.origin})
+	return clientData
+}
+
+// create answers the options of a registration.
+func (a *softAuthenticator) create(challenge string) map[string]interface{} {
+	attestation := encodeCBOR(map[interface{}]interface{}{
+		"fmt":      "none",
+		"attStmt":  map[interface{}]interface{}{},
+		"authData": a.authenticatorData(true),
+	})
+	return map[string]interface{}{
+		"id":    b64.EncodeToString(a.id),
+		"rawId": b64.EncodeToString(a.id),
+		"type":  "public-key",
+		"response": map[string]interface{}{
+			"clientDataJSON":    b64.EncodeToString(a.clientData("webauthn.create", challenge)),
+			"attestationObject": b64.EncodeToString(attestation),
+			"transports":        []string{"internal"},
+		},
+	}
+}
+
+// get answers the options of a login.
+func (a *softAuthenticator) get(t *testing.T, challenge string) map[string]interface{} {
+	a.signCount++
+	authData := a.authenticatorData(false)
+	clientData := a.clientData("webauthn.get", challenge)
+	clientDataHash := sha256.Sum256(clientData)
+	digest := sha256.Sum256(append(authData, clientDataHash[:]...))
+	signature, err := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+	assert.NoError(t, err)
+
+	return map[string]interface{}{
+		"id":    b64.EncodeToString(a.id),
+		"rawId": b64.EncodeToString(a.id),
+		"type":  "public-key",
+		"response": map[string]interface{}{
+			"clientDataJSON":    b64.EncodeToString(clientData),
+			"authenticatorData": b64.EncodeToString(authData),
+			"signature":         b64.EncodeToString(signature),
+		},
+	}
+}
+
+type webAuthnOptions struct {
+	Session   string `json:"session"`
+	PublicKey struct {
+		Challenge        string                   `json:"challenge"`
+		AllowCredentials []map[string]interface{} `json:"allowCredentials"`
+	} `json:"publicKey"`
+}
+
+func beginWebAuthn(t *testing.T, router *gin.Engine, path, accessToken string, body interface{}) webAuthnOptions {
+	w := performUserRequest(router, "POST", path, accessToken, "", body)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var options webAuthnOptions
+	json.Unmarshal(w.Body.Bytes(), &options)
+	return options
+}
+
+func registerPasskey(t *testing.T, router *gin.Engine, accessToken string, authenticator *softAuthenticator) {
+	options := beginWebAuthn(t, router, "/auth/webauthn/register/begin", accessToken, nil)
+	w := performUserRequest(router, "POST", "/auth/webauthn/register/finish", accessToken, "", map[string]interface{}{
+		"session":    options.Session,
+		"name":       "laptop",
+		"credential": authenticator.create(options.PublicKey.Challenge),
+	})
+	assert.Equal(t, http.StatusCreated, w.Code)
+}
+
+func finishWebAuthnLogin(router *gin.Engine, session, mfaToken string, credential map[string]interface{}) (int, map[string]string) {
+	w := performRequest(router, "POST", "/auth/webauthn/login/finish", map[string]interface{}{
+		"session":    session,
+		"mfa_token":  mfaToken,
+		"credential": credential,
+	})
+	var response map[string]string
+	json.Unmarshal(w.Body.Bytes(), &response)
+	return w.Code, response
+}
+
+func TestPasskeyLogin(t *testing.T) {
+	database.InitTestDB()
+	router := newProtectedRouter()
+	login := registerAndLogin(t, router, "webauthn1@example.com")
+	accessToken := login["access_token"].(string)
+	authenticator := newSoftAuthenticator(t)
+	registerPasskey(t, router, accessToken, authenticator)
+
+	w := performUserRequest(router, "GET", "/auth/webauthn/credentials", accessToken, "", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"Name":"laptop"`)
+	assert.Contains(t, w.Body.String(), `"Transports":"internal"`)
+
+	// The same passkey can't be registered twice
+	options := beginWebAuthn(t, router, "/auth/webauthn/register/begin", accessToken, nil)
+	w = performUserRequest(router, "POST", "/auth/webauthn/register/finish", accessToken, "", map[string]interface{}{
+		"session":    options.Session,
+		"credential": authenticator.create(options.PublicKey.Challenge),
+	})
+	assert.Equal(t, http.StatusConflict, w.Code)
+
+	// Passwordless
+	options = beginWebAuthn(t, router, "/auth/webauthn/login/begin", "", nil)
+	assert.Empty(t, options.PublicKey.AllowCredentials)
+	assertion := authenticator.get(t, options.PublicKey.Challenge)
+	code, tokens := finishWebAuthnLogin(router, options.Session, "", assertion)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, http.StatusOK, protected(router, tokens["access_token"]))
+
+	// Sessions and assertions only work once
+	code, _ = finishWebAuthnLogin(router, options.Session, "", assertion)
+	assert.Equal(t, http.StatusUnauthorized, code)
+
+	// The password alone is no longer enough
+	w = performRequest(router, "POST", "/auth/login", map[string]string{"email": "webauthn1@example.com", "password": "testpassword"})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"mfa_methods":["webauthn"]`)
+
+	database.ResetTestDB()
+}
+
+func TestPasskeyLoginChecksAssertion(t *testing.T) {
+	database.InitTestDB()
+	router := newProtectedRouter()
+	login := registerAndLogin(t, router, "webauthn2@example.com")
+	claims, _ := auth.ValidateJWT(login["access_token"].(string))
+	authenticator := newSoftAuthenticator(t)
+	registerPasskey(t, router, login["access_token"].(string), authenticator)
+
+	for name, tamper := range map[string]func(){
+		"phishing origin":      func() { authenticator.origin = "https://let-me-in.example.net" },
+		"no user verification": func() { authenticator.userVerified = false },
+		"other key":            func() { authenticator.key = newSoftAuthenticator(t).key },
+	} {
+		restore := *authenticator
+		tamper()
+		options := beginWebAuthn(t, router, "/auth/webauthn/login/begin", "", nil)
+		code, _ := finishWebAuthnLogin(router, options.Session, "", authenticator.get(t, options.PublicKey.Challenge))
+		assert.Equal(t, http.StatusUnauthorized, code, name)
+		*authenticator = restore
+	}
+
+	// A counter going backwards gives a cloned key away
+	options := beginWebAuthn(t, router, "/auth/webauthn/login/begin", "", nil)
+	code, _ := finishWebAuthnLogin(router, options.Session, "", authenticator.get(t, options.PublicKey.Challenge))
+	assert.Equal(t, http.StatusOK, code)
+	authenticator.signCount = 0
+	options = beginWebAuthn(t, router, "/auth/webauthn/login/begin", "", nil)
+	code, _ = finishWebAuthnLogin(router, options.Session, "", authenticator.get(t, options.PublicKey.Challenge))
+	assert.Equal(t, http.StatusUnauthorized, code)
+	assert.Equal(t, int64(1), securityEvents(claims.UserID, auth.SecurityEventWebAuthnSignCount))
+
+	database.ResetTestDB()
+}
+
+func TestPasskeyAsSecondFactor(t *testing.T) {
+	database.InitTestDB()
+	router := newProtectedRouter()
+	login := registerAndLogin(t, router, "webauthn3@example.com")
+	authenticator := newSoftAuthenticator(t)
+	registerPasskey(t, router, login["access_token"].(string), authenticator)
+	other := registerAndLogin(t, router, "webauthn4@example.com")
+	otherAuthenticator := newSoftAuthenticator(t)
+	registerPasskey(t, router, other["access_token"].(string), otherAuthenticator)
+
+	// A security key without user verification does as a second factor
+	authenticator.userVerified = false
+	mfaToken := mfaChallenge(t, router, "webauthn3@example.com")
+	options := beginWebAuthn(t, router, "/auth/webauthn/login/begin", "", map[string]string{"mfa_token": mfaToken})
+	if assert.Len(t, options.PublicKey.AllowCredentials, 1) {
+		assert.Equal(t, b64.EncodeToString(authenticator.id), options.PublicKey.AllowCredentials[0]["id"])
+	}
+
+	// Only with the MFA token, and only with the user's own passkey
+	code, _ := finishWebAuthnLogin(router, options.Session, "", authenticator.get(t, options.PublicKey.Challenge))
+	assert.Equal(t, http.StatusUnauthorized, code)
+	code, _ = finishWebAuthnLogin(router, options.Session, mfaToken, otherAuthenticator.get(t, options.PublicKey.Challenge))
+	assert.Equal(t, http.StatusUnauthorized, code)
+
+	code, tokens := finishWebAuthnLogin(router, options.Session, mfaToken, authenticator.get(t, options.PublicKey.Challenge))
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, http.StatusOK, protected(router, tokens["access_token"]))
+
+	// The MFA token is used up
+	w := performRequest(router, "POST", "/auth/webauthn/login/begin", map[string]string{"mfa_token": mfaToken})
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	database.ResetTestDB()
+}
+
+// attestationObject wraps authenticator data in an attestation object without statement.
+func attestationObject(authData []byte) []byte {
+	return encodeCBOR(map[interface{}]interface{}{"fmt": "none", "attStmt": map[interface{}]interface{}{}, "authData": authData})
+}
+
+// attestedData returns authenticator data attesting a credential with the given COSE key.
+func attestedData(credentialID, coseKey []byte) []byte {
+	rpIDHash := sha256.Sum256([]byte("localhost"))
+	data := append(rpIDHash[:], 0x41, 0, 0, 0, 1)
+	data = append(data, make([]byte, 16)...) // AAGUID
+	data = binary.BigEndian.AppendUint16(data, uint16(len(credentialID)))
+	data = append(data, credentialID...)
+	return append(data, coseKey...)
+}
+
+// checkAttestation parses an attestation object, which must not panic, and checks that
+// what it accepts is consistent.
+func checkAttestation(t *testing.T, data []byte) {
+	attestation, err := auth.ParseAttestationObject(data)
+	if err != nil {
+		assert.Nil(t, attestation)
+		return
+	}
+	assert.NotNil(t, attestation.CredentialID)
+	// The public key that was split off parses the same on its own
+	again, err := auth.ParseAttestationObject(attestationObject(attestedData(attestation.CredentialID, attestation.PublicKey)))
+	if assert.NoError(t, err) {
+		assert.Equal(t, attestation.PublicKey, again.PublicKey)
+	}
+}
+
+func FuzzParseAttestationObject(f *testing.F) {
+	authenticator := newSoftAuthenticator(f)
+	valid := attestationObject(authenticator.authenticatorData(true))
+	f.Add(valid)
+	f.Add(valid[:len(valid)/2])
+	f.Add(attestationObject(authenticator.authenticatorData(false)))
+	f.Add(attestationObject([]byte("short")))
+	f.Add([]byte{})
+	f.Add([]byte{0xa1, 0x68, 'a', 'u', 't', 'h', 'D', 'a', 't', 'a', 0x5b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff})         // huge length
+	f.Add([]byte{0x9f, 0x01, 0xff})                                                                                                 // indefinite length
+	f.Add([]byte{0xc6, 0xc6, 0xc6, 0xc6, 0xc6, 0xc6, 0xc6, 0xc6, 0xc6, 0xc6, 0xc6, 0xc6, 0xc6, 0xc6, 0xc6, 0xc6, 0xc6, 0xc6, 0x00}) // nested tags
+	f.Add(append(bytes.Repeat([]byte{0x81}, 64), 0x00))                                                                             // nested arrays
+	f.Add([]byte{0xa1, 0x41, 0x00, 0x00})                                                                                           // byte string key
+	f.Add([]byte{0xfb, 0, 0, 0, 0, 0, 0, 0, 0})                                                                                     // float
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		checkAttestation(t, data)
+	})
+}
+
+func FuzzCredentialPublicKey(f *testing.F) {
+	ecKey := newSoftAuthenticator(f).key
+	ecdhKey, _ := ecKey.PublicKey.ECDH()
+	point := ecdhKey.Bytes()
+	f.Add(encodeCBOR(map[interface{}]interface{}{1: 2, 3: -7, -1: 1, -2: point[1:33], -3: point[33:]}))
+	f.Add(encodeCBOR(map[interface{}]interface{}{1: 2, 3: -7, -1: 1, -2: point[1:33], -3: make([]byte, 32)})) // not on the curve
+	edKey, _, _ := ed25519.GenerateKey(rand.Reader)
+	f.Add(encodeCBOR(map[interface{}]interface{}{1: 1, 3: -8, -1: 6, -2: []byte(edKey)}))
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	f.Add(encodeCBOR(map[interface{}]interface{}{1: 3, 3: -257, -1: rsaKey.N.Bytes(), -2: big.NewInt(int64(rsaKey.E)).Bytes()}))
+	f.Add(encodeCBOR(map[interface{}]interface{}{1: 3, 3: -257, -1: rsaKey.N.Bytes(), -2: bytes.Repeat([]byte{0xff}, 16)}))  // huge exponent
+	f.Add(encodeCBOR(map[interface{}]interface{}{1: 3, 3: -257, -1: bytes.Repeat([]byte{0xff}, 4096), -2: []byte{1, 0, 1}})) // huge modulus
+	f.Add(encodeCBOR(map[interface{}]interface{}{1: 2, 3: -7}))
+	f.Add(encodeCBOR("not a key"))
+
+	f.Fuzz(func(t *testing.T, coseKey []byte) {
+		checkAttestation(t, attestationObject(attestedData([]byte("credential"), coseKey)))
+	})
+}
@@ -1,36 +1,67 @@
 package auth
 
 import (
+	"crypto/hmac"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"github.com/golang-jwt/jwt/v5"
 	"golang.org/x/crypto/bcrypt"
-	"os"
+	"gorm.io/gorm"
+	"let-me-in/config"
 	"time"
 )
 
-// Secret key (use environment variables in production)
-var jwtSecret = []byte("super-secret-key")
+// AccessTokenTTL is how long access tokens are valid.
+const AccessTokenTTL = 2 * time.Hour
+
+// defaultRefreshTokenTTL is how long refresh tokens are valid unless REFRESH_TOKEN_TTL says otherwise.
+const defaultRefreshTokenTTL = 24 * time.Hour
+
+// RefreshTokenTTL is how long refresh tokens are valid, whether issued at login or by a rotation.
+func RefreshTokenTTL() time.Duration {
+	return config.GetDuration("REFRESH_TOKEN_TTL", defaultRefreshTokenTTL)
+}
+
+// Purposes of tokens that aren't access tokens
+const (
+	PurposeMFA              = "mfa"               // the password was right, the second factor is still missing
+	PurposeWebAuthnRegister = "webauthn_register" // a passkey registration is under way
+	PurposeWebAuthnLogin    = "webauthn_login"    // a passkey login is under way
+)
 
 // Claims structure
 type Claims struct {
-	UserID uint `json:"user_id"`
+	UserID    uint   `json:"user_id"`
+	Purpose   string `json:"purpose,omitempty"`   // empty for access tokens
+	Challenge string `json:"challenge,omitempty"` // of WebAuthn ceremonies
 	jwt.RegisteredClaims
 }
 
 // GenerateJWT generates a new JWT token for a user
 func GenerateJWT(userID uint) (string, error) {
-	claims := Claims{
-		UserID: userID,
-		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour * 2)), // Token expires in 2 hours
-			IssuedAt:  jwt.NewNumericDate(time.Now()),
-		},
+	return generateToken(Claims{UserID: userID}, AccessTokenTTL)
+}
+
+// generateToken signs claims as a token that is valid for ttl.
+func generateToken(claims Claims, ttl time.Duration) (string, error) {
+	jti, err := generateTokenID()
+	if err != nil {
+		return "", err
+	}
+
+	claims.RegisteredClaims = jwt.RegisteredClaims{
+		ID:        jti,
+		ExpiresAt: jwt.NewNumericDate(time.Now().Add(ttl)),
+		IssuedAt:  jwt.NewNumericDate(time.Now()),
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString(jwtSecret)
+	key := signingKeys.Load().Active()
+	token := jwt.NewWithClaims(key.method(), claims)
+	token.Header["kid"] = key.ID
+	return token.SignedString(key.private)
 }
 
 func GenerateRefreshToken() (string, error) {
@@ -45,11 +76,112 @@ func GenerateRefreshToken() (string, error) {
 	return base64.URLEncoding.EncodeToString(tokenBytes), nil
 }
 
-// ValidateJWT validates and parses a JWT token
+// device describes where a refresh token is used from.
+type device struct {
+	UserAgent  string
+	IPAddress  string
+	SignedInAt time.Time
+	LastUsedAt time.Time
+}
+
+// issueRefreshToken creates a refresh token for a user in the given family. An empty
+// familyID starts a new family.
+func issueRefreshToken(db *gorm.DB, userID uint, familyID string, d device) (string, error) {
+	token, err := GenerateRefreshToken()
+	if err != nil {
+		return "", err
+	}
+
+	if familyID == "" {
+		if familyID, err = generateFamilyID(); err != nil {
+			return "", err
+		}
+	}
+
+	refreshToken := RefreshToken{
+		TokenHash:  HashRefreshToken(token),
+		UserID:     userID,
+		FamilyID:   familyID,
+		ExpiresAt:  time.Now().Add(RefreshTokenTTL()).Unix(),
+		Active:     true,
+		UserAgent:  d.UserAgent,
+		IPAddress:  d.IPAddress,
+		SignedInAt: d.SignedInAt,
+		LastUsedAt: &d.LastUsedAt,
+	}
+	if err := db.Create(&refreshToken).Error; err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+func generateFamilyID() (string, error) {
+	familyBytes := make([]byte, 16)
+	if _, err := rand.Read(familyBytes); err != nil {
+		return "", errors.New("failed to generate token family")
+	}
+	return hex.EncodeToString(familyBytes), nil
+}
+
+// revokeTokenFamily deactivates every refresh token of the family token belongs to.
+func revokeTokenFamily(db *gorm.DB, token *RefreshToken) error {
+	query := db.Model(&RefreshToken{})
+	// Tokens issued before families existed are a family of their own
+	if token.FamilyID == "" {
+		query = query.Where("id = ?", token.ID)
+	} else {
+		query = query.Where("family_id = ?", token.FamilyID)
+	}
+	return query.Update("active", false).Error
+}
+
+// HashRefreshToken returns the keyed hash refresh tokens are stored and looked up by, so
+// reading the database doesn't reveal usable tokens. The key is REFRESH_TOKEN_HASH_KEY,
+// or the password pepper.
+func HashRefreshToken(token string) string {
+	mac := hmac.New(sha256.New, []byte(config.GetEnv("REFRESH_TOKEN_HASH_KEY", pepper())))
+	mac.Write([]byte(token))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// MigratePlaintextRefreshTokens deletes the refresh tokens stored in plaintext before they
+// were hashed, along with their column. Their holders have to log in again.
+func MigratePlaintextRefreshTokens(db *gorm.DB) error {
+	if !db.Migrator().HasColumn(&RefreshToken{}, "token") {
+		return nil
+	}
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec("DELETE FROM refresh_tokens").Error; err != nil {
+			return err
+		}
+		return tx.Migrator().DropColumn(&RefreshToken{}, "token")
+	})
+}
+
+// PurgeRefreshTokens permanently deletes refresh tokens that expired. Rotated tokens are
+// kept until then, so reusing them is still recognized.
+func PurgeRefreshTokens(db *gorm.DB) (int64, error) {
+	result := db.Unscoped().Where("expires_at < ?", time.Now().Unix()).Delete(&RefreshToken{})
+	return result.RowsAffected, result.Error
+}
+
+// ValidateJWT validates and parses a JWT access token, rejecting revoked ones
 func ValidateJWT(tokenString string) (*Claims, error) {
+	return validateToken(tokenString, "")
+}
+
+// validateToken validates and parses a token issued for purpose.
+func validateToken(tokenString, purpose string) (*Claims, error) {
+	keys := signingKeys.Load()
 	token, err := jwt.ParseWithClaims(tokenString, &Claims{}, func(token *jwt.Token) (interface{}, error) {
-		return jwtSecret, nil
-	})
+		kid, _ := token.Header["kid"].(string)
+		key, ok := keys.Key(kid)
+		// The key decides the algorithm, never the token
+		if !ok || token.Method.Alg() != key.Algorithm {
+			return nil, errors.New("unknown signing key")
+		}
+		return key.public, nil
+	}, jwt.WithValidMethods([]string{AlgHS256, AlgRS256, AlgEdDSA}))
 
 	if err != nil || !token.Valid {
 		return nil, errors.New("invalid token")
@@ -60,6 +192,15 @@ func ValidateJWT(tokenString string) (*Claims, error) {
 		return nil, errors.New("invalid claims")
 	}
 
+	// A token can't stand in for one with another purpose
+	if claims.Purpose != purpose {
+		return nil, errors.New("invalid token")
+	}
+
+	if revocations.revoked(claims) {
+		return nil, errors.New("token revoked")
+	}
+
 	return claims, nil
 }
 
@@ -73,15 +214,15 @@ func generateSalt() (string, error) {
 	return base64.StdEncoding.EncodeToString(saltBytes), nil
 }
 
+// pepper is the secret mixed into every password hash
+func pepper() string {
+	return config.GetEnv("PEPPER", "PPR")
+}
+
 // HashPassword hashes the password using salt and pepper
 func hashPassword(password, salt string) (string, error) {
-	pepper := os.Getenv("PEPPER")
-	if pepper == "" {
-		pepper = "PPR"
-	}
-
 	// Combine password, salt, and pepper
-	combined := password + salt + pepper
+	combined := password + salt + pepper()
 
 	// Hash the combined password
 	hashed, err := bcrypt.GenerateFromPassword([]byte(combined), bcrypt.DefaultCost)
@@ -93,13 +234,8 @@ func hashPassword(password, salt string) (string, error) {
 
 // VerifyPassword compares a plain text password with the hashed one
 func verifyPassword(plainPassword, salt, hashedPassword string) bool {
-	pepper := os.Getenv("PEPPER")
-	if pepper == "" {
-		pepper = "PPR"
-	}
-
 	// Combine password, salt, and pepper
-	combined := plainPassword + salt + pepper
+	combined := plainPassword + salt + pepper()
 
 	err := bcrypt.CompareHashAndPassword([]byte(hashedPassword), []byte(combined))
 	return err == nil
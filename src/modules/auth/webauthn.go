@@ -0,0 +1,548 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"let-me-in/config"
+	"let-me-in/database"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// webAuthnTimeout is how long a WebAuthn ceremony may take.
+const webAuthnTimeout = 5 * time.Minute
+
+// Flags of authenticator data
+const (
+	flagUserPresent            = 0x01
+	flagUserVerified           = 0x04
+	flagAttestedCredentialData = 0x40
+)
+
+// base64URL is binary data, encoded in JSON the way WebAuthn clients expect it.
+type base64URL []byte
+
+func (b base64URL) MarshalJSON() ([]byte, error) {
+	return json.Marshal(base64.RawURLEncoding.EncodeToString(b))
+}
+
+func (b *base64URL) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	decoded, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+	if err != nil {
+		return err
+	}
+	*b = decoded
+	return nil
+}
+
+// webAuthnRPID is the relying party ID credentials are bound to: the domain the
+// frontend is served from.
+func webAuthnRPID() string {
+	return config.GetEnv("WEBAUTHN_RP_ID", "localhost")
+}
+
+// webAuthnOrigins are the origins WebAuthn ceremonies may run in.
+func webAuthnOrigins() []string {
+	return strings.Split(config.GetEnv("WEBAUTHN_ORIGINS", "http://localhost:8080"), ",")
+}
+
+// userHandle is the WebAuthn user ID of a user.
+func userHandle(userID uint) []byte {
+	return binary.BigEndian.AppendUint64(nil, uint64(userID))
+}
+
+// authenticatorData is what the authenticator signs, see parseAuthenticatorData.
+type authenticatorData struct {
+	raw       []byte
+	rpIDHash  []byte
+	flags     byte
+	signCount uint32
+
+	// Only set at registration
+	credentialID []byte
+	publicKey    []byte // COSE_Key
+}
+
+// parseAuthenticatorData decodes authenticator data and checks it was made for this
+// relying party with the user present.
+func parseAuthenticatorData(data []byte) (*authenticatorData, error) {
+	if len(data) < 37 {
+		return nil, errors.New("authenticator data too short")
+	}
+	authData := &authenticatorData{
+		raw:       data,
+		rpIDHash:  data[:32],
+		flags:     data[32],
+		signCount: binary.BigEndian.Uint32(data[33:37]),
+	}
+
+	rpIDHash := sha256.Sum256([]byte(webAuthnRPID()))
+	if subtle.ConstantTimeCompare(authData.rpIDHash, rpIDHash[:]) != 1 {
+		return nil, errors.New("credential belongs to another relying party")
+	}
+	if authData.flags&flagUserPresent == 0 {
+		return nil, errors.New("user not present")
+	}
+
+	if authData.flags&flagAttestedCredentialData != 0 {
+		// AAGUID, then the length of the credential ID
+		rest := data[37:]
+		if len(rest) < 18 {
+			return nil, errors.New("attested credential data too short")
+		}
+		idLength := int(binary.BigEndian.Uint16(rest[16:18]))
+		rest = rest[18:]
+		if len(rest) < idLength {
+			return nil, errors.New("attested credential data too short")
+		}
+		authData.credentialID = rest[:idLength]
+
+		_, n, err := parseCOSEKey(rest[idLength:])
+		if err != nil {
+			return nil, err
+		}
+		authData.publicKey = rest[idLength : idLength+n]
+	}
+	return authData, nil
+}
+
+// Attestation is what registering a passkey tells about it, see ParseAttestationObject.
+type Attestation struct {
+	CredentialID []byte
+	PublicKey    []byte // COSE_Key
+	SignCount    uint32
+}
+
+var errInvalidAttestationObject = errors.New("invalid attestation object")
+
+// ParseAttestationObject decodes the attestation object of a new passkey, checking its
+// authenticator data the way parseAuthenticatorData does and that it carries the
+// credential. The attestation statement itself is not checked.
+func ParseAttestationObject(data []byte) (*Attestation, error) {
+	item, _, err := decodeCBOR(data)
+	attestation, _ := item.(map[interface{}]interface{})
+	rawAuthData, _ := attestation["authData"].([]byte)
+	if err != nil || rawAuthData == nil {
+		return nil, errInvalidAttestationObject
+	}
+	authData, err := parseAuthenticatorData(rawAuthData)
+	if err != nil {
+		return nil, err
+	}
+	if authData.credentialID == nil {
+		return nil, errors.New("no attested credential data")
+	}
+	return &Attestation{CredentialID: authData.credentialID, PublicKey: authData.publicKey, SignCount: authData.signCount}, nil
+}
+
+// verifyClientData checks the client data of a ceremony of type ("webauthn.create" or
+// "webauthn.get") answers challenge and comes from an allowed origin.
+func verifyClientData(raw []byte, ceremony, challenge string) error {
+	var clientData struct {
+		Type      string `json:"type"`
+		Challenge string `json:"challenge"`
+		Origin    string `json:"origin"`
+	}
+	if err := json.Unmarshal(raw, &clientData); err != nil {
+		return errors.New("invalid client data")
+	}
+
+	if clientData.Type != ceremony {
+		return errors.New("wrong ceremony")
+	}
+	if challenge == "" || subtle.ConstantTimeCompare([]byte(strings.TrimRight(clientData.Challenge, "=")), []byte(challenge)) != 1 {
+		return errors.New("wrong challenge")
+	}
+	for _, origin := range webAuthnOrigins() {
+		if clientData.Origin == strings.TrimSpace(origin) {
+			return nil
+		}
+	}
+	return errors.New("origin not allowed")
+}
+
+// newWebAuthnSession starts a ceremony: it returns a fresh challenge and a token that
+// carries it to the request finishing the ceremony.
+func newWebAuthnSession(userID uint, purpose string) ([]byte, string, error) {
+	challenge := make([]byte, 32)
+	if _, err := rand.Read(challenge); err != nil {
+		return nil, "", errors.New("failed to generate challenge")
+	}
+
+	session, err := generateToken(Claims{
+		UserID:    userID,
+		Purpose:   purpose,
+		Challenge: base64.RawURLEncoding.EncodeToString(challenge),
+	}, webAuthnTimeout)
+	return challenge, session, err
+}
+
+// credentialDescriptors lists the credentials of a user the way WebAuthn options refer
+// to them.
+func credentialDescriptors(db *gorm.DB, userID uint) ([]gin.H, error) {
+	var credentials []WebAuthnCredential
+	if err := db.Where("user_id = ?", userID).Find(&credentials).Error; err != nil {
+		return nil, err
+	}
+
+	descriptors := make([]gin.H, 0, len(credentials))
+	for _, credential := range credentials {
+		id, _ := base64.RawURLEncoding.DecodeString(credential.CredentialID)
+		descriptor := gin.H{"type": "public-key", "id": base64URL(id)}
+		if credential.Transports != "" {
+			descriptor["transports"] = strings.Split(credential.Transports, ",")
+		}
+		descriptors = append(descriptors, descriptor)
+	}
+	return descriptors, nil
+}
+
+// BeginWebAuthnRegistrationHandler starts registering a passkey for the current user. It
+// responds with the options for navigator.credentials.create() and a session to send to
+// FinishWebAuthnRegistrationHandler with the result.
+func BeginWebAuthnRegistrationHandler(c *gin.Context) {
+	user := CurrentUser(c)
+	credentials, ok := currentCredentials(c)
+	if !ok {
+		return
+	}
+
+	exclude, err := credentialDescriptors(database.DB, user.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch passkeys"})
+		return
+	}
+
+	challenge, session, err := newWebAuthnSession(user.ID, PurposeWebAuthnRegister)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start registration"})
+		return
+	}
+
+	params := make([]gin.H, 0, len(coseAlgorithms))
+	for _, alg := range coseAlgorithms {
+		params = append(params, gin.H{"type": "public-key", "alg": alg})
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"session": session,
+		"publicKey": gin.H{
+			"challenge":          base64URL(challenge),
+			"rp":                 gin.H{"id": webAuthnRPID(), "name": config.GetEnv("WEBAUTHN_RP_NAME", "Let Me In")},
+			"user":               gin.H{"id": base64URL(userHandle(user.ID)), "name": credentials.Email, "displayName": user.DisplayName},
+			"pubKeyCredParams":   params,
+			"timeout":            webAuthnTimeout.Milliseconds(),
+			"excludeCredentials": exclude,
+			"authenticatorSelection": gin.H{
+				"residentKey":      "preferred",
+				"userVerification": "preferred",
+			},
+			"attestation": "none",
+		},
+	})
+}
+
+// FinishWebAuthnRegistrationHandler verifies the credential created for a registration
+// and stores it. Attestation statements aren't verified: any authenticator will do.
+func FinishWebAuthnRegistrationHandler(c *gin.Context) {
+	var input struct {
+		Session    string `json:"session" binding:"required"`
+		Name       string `json:"name"`
+		Credential struct {
+			RawID    base64URL `json:"rawId"`
+			Response struct {
+				ClientDataJSON    base64URL `json:"clientDataJSON"`
+				AttestationObject base64URL `json:"attestationObject"`
+				Transports        []string  `json:"transports"`
+			} `json:"response"`
+		} `json:"credential"`
+	}
+
+	db := database.DB
+
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
+		return
+	}
+
+	user := CurrentUser(c)
+	session, err := validateToken(input.Session, PurposeWebAuthnRegister)
+	if err != nil || session.UserID != user.ID {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired session, start over"})
+		return
+	}
+
+	response := input.Credential.Response
+	if err := verifyClientData(response.ClientDataJSON, "webauthn.create", session.Challenge); err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid credential: " + err.Error()})
+		return
+	}
+
+	attestation, err := ParseAttestationObject(response.AttestationObject)
+	if err == errInvalidAttestationObject {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid attestation object"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid credential: " + err.Error()})
+		return
+	}
+	if !bytes.Equal(attestation.CredentialID, input.Credential.RawID) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid credential: credential ID mismatch"})
+		return
+	}
+
+	// The session only registers once
+	if err := RevokeAccessToken(db, session); err == ErrTokenAlreadyRevoked {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired session, start over"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke session"})
+		return
+	}
+
+	name := input.Name
+	if name == "" {
+		name = "Passkey"
+	}
+	credential := WebAuthnCredential{
+		UserID:       user.ID,
+		CredentialID: base64.RawURLEncoding.EncodeToString(attestation.CredentialID),
+		PublicKey:    attestation.PublicKey,
+		SignCount:    attestation.SignCount,
+		Transports:   strings.Join(input.Credential.Response.Transports, ","),
+		Name:         name,
+	}
+	var existing int64
+	db.Model(&WebAuthnCredential{}).Where("credential_id = ?", credential.CredentialID).Count(&existing)
+	if existing > 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "Passkey is already registered"})
+		return
+	}
+	if err := db.Create(&credential).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store passkey"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, credential)
+}
+
+// BeginWebAuthnLoginHandler starts logging in with a passkey. It responds with the
+// options for navigator.credentials.get() and a session to send to
+// FinishWebAuthnLoginHandler with the result.
+//
+// Without input, any passkey the authenticator finds logs its user in. With the
+// mfa_token of a password login, the passkey is the second factor and must be one of
+// that user's.
+func BeginWebAuthnLoginHandler(c *gin.Context) {
+	var input struct {
+		MFAToken string `json:"mfa_token"`
+	}
+
+	if err := c.ShouldBindJSON(&input); err != nil && c.Request.ContentLength > 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
+		return
+	}
+
+	var userID uint
+	userVerification := "required"
+	allow := []gin.H{}
+	if input.MFAToken != "" {
+		claims, err := validateToken(input.MFAToken, PurposeMFA)
+		if err != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired MFA token, log in again"})
+			return
+		}
+		userID = claims.UserID
+		userVerification = "preferred"
+		if allow, err = credentialDescriptors(database.DB, userID); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch passkeys"})
+			return
+		}
+	}
+
+	challenge, session, err := newWebAuthnSession(userID, PurposeWebAuthnLogin)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start login"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"session": session,
+		"publicKey": gin.H{
+			"challenge":        base64URL(challenge),
+			"rpId":             webAuthnRPID(),
+			"timeout":          webAuthnTimeout.Milliseconds(),
+			"allowCredentials": allow,
+			"userVerification": userVerification,
+		},
+	})
+}
+
+// FinishWebAuthnLoginHandler verifies a passkey assertion and responds with the access
+// and refresh tokens. As a second factor, it also takes the mfa_token the session was
+// started with. Logging in with a passkey alone requires user verification, a PIN or
+// biometric check by the authenticator.
+func FinishWebAuthnLoginHandler(c *gin.Context) {
+	var input struct {
+		Session    string `json:"session" binding:"required"`
+		MFAToken   string `json:"mfa_token"`
+		Credential struct {
+			RawID    base64URL `json:"rawId"`
+			Response struct {
+				ClientDataJSON    base64URL `json:"clientDataJSON"`
+				AuthenticatorData base64URL `json:"authenticatorData"`
+				Signature         base64URL `json:"signature"`
+				UserHandle        base64URL `json:"userHandle"`
+			} `json:"response"`
+		} `json:"credential"`
+	}
+
+	db := database.DB
+
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
+		return
+	}
+
+	session, err := validateToken(input.Session, PurposeWebAuthnLogin)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired session, start over"})
+		return
+	}
+
+	// A session bound to a user is a second factor, which completes a password login
+	var mfa *Claims
+	if session.UserID != 0 {
+		mfa, err = validateToken(input.MFAToken, PurposeMFA)
+		if err != nil || mfa.UserID != session.UserID {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired MFA token, log in again"})
+			return
+		}
+	}
+
+	var credential WebAuthnCredential
+	err = db.Where("credential_id = ?", base64.RawURLEncoding.EncodeToString(input.Credential.RawID)).First(&credential).Error
+	if err == gorm.ErrRecordNotFound || (err == nil && session.UserID != 0 && credential.UserID != session.UserID) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unknown passkey"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch passkey"})
+		return
+	}
+
+	response := input.Credential.Response
+	if response.UserHandle != nil && !bytes.Equal(response.UserHandle, userHandle(credential.UserID)) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unknown passkey"})
+		return
+	}
+	if err := verifyClientData(response.ClientDataJSON, "webauthn.get", session.Challenge); err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid assertion: " + err.Error()})
+		return
+	}
+	authData, err := parseAuthenticatorData(response.AuthenticatorData)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid assertion: " + err.Error()})
+		return
+	}
+	if mfa == nil && authData.flags&flagUserVerified == 0 {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Logging in with a passkey alone requires user verification"})
+		return
+	}
+
+	key, _, err := parseCOSEKey(credential.PublicKey)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read passkey"})
+		return
+	}
+	clientDataHash := sha256.Sum256(response.ClientDataJSON)
+	if err := key.verify(append(authData.raw[:len(authData.raw):len(authData.raw)], clientDataHash[:]...), response.Signature); err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid assertion: " + err.Error()})
+		return
+	}
+
+	// Authenticators that count signatures never go backwards, unless the key was copied
+	if (authData.signCount != 0 || credential.SignCount != 0) && authData.signCount <= credential.SignCount {
+		recordSecurityEvent(c, credential.UserID, SecurityEventWebAuthnSignCount,
+			fmt.Sprintf("passkey %d signed with count %d after %d", credential.ID, authData.signCount, credential.SignCount))
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Passkey may have been cloned"})
+		return
+	}
+
+	// The signature counts once too: of two requests with the same assertion, only one
+	// moves the count on from what both read
+	updated := db.Model(&WebAuthnCredential{}).Where("id = ? AND sign_count = ?", credential.ID, credential.SignCount).
+		Updates(map[string]interface{}{"sign_count": authData.signCount, "last_used_at": time.Now()})
+	if updated.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update passkey"})
+		return
+	}
+	if updated.RowsAffected == 0 {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired session, start over"})
+		return
+	}
+
+	// The session, and the MFA token, only log in once
+	for _, claims := range []*Claims{session, mfa} {
+		if claims == nil {
+			continue
+		}
+		if err := RevokeAccessToken(db, claims); err == ErrTokenAlreadyRevoked {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired session, start over"})
+			return
+		} else if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke session"})
+			return
+		}
+	}
+
+	var user User
+	if err := db.First(&user, credential.UserID).Error; err != nil || user.DisabledAt != nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Account is disabled"})
+		return
+	}
+
+	logIn(c, credential.UserID)
+}
+
+// ListWebAuthnCredentialsHandler lists the passkeys of the current user.
+func ListWebAuthnCredentialsHandler(c *gin.Context) {
+	var credentials []WebAuthnCredential
+	if err := database.DB.Where("user_id = ?", CurrentUser(c).ID).Order("id").Find(&credentials).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch passkeys"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"credentials": credentials})
+}
+
+// DeleteWebAuthnCredentialHandler removes a passkey of the current user.
+func DeleteWebAuthnCredentialHandler(c *gin.Context) {
+	// Deleted for good, so the same authenticator can register again
+	result := database.DB.Unscoped().Where("id = ? AND user_id = ?", c.Param("id"), CurrentUser(c).ID).Delete(&WebAuthnCredential{})
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete passkey"})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Passkey not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Passkey deleted"})
+}
@@ -0,0 +1,134 @@
+package reaper
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"let-me-in/database"
+	"let-me-in/models"
+	"let-me-in/modules/auth"
+	"let-me-in/terminal"
+)
+
+// Reaper periodically terminates idle and abandoned terminal sessions and purges
+// expired refresh tokens, access token revocations and password reset tokens.
+type Reaper struct {
+	Registry *terminal.Registry
+	// Interval is the time between two passes.
+	Interval time.Duration
+	// IdleTimeout is how long a session may go without any traffic.
+	IdleTimeout time.Duration
+	// DisconnectTimeout is how long a session may stay without an attached WebSocket.
+	DisconnectTimeout time.Duration
+}
+
+// Start runs a pass every Interval until ctx is done.
+func (r *Reaper) Start(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(r.Interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				r.Run()
+			}
+		}
+	}()
+}
+
+// Run performs a single pass.
+func (r *Reaper) Run() {
+	now := time.Now()
+	r.reapIdle(now.Add(-r.IdleTimeout))
+	r.reapAbandoned(now.Add(-r.DisconnectTimeout))
+	r.reapDisabled()
+
+	purged, err := auth.PurgeRefreshTokens(database.DB)
+	if err != nil {
+		log.Println("Reaper failed to purge refresh tokens:", err)
+	} else if purged > 0 {
+		log.Printf("Reaper purged %d refresh tokens", purged)
+	}
+
+	purged, err = auth.PurgeRevokedTokens(database.DB)
+	if err != nil {
+		log.Println("Reaper failed to purge revoked access tokens:", err)
+	} else if purged > 0 {
+		log.Printf("Reaper purged %d revoked access tokens", purged)
+	}
+
+	purged, err = auth.PurgePasswordResetTokens(database.DB)
+	if err != nil {
+		log.Println("Reaper failed to purge password reset tokens:", err)
+	} else if purged > 0 {
+		log.Printf("Reaper purged %d password reset tokens", purged)
+	}
+}
+
+// reapIdle terminates the sessions without traffic since cutoff.
+func (r *Reaper) reapIdle(cutoff time.Time) {
+	var sessions []models.Session
+	if err := database.DB.Where("status <> ? AND last_activity < ?", models.SessionTerminated, cutoff).Find(&sessions).Error; err != nil {
+		log.Println("Reaper failed to fetch idle sessions:", err)
+		return
+	}
+
+	for _, session := range sessions {
+		r.terminate(session.ID, models.TerminatedIdle)
+	}
+}
+
+// reapAbandoned terminates the sessions nobody has been attached to since cutoff. The
+// registry enforces this for the terminals it runs, so this mostly catches sessions
+// that were never connected to or whose terminal was lost in a restart. Those without a
+// disconnect time fall back on their last activity.
+func (r *Reaper) reapAbandoned(cutoff time.Time) {
+	var sessions []models.Session
+	err := database.DB.
+		Where("status <> ? AND (disconnected_at < ? OR (disconnected_at IS NULL AND last_activity < ?))", models.SessionTerminated, cutoff, cutoff).
+		Find(&sessions).Error
+	if err != nil {
+		log.Println("Reaper failed to fetch abandoned sessions:", err)
+		return
+	}
+
+	for _, session := range sessions {
+		if session.DisconnectedAt == nil && r.Registry.Get(session.ID) != nil {
+			continue // a WebSocket is still attached
+		}
+		r.terminate(session.ID, models.TerminatedDisconnected)
+	}
+}
+
+// reapDisabled terminates the sessions of disabled users. Disabling a user through the
+// API does so right away, this catches users disabled from the command line or by
+// another instance.
+func (r *Reaper) reapDisabled() {
+	disabled := database.DB.Model(&auth.User{}).Select("id").Where("disabled_at IS NOT NULL")
+	var sessions []models.Session
+	if err := database.DB.Where("status <> ? AND user_id IN (?)", models.SessionTerminated, disabled).Find(&sessions).Error; err != nil {
+		log.Println("Reaper failed to fetch sessions of disabled users:", err)
+		return
+	}
+
+	for _, session := range sessions {
+		r.terminate(session.ID, models.TerminatedUserDisabled)
+	}
+}
+
+func (r *Reaper) terminate(id uint, reason string) {
+	r.Registry.Terminate(id, reason)
+
+	err := database.DB.Model(&models.Session{}).
+		Where("id = ? AND status <> ?", id, models.SessionTerminated).
+		Updates(models.TerminatedColumns(reason)).Error
+	if err != nil {
+		log.Printf("Reaper failed to terminate session %d: %v", id, err)
+		return
+	}
+	log.Printf("Reaper terminated session %d: %s", id, reason)
+}
@@ -0,0 +1,143 @@
+package reaper
+
+import (
+	"testing"
+	"time"
+
+	"let-me-in/database"
+	"let-me-in/models"
+	"let-me-in/modules/auth"
+	"let-me-in/reaper"
+	"let-me-in/terminal"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// createSession stores a session whose last activity was age ago.
+func createSession(t *testing.T, status string, age time.Duration) models.Session {
+	session := models.Session{UserID: 1, Status: status}
+	assert.NoError(t, database.DB.Create(&session).Error)
+	// UpdateColumn skips the autoUpdateTime on LastActivity
+	database.DB.Model(&session).UpdateColumn("last_activity", time.Now().Add(-age))
+	return session
+}
+
+func reload(session models.Session) models.Session {
+	database.DB.First(&session, session.ID)
+	return session
+}
+
+func newReaper(registry *terminal.Registry) *reaper.Reaper {
+	return &reaper.Reaper{
+		Registry:          registry,
+		Interval:          time.Minute,
+		IdleTimeout:       time.Hour,
+		DisconnectTimeout: 5 * time.Minute,
+	}
+}
+
+func TestReaperTerminatesIdleAndAbandonedSessions(t *testing.T) {
+	database.InitTestDB()
+	registry := terminal.NewRegistry(time.Minute)
+
+	idle := createSession(t, models.SessionActive, 2*time.Hour)
+	abandoned := createSession(t, models.SessionDisconnected, 10*time.Minute)
+	neverConnected := createSession(t, models.SessionActive, 10*time.Minute)
+	recent := createSession(t, models.SessionDisconnected, time.Minute)
+
+	// Idle for long before disconnecting, the grace period still starts at the disconnect
+	lateDisconnect := createSession(t, models.SessionDisconnected, 10*time.Minute)
+	database.DB.Model(&lateDisconnect).UpdateColumn("disconnected_at", time.Now().Add(-time.Minute))
+	expiredDisconnect := createSession(t, models.SessionDisconnected, 10*time.Minute)
+	database.DB.Model(&expiredDisconnect).UpdateColumn("disconnected_at", time.Now().Add(-6*time.Minute))
+
+	// An attached session is left alone until it goes idle
+	attached := createSession(t, models.SessionActive, 10*time.Minute)
+	_, err := registry.Start(attached.ID, models.BackendLocal, terminal.DefaultProfiles()[terminal.DefaultProfile].Spec(""))
+	assert.NoError(t, err)
+	defer registry.Terminate(attached.ID, models.TerminatedByUser)
+
+	newReaper(registry).Run()
+
+	for _, tc := range []struct {
+		session models.Session
+		reason  string
+	}{
+		{idle, models.TerminatedIdle},
+		{abandoned, models.TerminatedDisconnected},
+		{neverConnected, models.TerminatedDisconnected},
+		{expiredDisconnect, models.TerminatedDisconnected},
+	} {
+		session := reload(tc.session)
+		assert.Equal(t, models.SessionTerminated, session.Status)
+		assert.Equal(t, tc.reason, session.TerminationReason)
+		assert.NotNil(t, session.EndedAt)
+	}
+
+	assert.Equal(t, models.SessionDisconnected, reload(recent).Status)
+	assert.Equal(t, models.SessionDisconnected, reload(lateDisconnect).Status)
+	assert.Equal(t, models.SessionActive, reload(attached).Status)
+	assert.NotNil(t, registry.Get(attached.ID))
+
+	database.ResetTestDB()
+}
+
+func TestReaperKillsRunningIdleTerminal(t *testing.T) {
+	database.InitTestDB()
+	registry := terminal.NewRegistry(time.Minute)
+
+	idle := createSession(t, models.SessionActive, 2*time.Hour)
+	_, err := registry.Start(idle.ID, models.BackendLocal, terminal.DefaultProfiles()[terminal.DefaultProfile].Spec(""))
+	assert.NoError(t, err)
+
+	newReaper(registry).Run()
+
+	assert.Nil(t, registry.Get(idle.ID))
+	assert.Equal(t, models.TerminatedIdle, reload(idle).TerminationReason)
+
+	database.ResetTestDB()
+}
+
+func TestReaperPurgesExpiredRefreshTokens(t *testing.T) {
+	database.InitTestDB()
+
+	user := auth.User{DisplayName: "reaper"}
+	database.DB.Create(&user)
+
+	valid := auth.RefreshToken{TokenHash: auth.HashRefreshToken("reaper-valid"), UserID: user.ID, ExpiresAt: time.Now().Add(time.Hour).Unix(), Active: true}
+	expired := auth.RefreshToken{TokenHash: auth.HashRefreshToken("reaper-expired"), UserID: user.ID, ExpiresAt: time.Now().Add(-time.Hour).Unix(), Active: true}
+	// Rotated tokens stay until they expire, so reusing them can be detected
+	rotated := auth.RefreshToken{TokenHash: auth.HashRefreshToken("reaper-rotated"), UserID: user.ID, ExpiresAt: time.Now().Add(time.Hour).Unix(), Active: false}
+	for _, token := range []*auth.RefreshToken{&valid, &expired, &rotated} {
+		assert.NoError(t, database.DB.Create(token).Error)
+	}
+
+	newReaper(terminal.NewRegistry(time.Minute)).Run()
+
+	var remaining []auth.RefreshToken
+	database.DB.Unscoped().Where("user_id = ?", user.ID).Order("id").Find(&remaining)
+	if assert.Len(t, remaining, 2) {
+		assert.Equal(t, valid.ID, remaining[0].ID)
+		assert.Equal(t, rotated.ID, remaining[1].ID)
+	}
+
+	database.ResetTestDB()
+}
+
+func TestReaperTerminatesSessionsOfDisabledUsers(t *testing.T) {
+	database.InitTestDB()
+
+	disabledAt := time.Now()
+	user := auth.User{DisplayName: "reaper-disabled", DisabledAt: &disabledAt}
+	database.DB.Create(&user)
+	session := models.Session{UserID: user.ID, Status: models.SessionActive}
+	assert.NoError(t, database.DB.Create(&session).Error)
+	other := createSession(t, models.SessionActive, time.Minute)
+
+	newReaper(terminal.NewRegistry(time.Minute)).Run()
+
+	assert.Equal(t, models.TerminatedUserDisabled, reload(session).TerminationReason)
+	assert.Equal(t, models.SessionActive, reload(other).Status)
+
+	database.ResetTestDB()
+}
@@ -0,0 +1,42 @@
+package terminal
+
+import (
+	"errors"
+	"io"
+	"syscall"
+)
+
+// ErrUnsupportedSignal is returned by Process.Signal when a backend can't deliver a signal.
+var ErrUnsupportedSignal = errors.New("signal not supported by this backend")
+
+// Backend starts terminal processes, e.g. locally or inside a container.
+type Backend interface {
+	// Spawn starts a process attached to a new terminal.
+	Spawn(spec Spec) (Process, error)
+}
+
+// Spec describes the process a Backend spawns.
+type Spec struct {
+	// Command is the program to run followed by its arguments.
+	Command []string
+	// Dir is the working directory; empty means the backend's default.
+	Dir string
+	// Env is the environment of the process, as KEY=value pairs.
+	Env []string
+	// ContainerID is the container to run the process in, for container backends.
+	ContainerID string
+}
+
+// Process is a process attached to a terminal. Reading returns the terminal output and
+// writing types into it.
+type Process interface {
+	io.ReadWriter
+	// Resize changes the size of the terminal.
+	Resize(cols, rows uint16) error
+	// Signal delivers sig to the foreground process of the terminal.
+	Signal(sig syscall.Signal) error
+	// Wait blocks until the process exits.
+	Wait() error
+	// Close kills the process and releases the terminal.
+	Close() error
+}
@@ -0,0 +1,61 @@
+package terminal
+
+// RingBuffer keeps the most recent bytes written to it, up to a fixed size.
+// It is not safe for concurrent use; Session guards its buffer with its own mutex.
+type RingBuffer struct {
+	data []byte
+	next int
+	full bool
+}
+
+// NewRingBuffer creates a buffer that holds the last size bytes written to it.
+func NewRingBuffer(size int) *RingBuffer {
+	if size < 0 {
+		size = 0
+	}
+	return &RingBuffer{data: make([]byte, size)}
+}
+
+// Write appends p to the buffer, discarding the oldest bytes once it is full.
+func (b *RingBuffer) Write(p []byte) (int, error) {
+	size := len(b.data)
+	if size == 0 {
+		return len(p), nil
+	}
+
+	// Only the tail of a write larger than the buffer survives
+	if len(p) >= size {
+		copy(b.data, p[len(p)-size:])
+		b.next = 0
+		b.full = true
+		return len(p), nil
+	}
+
+	n := copy(b.data[b.next:], p)
+	if n < len(p) {
+		copy(b.data, p[n:])
+	}
+	if b.next+len(p) >= size {
+		b.full = true
+	}
+	b.next = (b.next + len(p)) % size
+	return len(p), nil
+}
+
+// Bytes returns a copy of the buffered bytes, oldest first.
+func (b *RingBuffer) Bytes() []byte {
+	if !b.full {
+		return append([]byte(nil), b.data[:b.next]...)
+	}
+	out := make([]byte, 0, len(b.data))
+	out = append(out, b.data[b.next:]...)
+	return append(out, b.data[:b.next]...)
+}
+
+// Len returns the number of buffered bytes.
+func (b *RingBuffer) Len() int {
+	if b.full {
+		return len(b.data)
+	}
+	return b.next
+}
@@ -0,0 +1,234 @@
+package terminal
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"syscall"
+)
+
+// ContainerBackend runs processes inside existing containers through the exec API of a
+// Docker-compatible Engine listening on a unix socket.
+type ContainerBackend struct {
+	socketPath string
+	client     *http.Client
+}
+
+// NewContainerBackend creates a backend talking to the Engine API at socketPath,
+// e.g. /var/run/docker.sock.
+func NewContainerBackend(socketPath string) *ContainerBackend {
+	return &ContainerBackend{
+		socketPath: socketPath,
+		client: &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					var dialer net.Dialer
+					return dialer.DialContext(ctx, "unix", socketPath)
+				},
+			},
+		},
+	}
+}
+
+// Spawn creates an exec instance running spec.Command in spec.ContainerID and attaches to it.
+func (b *ContainerBackend) Spawn(spec Spec) (Process, error) {
+	if spec.ContainerID == "" {
+		return nil, errors.New("no container to run in")
+	}
+	if len(spec.Command) == 0 {
+		return nil, errors.New("no command to run")
+	}
+
+	config := map[string]interface{}{
+		"AttachStdin":  true,
+		"AttachStdout": true,
+		"AttachStderr": true,
+		"Tty":          true,
+		"Cmd":          spec.Command,
+		"Env":          spec.Env,
+		"WorkingDir":   spec.Dir,
+	}
+	var created struct {
+		ID string `json:"Id"`
+	}
+	if err := b.call(http.MethodPost, "/containers/"+url.PathEscape(spec.ContainerID)+"/exec", config, &created); err != nil {
+		return nil, err
+	}
+
+	conn, reader, err := b.startExec(created.ID)
+	if err != nil {
+		return nil, err
+	}
+	return &containerProcess{
+		backend: b,
+		execID:  created.ID,
+		conn:    conn,
+		reader:  reader,
+		done:    make(chan struct{}),
+	}, nil
+}
+
+// startExec starts an exec instance and hijacks the connection, which then carries the
+// raw terminal stream in both directions.
+func (b *ContainerBackend) startExec(execID string) (net.Conn, *bufio.Reader, error) {
+	conn, err := net.Dial("unix", b.socketPath)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	body, _ := json.Marshal(map[string]bool{"Detach": false, "Tty": true})
+	req, err := http.NewRequest(http.MethodPost, "http://engine/exec/"+url.PathEscape(execID)+"/start", bytes.NewReader(body))
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "tcp")
+
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	// Older engines answer 200 instead of switching protocols, the stream follows either way
+	if resp.StatusCode != http.StatusSwitchingProtocols && resp.StatusCode != http.StatusOK {
+		defer conn.Close()
+		return nil, nil, engineError(resp)
+	}
+	return conn, reader, nil
+}
+
+// call sends a JSON request to the Engine API and decodes the JSON response into out, if given.
+func (b *ContainerBackend) call(method, path string, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		payload, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(payload)
+	}
+
+	req, err := http.NewRequest(method, "http://engine"+path, body)
+	if err != nil {
+		return err
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusMultipleChoices {
+		return engineError(resp)
+	}
+	if out != nil {
+		return json.NewDecoder(resp.Body).Decode(out)
+	}
+	return nil
+}
+
+// engineError turns an Engine API error response into an error.
+func engineError(resp *http.Response) error {
+	var body struct {
+		Message string `json:"message"`
+	}
+	json.NewDecoder(resp.Body).Decode(&body)
+	if body.Message == "" {
+		body.Message = resp.Status
+	}
+	return fmt.Errorf("container engine: %s", body.Message)
+}
+
+// controlChars are the keystrokes that make the terminal line discipline inside the
+// container signal its foreground process, since the exec API has no way to signal it.
+var controlChars = map[syscall.Signal][]byte{
+	syscall.SIGINT:  {0x03}, // Ctrl-C
+	syscall.SIGQUIT: {0x1c}, // Ctrl-\
+	syscall.SIGTSTP: {0x1a}, // Ctrl-Z
+}
+
+type containerProcess struct {
+	backend *ContainerBackend
+	execID  string
+	conn    net.Conn
+	reader  *bufio.Reader
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func (p *containerProcess) Read(b []byte) (int, error) {
+	n, err := p.reader.Read(b)
+	if err != nil {
+		p.finish()
+	}
+	return n, err
+}
+
+func (p *containerProcess) Write(b []byte) (int, error) {
+	return p.conn.Write(b)
+}
+
+func (p *containerProcess) Resize(cols, rows uint16) error {
+	path := fmt.Sprintf("/exec/%s/resize?h=%d&w=%d", url.PathEscape(p.execID), rows, cols)
+	return p.backend.call(http.MethodPost, path, nil, nil)
+}
+
+func (p *containerProcess) Signal(sig syscall.Signal) error {
+	keys, ok := controlChars[sig]
+	if !ok {
+		return ErrUnsupportedSignal
+	}
+	_, err := p.conn.Write(keys)
+	return err
+}
+
+// Wait blocks until the terminal stream ends and reports how the process exited.
+func (p *containerProcess) Wait() error {
+	<-p.done
+
+	var inspect struct {
+		Running  bool
+		ExitCode int
+	}
+	if err := p.backend.call(http.MethodGet, "/exec/"+url.PathEscape(p.execID)+"/json", nil, &inspect); err != nil {
+		return err
+	}
+	if !inspect.Running && inspect.ExitCode != 0 {
+		return fmt.Errorf("process exited with code %d", inspect.ExitCode)
+	}
+	return nil
+}
+
+// Close ends the process by hanging up its terminal stream. A Ctrl-D goes first so a
+// shell sitting at its prompt exits cleanly.
+func (p *containerProcess) Close() error {
+	p.conn.Write([]byte{0x04})
+	err := p.conn.Close()
+	p.finish()
+	return err
+}
+
+func (p *containerProcess) finish() {
+	p.closeOnce.Do(func() { close(p.done) })
+}
@@ -0,0 +1,143 @@
+package terminal
+
+import (
+	"encoding/json"
+
+	"let-me-in/models"
+)
+
+// Control message types of live sessions, sent in OpControl frames. Every connection to
+// a session is a participant with a number, and the participant holding the driver role
+// is the only one whose input reaches the terminal. The role starts with the owner;
+// others can ask for it, and the owner or the current driver can hand it over or give
+// it back to the owner.
+const (
+	ControlWelcome   = "welcome"           // server: the participant number of a new connection, and the driver
+	ControlDriver    = "driver"            // server: the driver changed; participant 0 means nobody drives
+	ControlRequested = "control_requested" // server: a participant asks for control
+	ControlRequest   = "request_control"   // client: ask for control
+	ControlGrant     = "grant_control"     // client: hand control to a participant
+	ControlRevoke    = "revoke_control"    // client: give control back to the owner
+)
+
+// SessionControl is the payload of the OpControl frames used on live sessions.
+type SessionControl struct {
+	Type        string `json:"type"`
+	Participant uint   `json:"participant"`
+	UserID      uint   `json:"user_id,omitempty"`
+	Driver      uint   `json:"driver,omitempty"` // in a welcome
+}
+
+// sessionEvent is an event for the audit trail that happened while s.mu was held, to be
+// reported once it is released.
+type sessionEvent struct {
+	userID  uint
+	shareID uint
+	event   string
+}
+
+// handleControl acts on a control message received from c.
+func (r *Registry) handleControl(s *Session, c *client, payload []byte) {
+	var control SessionControl
+	if err := json.Unmarshal(payload, &control); err != nil {
+		c.sendError("invalid control message")
+		return
+	}
+
+	s.mu.Lock()
+	var events []sessionEvent
+	switch control.Type {
+	case ControlRequest:
+		if c.readOnly {
+			c.sendError("read-only participants can't take control")
+		} else if s.driver != c {
+			s.broadcast(SessionControl{Type: ControlRequested, Participant: c.participant, UserID: c.userID})
+		}
+	case ControlGrant:
+		target := s.participant(control.Participant)
+		if c != s.conn && c != s.driver {
+			c.sendError("only the owner or the driver can hand over control")
+		} else if target == nil {
+			c.sendError("no such participant")
+		} else if target.readOnly {
+			c.sendError("participant is read-only")
+		} else {
+			events = s.handoff(target)
+		}
+	case ControlRevoke:
+		if c != s.conn && c != s.driver {
+			c.sendError("only the owner or the driver can revoke control")
+		} else {
+			events = s.handoff(s.conn)
+		}
+	default:
+		c.sendError("unknown control message " + control.Type)
+	}
+	s.mu.Unlock()
+
+	r.events(s.ID, events)
+}
+
+// handoff makes `to` the driver and tells every participant. It must be called with s.mu
+// held, and returns the events to report: control being granted to or revoked from
+// anyone but the owner.
+func (s *Session) handoff(to *client) []sessionEvent {
+	from := s.driver
+	if from == to {
+		return nil
+	}
+	s.driver = to
+
+	changed := SessionControl{Type: ControlDriver}
+	if to != nil {
+		changed.Participant = to.participant
+		changed.UserID = to.userID
+	}
+	s.broadcast(changed)
+
+	var events []sessionEvent
+	if from != nil && !from.owner {
+		events = append(events, from.event(models.SessionEventControlRevoked))
+	}
+	if to != nil && !to.owner {
+		events = append(events, to.event(models.SessionEventControlGranted))
+	}
+	return events
+}
+
+// drives tells whether c holds the driver role.
+func (s *Session) drives(c *client) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.driver == c
+}
+
+// participant returns the client with the given participant number, or nil. It must be
+// called with s.mu held.
+func (s *Session) participant(number uint) *client {
+	if s.conn != nil && s.conn.participant == number {
+		return s.conn
+	}
+	for c := range s.observers {
+		if c.participant == number {
+			return c
+		}
+	}
+	return nil
+}
+
+// broadcast sends a control message to every participant. It must be called with s.mu held.
+func (s *Session) broadcast(control SessionControl) {
+	if s.conn != nil {
+		s.conn.sendJSON(OpControl, control)
+	}
+	for c := range s.observers {
+		c.sendJSON(OpControl, control)
+	}
+}
+
+func (r *Registry) events(id uint, events []sessionEvent) {
+	for _, e := range events {
+		r.event(id, e)
+	}
+}
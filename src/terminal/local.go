@@ -0,0 +1,68 @@
+package terminal
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"syscall"
+
+	"github.com/creack/pty"
+	"golang.org/x/sys/unix"
+)
+
+// LocalBackend runs processes on the server itself, in a PTY.
+type LocalBackend struct{}
+
+// Spawn starts spec.Command in a new PTY.
+func (LocalBackend) Spawn(spec Spec) (Process, error) {
+	if len(spec.Command) == 0 {
+		return nil, errors.New("no command to run")
+	}
+
+	cmd := exec.Command(spec.Command[0], spec.Command[1:]...)
+	cmd.Dir = spec.Dir
+	// An empty environment rather than the server's, which may hold secrets
+	cmd.Env = append([]string{}, spec.Env...)
+	ptmx, err := pty.Start(cmd)
+	if err != nil {
+		return nil, err
+	}
+	return &localProcess{ptmx: ptmx, cmd: cmd}, nil
+}
+
+type localProcess struct {
+	ptmx *os.File
+	cmd  *exec.Cmd
+}
+
+func (p *localProcess) Read(b []byte) (int, error) {
+	return p.ptmx.Read(b)
+}
+
+func (p *localProcess) Write(b []byte) (int, error) {
+	return p.ptmx.Write(b)
+}
+
+func (p *localProcess) Resize(cols, rows uint16) error {
+	return pty.Setsize(p.ptmx, &pty.Winsize{Cols: cols, Rows: rows})
+}
+
+// Signal delivers sig to the foreground process group of the terminal, like typing
+// Ctrl-C would, falling back to the shell itself.
+func (p *localProcess) Signal(sig syscall.Signal) error {
+	pgrp, err := unix.IoctlGetInt(int(p.ptmx.Fd()), unix.TIOCGPGRP)
+	if err != nil || pgrp <= 0 {
+		return p.cmd.Process.Signal(sig)
+	}
+	return syscall.Kill(-pgrp, sig)
+}
+
+func (p *localProcess) Wait() error {
+	return p.cmd.Wait()
+}
+
+func (p *localProcess) Close() error {
+	err := p.ptmx.Close()
+	p.cmd.Process.Kill()
+	return err
+}
@@ -0,0 +1,270 @@
+package terminal
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// MaxPlaybackSpeed is the fastest a recording can be replayed.
+const MaxPlaybackSpeed = 16
+
+// Playback control message types, sent in OpControl frames. Clients send pause, resume,
+// seek and speed; the server answers every one of them with a status, and sends end once
+// the recording is over.
+const (
+	ControlPause  = "pause"
+	ControlResume = "resume"
+	ControlSeek   = "seek"
+	ControlSpeed  = "speed"
+	ControlStatus = "status"
+	ControlEnd    = "end"
+)
+
+// PlaybackControl is the payload of the OpControl frames used during playback.
+type PlaybackControl struct {
+	Type     string  `json:"type"`
+	At       float64 `json:"at,omitempty"`       // seek target, or current position in a status
+	Speed    float64 `json:"speed,omitempty"`    // speed multiplier
+	Paused   bool    `json:"paused,omitempty"`   // in a status
+	Duration float64 `json:"duration,omitempty"` // in a status
+}
+
+// RecordingEvent is an event of an asciicast recording.
+type RecordingEvent struct {
+	Time float64
+	Type string
+	Data string
+}
+
+// Recording is a parsed asciicast v2 file.
+type Recording struct {
+	Header RecordingHeader
+	Events []RecordingEvent
+}
+
+// resetTerminal clears the screen of the viewer before it is redrawn by a seek.
+const resetTerminal = "\x1bc"
+
+// LoadRecording reads an asciicast v2 file.
+func LoadRecording(path string) (*Recording, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	if !scanner.Scan() {
+		return nil, errors.New("empty recording")
+	}
+
+	recording := &Recording{}
+	if err := json.Unmarshal(scanner.Bytes(), &recording.Header); err != nil || recording.Header.Version != 2 {
+		return nil, errors.New("not an asciicast v2 recording")
+	}
+
+	for scanner.Scan() {
+		var raw []interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &raw); err != nil || len(raw) != 3 {
+			// The last line of a recording cut short by a crash may be incomplete
+			continue
+		}
+		at, ok1 := raw[0].(float64)
+		eventType, ok2 := raw[1].(string)
+		data, ok3 := raw[2].(string)
+		if ok1 && ok2 && ok3 {
+			recording.Events = append(recording.Events, RecordingEvent{Time: at, Type: eventType, Data: data})
+		}
+	}
+	return recording, scanner.Err()
+}
+
+// Duration returns the time of the last event.
+func (r *Recording) Duration() float64 {
+	if len(r.Events) == 0 {
+		return 0
+	}
+	return r.Events[len(r.Events)-1].Time
+}
+
+// Play replays the recording to conn with its original timing, scaled by speed, starting
+// at the given position. Output is sent in OpData frames and size changes in OpResize
+// frames, like a live terminal, and clients steer playback with OpControl frames. Play
+// returns when the connection closes.
+func (r *Recording) Play(conn *websocket.Conn, speed, at float64) error {
+	c := newClient(conn)
+	defer c.close()
+	p := &player{
+		recording: r,
+		client:    c,
+		speed:     speed,
+		controls:  make(chan PlaybackControl),
+		closed:    make(chan struct{}),
+	}
+	go p.readControls(conn)
+
+	p.sendResize(r.Header.Width, r.Header.Height)
+	p.seek(at)
+	return p.run()
+}
+
+type player struct {
+	recording *Recording
+	client    *client
+	speed     float64
+	paused    bool
+	position  float64 // recording time already played
+	next      int     // index of the next event to play
+
+	controls chan PlaybackControl
+	closed   chan struct{}
+}
+
+func (p *player) run() error {
+	for {
+		var timer <-chan time.Time
+		var waitStart time.Time
+		if !p.paused && p.next < len(p.recording.Events) {
+			delay := (p.recording.Events[p.next].Time - p.position) / p.speed
+			waitStart = time.Now()
+			timer = time.After(time.Duration(delay * float64(time.Second)))
+		}
+
+		select {
+		case <-p.closed:
+			return nil
+		case <-timer:
+			event := p.recording.Events[p.next]
+			p.position = event.Time
+			p.next++
+			p.play(event)
+			if p.next == len(p.recording.Events) {
+				p.sendEnd()
+			}
+		case control := <-p.controls:
+			if timer != nil {
+				// Account for the time played while waiting for the next event
+				p.position += time.Since(waitStart).Seconds() * p.speed
+				if p.position > p.recording.Events[p.next].Time {
+					p.position = p.recording.Events[p.next].Time
+				}
+			}
+			p.apply(control)
+		}
+	}
+}
+
+func (p *player) apply(control PlaybackControl) {
+	switch control.Type {
+	case ControlPause:
+		p.paused = true
+	case ControlResume:
+		p.paused = false
+	case ControlSeek:
+		p.seek(control.At)
+	case ControlSpeed:
+		if control.Speed <= 0 || control.Speed > MaxPlaybackSpeed {
+			p.client.sendError(fmt.Sprintf("speed must be greater than 0 and at most %d", MaxPlaybackSpeed))
+			return
+		}
+		p.speed = control.Speed
+	default:
+		p.client.sendError("unknown playback control " + control.Type)
+		return
+	}
+	p.sendStatus()
+}
+
+// seek redraws the screen as it was at the given time and continues from there. A seek
+// to or past the last event ends the recording right away.
+func (p *player) seek(at float64) {
+	if at < 0 {
+		at = 0
+	}
+
+	var output strings.Builder
+	output.WriteString(resetTerminal)
+	width, height := p.recording.Header.Width, p.recording.Header.Height
+	p.next = 0
+	for p.next < len(p.recording.Events) && p.recording.Events[p.next].Time <= at {
+		event := p.recording.Events[p.next]
+		switch event.Type {
+		case EventOutput:
+			output.WriteString(event.Data)
+		case EventResize:
+			fmt.Sscanf(event.Data, "%dx%d", &width, &height)
+		}
+		p.next++
+	}
+	p.position = min(at, p.recording.Duration())
+
+	p.sendResize(width, height)
+	p.client.waitOutput([]byte(output.String()))
+	if p.next == len(p.recording.Events) {
+		p.sendEnd()
+	}
+}
+
+func (p *player) play(event RecordingEvent) {
+	switch event.Type {
+	case EventOutput:
+		p.client.waitOutput([]byte(event.Data))
+	case EventResize:
+		var width, height int
+		if _, err := fmt.Sscanf(event.Data, "%dx%d", &width, &height); err == nil {
+			p.sendResize(width, height)
+		}
+	}
+}
+
+func (p *player) sendResize(width, height int) {
+	p.client.sendJSON(OpResize, ResizeMessage{Cols: uint16(width), Rows: uint16(height)})
+}
+
+func (p *player) sendEnd() {
+	p.client.sendJSON(OpControl, PlaybackControl{Type: ControlEnd, At: p.position})
+}
+
+func (p *player) sendStatus() {
+	p.client.sendJSON(OpControl, PlaybackControl{
+		Type:     ControlStatus,
+		At:       p.position,
+		Speed:    p.speed,
+		Paused:   p.paused,
+		Duration: p.recording.Duration(),
+	})
+}
+
+// readControls forwards the control frames sent by the client to the player.
+func (p *player) readControls(conn *websocket.Conn) {
+	defer close(p.closed)
+	for {
+		_, msg, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+
+		frame, err := DecodeFrame(msg)
+		if err != nil || frame.Op != OpControl {
+			// Recordings are read-only, there is nowhere to send input
+			p.client.sendError("playback only accepts control frames")
+			continue
+		}
+
+		var control PlaybackControl
+		if err := json.Unmarshal(frame.Payload, &control); err != nil {
+			p.client.sendError("invalid control message")
+			continue
+		}
+
+		p.controls <- control
+	}
+}
@@ -0,0 +1,124 @@
+package terminal
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+)
+
+// DefaultProfile is the profile used when a session doesn't ask for one.
+const DefaultProfile = "bash"
+
+// Profile is a named recipe for the process behind a session, e.g. a plain shell or a
+// Rails console. Clients pick profiles by name, so they never choose what is executed.
+type Profile struct {
+	Description string `json:"description"`
+	// Command is the program to run followed by its arguments.
+	Command []string `json:"command"`
+	// Dir is the working directory; empty means the server's.
+	Dir string `json:"dir"`
+	// EnvAllow lists the server environment variables passed through to the process.
+	EnvAllow []string `json:"env_allow"`
+	// Env sets environment variables, overriding the ones passed through.
+	Env map[string]string `json:"env"`
+	// Term is the initial value of TERM.
+	Term string `json:"term"`
+}
+
+// Profiles are the shell profiles sessions can use, by name.
+type Profiles map[string]Profile
+
+// ShellProfiles are the profiles available to the web server.
+var ShellProfiles = DefaultProfiles()
+
+var profileNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,31}$`)
+
+// ValidProfileName reports whether name is well formed: lowercase letters, digits, dashes
+// and underscores, up to 32 characters.
+func ValidProfileName(name string) bool {
+	return profileNamePattern.MatchString(name)
+}
+
+// DefaultProfiles returns the profiles used when none are configured: a bash shell.
+func DefaultProfiles() Profiles {
+	return Profiles{
+		DefaultProfile: {
+			Description: "Bash shell",
+			Command:     []string{"bash"},
+			EnvAllow:    []string{"PATH", "HOME", "USER", "LANG", "SHELL"},
+			Term:        "xterm-256color",
+		},
+	}
+}
+
+// LoadProfiles reads profiles from a JSON file mapping profile names to profiles.
+func LoadProfiles(path string) (Profiles, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var profiles Profiles
+	if err := json.Unmarshal(data, &profiles); err != nil {
+		return nil, fmt.Errorf("invalid profiles file %s: %w", path, err)
+	}
+
+	for name, profile := range profiles {
+		if !ValidProfileName(name) {
+			return nil, fmt.Errorf("invalid profile name %q", name)
+		}
+		if len(profile.Command) == 0 || profile.Command[0] == "" {
+			return nil, fmt.Errorf("profile %q has no command", name)
+		}
+		if profile.Term == "" {
+			profile.Term = "xterm-256color"
+			profiles[name] = profile
+		}
+	}
+	return profiles, nil
+}
+
+// Names returns the profile names in alphabetical order.
+func (p Profiles) Names() []string {
+	names := make([]string, 0, len(p))
+	for name := range p {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Spec builds the spec of a process running this profile.
+func (p Profile) Spec(containerID string) Spec {
+	env := make(map[string]string)
+	for _, key := range p.EnvAllow {
+		if value, ok := os.LookupEnv(key); ok {
+			env[key] = value
+		}
+	}
+	for key, value := range p.Env {
+		env[key] = value
+	}
+	if p.Term != "" {
+		env["TERM"] = p.Term
+	}
+
+	keys := make([]string, 0, len(env))
+	for key := range env {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	spec := Spec{
+		Command:     append([]string(nil), p.Command...),
+		Dir:         p.Dir,
+		Env:         make([]string, 0, len(keys)),
+		ContainerID: containerID,
+	}
+	for _, key := range keys {
+		spec.Env = append(spec.Env, key+"="+env[key])
+	}
+	return spec
+}
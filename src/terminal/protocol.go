@@ -0,0 +1,252 @@
+package terminal
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Subprotocol is the WebSocket subprotocol a client requests to speak the framed protocol.
+// Clients that don't request it are in raw mode: every message they send is written to
+// the PTY as is and they receive the PTY output as text messages.
+//
+// In the framed protocol every message is a binary frame whose first byte is an opcode
+// and the rest is its payload. Control payloads are JSON objects.
+const Subprotocol = "letmein.v1"
+
+// Frame opcodes.
+const (
+	OpData   byte = '0' // stdin from the client, PTY output from the server
+	OpResize byte = '1' // {"cols": 180, "rows": 50}
+	OpPing   byte = '2' // any payload, answered with an OpPong carrying the same payload
+	OpPong   byte = '3'
+	OpSignal byte = '4' // {"signal": "SIGINT"}
+	OpError  byte = '5' // {"message": "..."}
+	// OpControl carries a JSON object whose "type" field tells what it is about, e.g.
+	// {"type": "pause"} during playback.
+	OpControl byte = '6'
+)
+
+// ResizeMessage is the payload of an OpResize frame.
+type ResizeMessage struct {
+	Cols uint16 `json:"cols"`
+	Rows uint16 `json:"rows"`
+}
+
+// SignalMessage is the payload of an OpSignal frame.
+type SignalMessage struct {
+	Signal string `json:"signal"`
+}
+
+// ErrorMessage is the payload of an OpError frame.
+type ErrorMessage struct {
+	Message string `json:"message"`
+}
+
+// Frame is a decoded protocol message.
+type Frame struct {
+	Op      byte
+	Payload []byte
+}
+
+var errEmptyFrame = errors.New("empty frame")
+
+// EncodeFrame builds the wire representation of a frame.
+func EncodeFrame(op byte, payload []byte) []byte {
+	msg := make([]byte, 0, len(payload)+1)
+	msg = append(msg, op)
+	return append(msg, payload...)
+}
+
+// DecodeFrame splits a message into its opcode and payload.
+func DecodeFrame(msg []byte) (Frame, error) {
+	if len(msg) == 0 {
+		return Frame{}, errEmptyFrame
+	}
+	return Frame{Op: msg[0], Payload: msg[1:]}, nil
+}
+
+// signals are the signals a client may send to the foreground process of a terminal.
+var signals = map[string]syscall.Signal{
+	"SIGHUP":  syscall.SIGHUP,
+	"SIGINT":  syscall.SIGINT,
+	"SIGQUIT": syscall.SIGQUIT,
+	"SIGKILL": syscall.SIGKILL,
+	"SIGTERM": syscall.SIGTERM,
+	"SIGCONT": syscall.SIGCONT,
+	"SIGTSTP": syscall.SIGTSTP,
+}
+
+// ParseSignal resolves a signal name such as "SIGINT" or "int".
+func ParseSignal(name string) (syscall.Signal, bool) {
+	name = strings.ToUpper(name)
+	if !strings.HasPrefix(name, "SIG") {
+		name = "SIG" + name
+	}
+	sig, ok := signals[name]
+	return sig, ok
+}
+
+// sendQueueSize is how many messages may wait for a client before it counts as lagging.
+const sendQueueSize = 256
+
+// outputSlots is how much of the queue waitOutput may fill, so there is always room for
+// the control messages sent along.
+const outputSlots = 192
+
+// writeTimeout is how long writing a single message to a client may take.
+const writeTimeout = 10 * time.Second
+
+var errClientClosed = errors.New("client closed")
+
+// client is a WebSocket attached to a session. Messages go through a queue drained by a
+// writer goroutine of its own, so sending never waits on the network. A client whose
+// queue fills up, or that takes longer than writeTimeout to accept a message, is
+// disconnected. It also hides the protocol mode.
+type client struct {
+	conn   *websocket.Conn
+	framed bool
+
+	// Who is behind a connection to a live session
+	participant uint // number of the connection within its session
+	userID      uint
+	shareID     uint // guests connected through a share link
+	owner       bool
+	readOnly    bool // may not be handed control
+
+	queue     chan message
+	slots     chan struct{} // taken by waitOutput, freed once its message was written
+	done      chan struct{} // closed once the client is closed
+	closeOnce sync.Once
+}
+
+// event is an event for the audit trail caused by whoever is behind c.
+func (c *client) event(event string) sessionEvent {
+	return sessionEvent{userID: c.userID, shareID: c.shareID, event: event}
+}
+
+// message is a WebSocket message waiting in a client's queue.
+type message struct {
+	kind int // websocket.TextMessage or websocket.BinaryMessage
+	data []byte
+	slot bool // holds one of the slots
+}
+
+func newClient(conn *websocket.Conn) *client {
+	c := &client{
+		conn:   conn,
+		framed: conn.Subprotocol() == Subprotocol,
+		queue:  make(chan message, sendQueueSize),
+		slots:  make(chan struct{}, outputSlots),
+		done:   make(chan struct{}),
+	}
+	go c.writeLoop()
+	return c
+}
+
+// writeLoop writes the queued messages until the client is closed, closing it when a
+// write fails or times out.
+func (c *client) writeLoop() {
+	for {
+		select {
+		case <-c.done:
+			return
+		case msg := <-c.queue:
+			c.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+			if err := c.conn.WriteMessage(msg.kind, msg.data); err != nil {
+				log.Println("WebSocket write error:", err)
+				c.close()
+				return
+			}
+			if msg.slot {
+				<-c.slots
+			}
+		}
+	}
+}
+
+// enqueue queues a message without waiting, disconnecting the client if its queue is full.
+func (c *client) enqueue(msg message) error {
+	select {
+	case <-c.done:
+		return errClientClosed
+	default:
+	}
+	select {
+	case c.queue <- msg:
+		return nil
+	default:
+		log.Println("Disconnecting WebSocket that stopped reading")
+		c.close()
+		return errClientClosed
+	}
+}
+
+// outputMessage wraps output in a message for the client's protocol mode.
+func (c *client) outputMessage(p []byte) message {
+	if !c.framed {
+		return message{kind: websocket.TextMessage, data: append([]byte(nil), p...)}
+	}
+	return message{kind: websocket.BinaryMessage, data: EncodeFrame(OpData, p)}
+}
+
+// sendOutput sends output to the client.
+func (c *client) sendOutput(p []byte) error {
+	return c.enqueue(c.outputMessage(p))
+}
+
+// waitOutput sends output to the client, waiting for it to catch up first if it has
+// much left to write. This is how a client slows down whoever produces the output,
+// so it must never be called with a lock others need held.
+func (c *client) waitOutput(p []byte) error {
+	select {
+	case c.slots <- struct{}{}:
+	case <-c.done:
+		return errClientClosed
+	}
+	msg := c.outputMessage(p)
+	msg.slot = true
+	if err := c.enqueue(msg); err != nil {
+		<-c.slots
+		return err
+	}
+	return nil
+}
+
+// sendFrame sends a frame to the client. Raw clients only understand output, so
+// anything else is dropped for them.
+func (c *client) sendFrame(op byte, payload []byte) error {
+	if !c.framed {
+		return nil
+	}
+	return c.enqueue(message{kind: websocket.BinaryMessage, data: EncodeFrame(op, payload)})
+}
+
+// sendJSON sends a frame whose payload is v encoded as JSON.
+func (c *client) sendJSON(op byte, v interface{}) error {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return c.sendFrame(op, payload)
+}
+
+// sendError reports a problem with a frame the client sent.
+func (c *client) sendError(message string) error {
+	return c.sendJSON(OpError, ErrorMessage{Message: message})
+}
+
+// close closes the connection, dropping the messages still queued. It may be called
+// more than once.
+func (c *client) close() {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.conn.Close()
+	})
+}
@@ -0,0 +1,141 @@
+package terminal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Default terminal size written to recording headers, until a client resizes.
+const (
+	defaultCols = 80
+	defaultRows = 24
+)
+
+// Recorder writes a terminal session to an asciicast v2 file: a JSON header line
+// followed by one [time, type, data] event per line.
+// See https://docs.asciinema.org/manual/asciicast/v2/
+type Recorder struct {
+	mu      sync.Mutex
+	file    *os.File
+	start   time.Time
+	pending []byte // an incomplete UTF-8 sequence held back from the last output
+	closed  bool
+}
+
+// ErrRecorderClosed is returned when recording to a Recorder that was closed.
+var ErrRecorderClosed = errors.New("recorder closed")
+
+// RecordingHeader is the first line of an asciicast v2 file.
+type RecordingHeader struct {
+	Version   int               `json:"version"`
+	Width     int               `json:"width"`
+	Height    int               `json:"height"`
+	Timestamp int64             `json:"timestamp"`
+	Title     string            `json:"title,omitempty"`
+	Env       map[string]string `json:"env,omitempty"`
+}
+
+// Asciicast event types
+const (
+	EventOutput = "o"
+	EventInput  = "i"
+	EventResize = "r"
+)
+
+// NewRecorder creates the recording file at path and writes its header.
+func NewRecorder(path string, header RecordingHeader) (*Recorder, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return nil, err
+	}
+
+	header.Version = 2
+	if header.Width == 0 || header.Height == 0 {
+		header.Width, header.Height = defaultCols, defaultRows
+	}
+	start := time.Now()
+	header.Timestamp = start.Unix()
+
+	line, _ := json.Marshal(header)
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &Recorder{file: file, start: start}, nil
+}
+
+// Output records terminal output. A multi-byte character split across two reads is
+// written once complete, since asciicast data must be valid UTF-8.
+func (r *Recorder) Output(p []byte) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return ErrRecorderClosed
+	}
+
+	data := append(r.pending, p...)
+	cut := len(data)
+	// Hold back a trailing incomplete character, which is at most 3 bytes long
+	for i := len(data) - 1; i >= 0 && i >= len(data)-3; i-- {
+		if utf8.RuneStart(data[i]) {
+			if !utf8.FullRune(data[i:]) {
+				cut = i
+			}
+			break
+		}
+	}
+	r.pending = append([]byte(nil), data[cut:]...)
+	if cut > 0 {
+		return r.write(EventOutput, string(data[:cut]))
+	}
+	return nil
+}
+
+// Input records what was typed into the terminal.
+func (r *Recorder) Input(p []byte) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return ErrRecorderClosed
+	}
+	return r.write(EventInput, string(p))
+}
+
+// Resize records a change of the terminal size.
+func (r *Recorder) Resize(cols, rows uint16) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return ErrRecorderClosed
+	}
+	return r.write(EventResize, fmt.Sprintf("%dx%d", cols, rows))
+}
+
+// Close flushes any held back output and closes the file.
+func (r *Recorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return ErrRecorderClosed
+	}
+	r.closed = true
+	if len(r.pending) > 0 {
+		r.write(EventOutput, strings.ToValidUTF8(string(r.pending), "�"))
+		r.pending = nil
+	}
+	return r.file.Close()
+}
+
+func (r *Recorder) write(eventType, data string) error {
+	elapsed := math.Round(time.Since(r.start).Seconds()*1e6) / 1e6
+	line, _ := json.Marshal([]interface{}{elapsed, eventType, data})
+	_, err := r.file.Write(append(line, '\n'))
+	return err
+}
@@ -1,55 +1,589 @@
 package terminal
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
-	"os/exec"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"let-me-in/models"
 
-	"github.com/creack/pty"
 	"github.com/gorilla/websocket"
 )
 
-// StartTerminalSession starts a PTY terminal session and links it with WebSocket
-func StartTerminalSession(conn *websocket.Conn, command string) {
-	// Start a shell or any command (e.g., Django or Rails shell)
-	cmd := exec.Command("bash") // You can replace with "python manage.py shell" or "rails console"
+// ErrSessionNotFound is returned when a session is not running in the registry.
+var ErrSessionNotFound = errors.New("terminal session not found")
+
+// Session is a running terminal process. It belongs to a Registry rather than to a
+// WebSocket, so the shell keeps running when the connection drops.
+type Session struct {
+	ID uint
+
+	proc Process
+
+	lastActivity atomic.Int64 // unix nanoseconds of the last reported activity
+
+	recorder    *Recorder // nil when recording is disabled
+	recordInput bool
+
+	mu           sync.Mutex
+	conn         *client              // the owner's connection
+	observers    map[*client]struct{} // every other connection
+	driver       *client              // the only client whose input reaches the terminal
+	participants uint                 // last participant number handed out
+	scrollback   *RingBuffer
+	timer        *time.Timer
+	closed       bool
+}
+
+// Registry keeps track of the running terminal sessions, keyed by models.Session.ID.
+type Registry struct {
+	// Backends are the backends sessions can run on, by name.
+	Backends map[string]Backend
+	// Timeout is how long a session survives without an attached WebSocket.
+	Timeout time.Duration
+	// ScrollbackSize is how many bytes of recent output are replayed to a newly attached WebSocket.
+	ScrollbackSize int
+	// RecordingsDir is where sessions are recorded as asciicast files; empty disables recording.
+	RecordingsDir string
+	// RecordInput also records what is typed into sessions, passwords included.
+	RecordInput bool
+	// OnRecording is called, when set, with the path of the file a session is recorded to.
+	OnRecording func(id uint, path string)
+	// OnStatusChange is called, when set, every time a session changes status. The
+	// reason is only given when the session is terminated.
+	OnStatusChange func(id uint, status, reason string)
+	// OnActivity is called, when set, as traffic flows between a session and its
+	// WebSocket, at most once per ActivityInterval.
+	OnActivity       func(id uint)
+	ActivityInterval time.Duration
+	// OnSessionEvent is called, when set, for the events that go to the audit trail of a
+	// session, such as an observer attaching, along with the user behind them. Guests have
+	// no user, only the share link they connected through.
+	OnSessionEvent func(id, userID, shareID uint, event string)
+
+	mu       sync.Mutex
+	sessions map[uint]*Session
+	starting map[uint]*pendingStart // sessions whose process is being spawned
+}
+
+// pendingStart is a session being started, which other starts of it wait for.
+type pendingStart struct {
+	done    chan struct{} // closed once the start is over
+	session *Session
+	err     error
+}
+
+// Sessions is the registry used by the web server.
+var Sessions = NewRegistry(5 * time.Minute)
+
+// DefaultScrollbackSize is the amount of output kept per session unless configured otherwise.
+const DefaultScrollbackSize = 64 * 1024
+
+// NewRegistry creates an empty registry whose sessions are killed after timeout without a connection.
+func NewRegistry(timeout time.Duration) *Registry {
+	return &Registry{
+		Backends:         map[string]Backend{models.BackendLocal: LocalBackend{}},
+		Timeout:          timeout,
+		ScrollbackSize:   DefaultScrollbackSize,
+		ActivityInterval: 30 * time.Second,
+		sessions:         make(map[uint]*Session),
+		starting:         make(map[uint]*pendingStart),
+	}
+}
+
+// Get returns the running session with the given ID, or nil if there is none.
+func (r *Registry) Get(id uint) *Session {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.sessions[id]
+}
+
+// Start returns the running session with the given ID, spawning spec on the named
+// backend if there is none. Spawning can take a while, e.g. a round trip to the
+// container engine, so it happens without holding up the rest of the registry; starting
+// the same session again meanwhile waits for it.
+func (r *Registry) Start(id uint, backend string, spec Spec) (*Session, error) {
+	r.mu.Lock()
+	if s, ok := r.sessions[id]; ok {
+		r.mu.Unlock()
+		return s, nil
+	}
+	if pending, ok := r.starting[id]; ok {
+		r.mu.Unlock()
+		<-pending.done
+		return pending.session, pending.err
+	}
+	b, ok := r.Backends[backend]
+	if !ok {
+		r.mu.Unlock()
+		return nil, fmt.Errorf("unknown backend %q", backend)
+	}
+	pending := &pendingStart{done: make(chan struct{})}
+	r.starting[id] = pending
+	r.mu.Unlock()
 
-	// Start PTY session
-	ptmx, err := pty.Start(cmd)
+	s, err := r.spawn(id, b, spec)
+
+	r.mu.Lock()
+	delete(r.starting, id)
+	if err == nil {
+		// Nobody is attached yet, so the grace period starts right away
+		s.mu.Lock()
+		r.startGracePeriod(s)
+		s.mu.Unlock()
+		r.sessions[id] = s
+	}
+	r.mu.Unlock()
+	pending.session, pending.err = s, err
+	close(pending.done)
 	if err != nil {
-		log.Println("Failed to start PTY:", err)
-		conn.WriteMessage(websocket.TextMessage, []byte("Error: Failed to start PTY session."))
-		return
+		return nil, err
+	}
+
+	go r.pump(s)
+	return s, nil
+}
+
+// spawn starts the process of a new session, and its recording.
+func (r *Registry) spawn(id uint, b Backend, spec Spec) (*Session, error) {
+	proc, err := b.Spawn(spec)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Session{
+		ID:          id,
+		proc:        proc,
+		observers:   make(map[*client]struct{}),
+		scrollback:  NewRingBuffer(r.ScrollbackSize),
+		recordInput: r.RecordInput,
+	}
+	if r.RecordingsDir != "" {
+		if s.recorder, err = r.record(id, spec); err != nil {
+			proc.Close()
+			proc.Wait()
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// Attach links conn to a running session as its owner, userID, and blocks until the
+// connection drops or the session ends. The recent output is replayed first so the
+// screen isn't blank, and a previously attached connection is closed, so the newest one
+// wins. The owner drives the session unless control was handed to someone else.
+func (r *Registry) Attach(id, userID uint, conn *websocket.Conn) error {
+	s := r.Get(id)
+	if s == nil {
+		return ErrSessionNotFound
+	}
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return ErrSessionNotFound
 	}
-	defer ptmx.Close()
-
-	// Goroutine to read from PTY and send to WebSocket
-	go func() {
-		buf := make([]byte, 1024)
-		for {
-			n, err := ptmx.Read(buf)
-			if err != nil {
-				log.Println("PTY read error:", err)
-				return
-			}
-			err = conn.WriteMessage(websocket.TextMessage, buf[:n])
-			if err != nil {
-				log.Println("WebSocket write error:", err)
-				return
-			}
-		}
-	}()
+	previous := s.conn
+	c := s.join(conn, userID)
+	c.owner = true
+	s.conn = c
+	var events []sessionEvent
+	if s.driver == nil || s.driver == previous {
+		events = s.handoff(c)
+	}
+	if s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+	}
+	s.mu.Unlock()
+	if previous != nil {
+		previous.close()
+	}
+	r.notify(id, models.SessionActive, "")
+	r.events(id, events)
 
 	// Read from WebSocket and send to PTY
 	for {
 		_, msg, err := conn.ReadMessage()
 		if err != nil {
 			log.Println("WebSocket read error:", err)
-			return
+			break
+		}
+		r.touch(s)
+
+		// Raw clients send nothing but keystrokes
+		if c.framed {
+			err = r.handleFrame(s, c, msg)
+		} else if s.drives(c) {
+			err = s.write(msg)
+		}
+		if err != nil {
+			log.Println("PTY write error:", err)
+			break
+		}
+	}
+
+	c.close()
+	r.detach(s, c)
+	return nil
+}
+
+// Observer tells who is behind an observer connection.
+type Observer struct {
+	UserID   uint
+	ShareID  uint // the share link a guest connected through, guests have no user
+	ReadOnly bool // may not be handed control
+}
+
+// Observe links conn to a running session as an observer, and blocks until the
+// connection drops or the session ends. Observers get the same output as the
+// owner, but their input is rejected unless they are handed control, which read-only
+// observers never are. They don't keep the session alive: it still ends Timeout after
+// its owner disconnects.
+func (r *Registry) Observe(id uint, observer Observer, conn *websocket.Conn) error {
+	s := r.Get(id)
+	if s == nil {
+		return ErrSessionNotFound
+	}
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return ErrSessionNotFound
+	}
+	c := s.join(conn, observer.UserID)
+	c.shareID = observer.ShareID
+	c.readOnly = observer.ReadOnly
+	s.observers[c] = struct{}{}
+	s.mu.Unlock()
+	r.event(id, c.event(models.SessionEventObserverAttached))
+
+	for {
+		_, msg, err := conn.ReadMessage()
+		if err != nil {
+			break
+		}
+		if c.framed {
+			err = r.handleFrame(s, c, msg)
+		} else if s.drives(c) {
+			err = s.write(msg)
 		}
-		_, err = ptmx.Write(msg)
 		if err != nil {
 			log.Println("PTY write error:", err)
+			break
+		}
+	}
+
+	c.close()
+	s.mu.Lock()
+	delete(s.observers, c)
+	var events []sessionEvent
+	if s.driver == c {
+		// Control goes back to the owner
+		events = s.handoff(s.conn)
+	}
+	s.mu.Unlock()
+	r.events(id, events)
+	r.event(id, c.event(models.SessionEventObserverDetached))
+	return nil
+}
+
+// DisconnectShare disconnects the observers of a session that joined through the share
+// link shareID, once it was revoked or expired.
+func (r *Registry) DisconnectShare(id, shareID uint) {
+	s := r.Get(id)
+	if s == nil {
+		return
+	}
+
+	var guests []*client
+	s.mu.Lock()
+	for c := range s.observers {
+		if c.shareID == shareID {
+			guests = append(guests, c)
+		}
+	}
+	s.mu.Unlock()
+
+	// Observe notices the closed connection and detaches them
+	for _, c := range guests {
+		c.close()
+	}
+}
+
+// Terminate kills the process behind a session and removes it from the registry.
+// The reason is passed on to OnStatusChange.
+func (r *Registry) Terminate(id uint, reason string) {
+	r.mu.Lock()
+	s, ok := r.sessions[id]
+	delete(r.sessions, id)
+	r.mu.Unlock()
+	if !ok {
+		return
+	}
+	r.terminate(s, reason)
+}
+
+// terminate kills the process behind a session that was removed from the registry.
+func (r *Registry) terminate(s *Session, reason string) {
+	id := s.ID
+	s.mu.Lock()
+	s.closed = true
+	if s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+	}
+	// Recording stops here, output still read from the dying process is left out
+	if s.recorder != nil {
+		if err := s.recorder.Close(); err != nil {
+			log.Printf("Failed to close recording of session %d: %v", id, err)
+		}
+		s.recorder = nil
+	}
+	var clients []*client
+	if s.conn != nil {
+		clients = append(clients, s.conn)
+		s.conn = nil
+	}
+	for c := range s.observers {
+		clients = append(clients, c)
+	}
+	s.mu.Unlock()
+
+	for _, c := range clients {
+		c.close()
+	}
+
+	s.proc.Close()
+	s.proc.Wait()
+
+	r.notify(id, models.SessionTerminated, reason)
+}
+
+// detach forgets conn and starts the grace period, unless a newer connection took over.
+func (r *Registry) detach(s *Session, c *client) {
+	s.mu.Lock()
+	if s.closed || s.conn != c {
+		s.mu.Unlock()
+		return
+	}
+	if s.driver == c {
+		s.handoff(nil)
+	}
+	s.conn = nil
+	r.startGracePeriod(s)
+	s.mu.Unlock()
+
+	r.notify(s.ID, models.SessionDisconnected, "")
+}
+
+// startGracePeriod terminates s once it went r.Timeout without an owner. The caller
+// holds s.mu.
+func (r *Registry) startGracePeriod(s *Session) {
+	var timer *time.Timer
+	timer = time.AfterFunc(r.Timeout, func() {
+		// Unless an owner attached since, or left again and started a new grace period
+		r.mu.Lock()
+		s.mu.Lock()
+		expired := r.sessions[s.ID] == s && s.conn == nil && s.timer == timer
+		if expired {
+			delete(r.sessions, s.ID)
+		}
+		s.mu.Unlock()
+		r.mu.Unlock()
+		if expired {
+			r.terminate(s, models.TerminatedDisconnected)
+		}
+	})
+	s.timer = timer
+}
+
+// pump reads from the PTY into the scrollback and the queues of the attached WebSockets,
+// if any, until the process exits.
+func (r *Registry) pump(s *Session) {
+	buf := make([]byte, 1024)
+	for {
+		n, err := s.proc.Read(buf)
+		if err != nil {
+			log.Println("PTY read error:", err)
+			r.Terminate(s.ID, models.TerminatedProcessExited)
 			return
 		}
+
+		s.recording(func(recorder *Recorder) error { return recorder.Output(buf[:n]) })
+
+		// Observers that don't keep up are disconnected, while the owner slows the terminal
+		// down to their pace, the way a terminal does. The owner is waited for after
+		// unlocking s.mu, so a slow owner doesn't hold up anyone else.
+		s.mu.Lock()
+		s.scrollback.Write(buf[:n])
+		owner := s.conn
+		for c := range s.observers {
+			c.sendOutput(buf[:n])
+		}
+		s.mu.Unlock()
+		if owner != nil {
+			owner.waitOutput(buf[:n])
+			r.touch(s)
+		}
+	}
+}
+
+// handleFrame acts on a frame received from c. Malformed frames are reported back to
+// the client; only failing to write to the PTY is returned as an error.
+func (r *Registry) handleFrame(s *Session, c *client, msg []byte) error {
+	frame, err := DecodeFrame(msg)
+	if err != nil {
+		c.sendError(err.Error())
+		return nil
+	}
+
+	switch frame.Op {
+	case OpData, OpResize, OpSignal:
+		if !s.drives(c) {
+			c.sendError("session is read-only until you are handed control")
+			return nil
+		}
+	}
+
+	switch frame.Op {
+	case OpData:
+		return s.write(frame.Payload)
+	case OpResize:
+		var resize ResizeMessage
+		if err := json.Unmarshal(frame.Payload, &resize); err != nil || resize.Cols == 0 || resize.Rows == 0 {
+			c.sendError("invalid resize message")
+			return nil
+		}
+		if err := s.proc.Resize(resize.Cols, resize.Rows); err != nil {
+			c.sendError("failed to resize terminal")
+		} else {
+			s.recording(func(recorder *Recorder) error { return recorder.Resize(resize.Cols, resize.Rows) })
+		}
+	case OpPing:
+		c.sendFrame(OpPong, frame.Payload)
+	case OpControl:
+		r.handleControl(s, c, frame.Payload)
+	case OpSignal:
+		var signal SignalMessage
+		if err := json.Unmarshal(frame.Payload, &signal); err != nil {
+			c.sendError("invalid signal message")
+			return nil
+		}
+		sig, ok := ParseSignal(signal.Signal)
+		if !ok {
+			c.sendError("unsupported signal " + signal.Signal)
+			return nil
+		}
+		if err := s.proc.Signal(sig); err == ErrUnsupportedSignal {
+			c.sendError(signal.Signal + " is not supported by this session")
+		} else if err != nil {
+			c.sendError("failed to send signal")
+		}
+	default:
+		c.sendError(fmt.Sprintf("unknown opcode %q", frame.Op))
+	}
+	return nil
+}
+
+// join sets up a client for a new connection and sends it its participant number and
+// the recent output, so the screen isn't blank. It must be called with s.mu held, which
+// keeps the pump from sending live output before the replay.
+func (s *Session) join(conn *websocket.Conn, userID uint) *client {
+	s.participants++
+	c := newClient(conn)
+	c.participant = s.participants
+	c.userID = userID
+
+	welcome := SessionControl{Type: ControlWelcome, Participant: c.participant}
+	if s.driver != nil {
+		welcome.Driver = s.driver.participant
+	}
+	c.sendJSON(OpControl, welcome)
+
+	if s.scrollback.Len() > 0 {
+		c.sendOutput(s.scrollback.Bytes())
+	}
+	return c
+}
+
+// write types p into the terminal.
+func (s *Session) write(p []byte) error {
+	if s.recordInput {
+		s.recording(func(recorder *Recorder) error { return recorder.Input(p) })
+	}
+	_, err := s.proc.Write(p)
+	return err
+}
+
+// recording records to the session's recorder with f, unless it isn't recorded or
+// recording stopped. f runs outside s.mu, so writing the file holds up nobody else; the
+// recorder has its own lock, and refuses writes once Terminate closed it.
+func (s *Session) recording(f func(*Recorder) error) {
+	s.mu.Lock()
+	recorder := s.recorder
+	s.mu.Unlock()
+	if recorder == nil {
+		return
+	}
+	if err := f(recorder); err != nil && err != ErrRecorderClosed {
+		log.Printf("Failed to record session %d: %v", s.ID, err)
+	}
+}
+
+// record starts recording a new session to a file named after its ID and start time.
+func (r *Registry) record(id uint, spec Spec) (*Recorder, error) {
+	if err := os.MkdirAll(r.RecordingsDir, 0o700); err != nil {
+		return nil, err
+	}
+
+	env := map[string]string{"SHELL": spec.Command[0]}
+	for _, kv := range spec.Env {
+		if value, ok := strings.CutPrefix(kv, "TERM="); ok {
+			env["TERM"] = value
+		}
+	}
+
+	path := filepath.Join(r.RecordingsDir, fmt.Sprintf("session-%d-%d.cast", id, time.Now().UnixNano()))
+	recorder, err := NewRecorder(path, RecordingHeader{Title: fmt.Sprintf("Session %d", id), Env: env})
+	if err != nil {
+		return nil, err
+	}
+	if r.OnRecording != nil {
+		r.OnRecording(id, path)
+	}
+	return recorder, nil
+}
+
+// touch reports activity on a session unless it was reported less than ActivityInterval ago.
+func (r *Registry) touch(s *Session) {
+	if r.OnActivity == nil {
+		return
+	}
+	now := time.Now().UnixNano()
+	last := s.lastActivity.Load()
+	if now-last < int64(r.ActivityInterval) || !s.lastActivity.CompareAndSwap(last, now) {
+		return
+	}
+	// Don't hold up the terminal while the activity is recorded
+	go r.OnActivity(s.ID)
+}
+
+func (r *Registry) notify(id uint, status, reason string) {
+	if r.OnStatusChange != nil {
+		r.OnStatusChange(id, status, reason)
+	}
+}
+
+func (r *Registry) event(id uint, e sessionEvent) {
+	if r.OnSessionEvent != nil {
+		r.OnSessionEvent(id, e.userID, e.shareID, e.event)
 	}
 }
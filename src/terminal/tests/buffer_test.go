@@ -0,0 +1,61 @@
+package terminal
+
+import (
+	"testing"
+	"time"
+
+	"let-me-in/models"
+	"let-me-in/terminal"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRingBufferKeepsMostRecentBytes(t *testing.T) {
+	testCases := []struct {
+		name   string
+		size   int
+		writes []string
+		want   string
+	}{
+		{name: "Empty", size: 4, writes: nil, want: ""},
+		{name: "Below capacity", size: 8, writes: []string{"abc", "de"}, want: "abcde"},
+		{name: "Exactly full", size: 4, writes: []string{"ab", "cd"}, want: "abcd"},
+		{name: "Wraps around", size: 4, writes: []string{"abc", "def"}, want: "cdef"},
+		{name: "Write larger than buffer", size: 4, writes: []string{"ab", "cdefgh"}, want: "efgh"},
+		{name: "Many small writes", size: 3, writes: []string{"a", "b", "c", "d", "e"}, want: "cde"},
+		{name: "Zero size", size: 0, writes: []string{"abc"}, want: ""},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			buffer := terminal.NewRingBuffer(tc.size)
+			for _, w := range tc.writes {
+				n, err := buffer.Write([]byte(w))
+				assert.NoError(t, err)
+				assert.Equal(t, len(w), n)
+			}
+			assert.Equal(t, tc.want, string(buffer.Bytes()))
+			assert.Equal(t, len(tc.want), buffer.Len())
+		})
+	}
+}
+
+func TestScrollbackReplayedOnReattach(t *testing.T) {
+	registry := terminal.NewRegistry(time.Minute)
+	defer registry.Terminate(1, models.TerminatedByUser)
+
+	_, err := registry.Start(1, models.BackendLocal, bash)
+	assert.NoError(t, err)
+	url := startServer(t, registry)
+
+	conn := dial(t, url)
+	conn.WriteMessage(websocket.TextMessage, []byte("echo scrollback-$((40+2))\n"))
+	readUntil(t, conn, "scrollback-42")
+	conn.Close()
+
+	// The output produced before the disconnect is the first thing the new connection sees
+	conn = dial(t, url)
+	defer conn.Close()
+	readUntil(t, conn, "scrollback-42")
+}
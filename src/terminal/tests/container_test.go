@@ -0,0 +1,199 @@
+package terminal
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"let-me-in/models"
+	"let-me-in/terminal"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeEngine implements the slice of the Docker Engine API used by the container backend.
+// Exec instances echo their input and exit once they receive a Ctrl-D.
+type fakeEngine struct {
+	mu       sync.Mutex
+	commands [][]string
+	resizes  []string
+	received []byte
+	exited   bool
+}
+
+func (e *fakeEngine) serve(t *testing.T) string {
+	dir, err := os.MkdirTemp("", "engine")
+	assert.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	socketPath := filepath.Join(dir, "engine.sock")
+	listener, err := net.Listen("unix", socketPath)
+	assert.NoError(t, err)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /containers/{id}/exec", e.createExec)
+	mux.HandleFunc("POST /exec/{id}/start", e.startExec)
+	mux.HandleFunc("POST /exec/{id}/resize", e.resizeExec)
+	mux.HandleFunc("GET /exec/{id}/json", e.inspectExec)
+
+	server := &http.Server{Handler: mux}
+	go server.Serve(listener)
+	t.Cleanup(func() { server.Close() })
+	return socketPath
+}
+
+func (e *fakeEngine) createExec(w http.ResponseWriter, r *http.Request) {
+	if r.PathValue("id") != "web-1" {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"message": "No such container: " + r.PathValue("id")})
+		return
+	}
+
+	var config struct {
+		Tty bool
+		Cmd []string
+	}
+	json.NewDecoder(r.Body).Decode(&config)
+	e.mu.Lock()
+	e.commands = append(e.commands, config.Cmd)
+	e.mu.Unlock()
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]string{"Id": "exec-1"})
+}
+
+func (e *fakeEngine) startExec(w http.ResponseWriter, r *http.Request) {
+	var config struct {
+		Detach bool
+		Tty    bool
+	}
+	json.NewDecoder(r.Body).Decode(&config)
+
+	conn, buf, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	buf.WriteString("HTTP/1.1 101 UPGRADED\r\nContent-Type: application/vnd.docker.raw-stream\r\nConnection: Upgrade\r\nUpgrade: tcp\r\n\r\n")
+	buf.Flush()
+
+	data := make([]byte, 1024)
+	for {
+		n, err := buf.Read(data)
+		if err != nil {
+			return
+		}
+		e.mu.Lock()
+		e.received = append(e.received, data[:n]...)
+		e.mu.Unlock()
+
+		for _, b := range data[:n] {
+			if b == 0x04 {
+				e.mu.Lock()
+				e.exited = true
+				e.mu.Unlock()
+				return
+			}
+		}
+		conn.Write(data[:n])
+	}
+}
+
+func (e *fakeEngine) resizeExec(w http.ResponseWriter, r *http.Request) {
+	e.mu.Lock()
+	e.resizes = append(e.resizes, r.URL.Query().Get("w")+"x"+r.URL.Query().Get("h"))
+	e.mu.Unlock()
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (e *fakeEngine) inspectExec(w http.ResponseWriter, r *http.Request) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	json.NewEncoder(w).Encode(map[string]interface{}{"Running": !e.exited, "ExitCode": 0})
+}
+
+func (e *fakeEngine) receivedBytes() []byte {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]byte(nil), e.received...)
+}
+
+func TestContainerBackendProcess(t *testing.T) {
+	engine := &fakeEngine{}
+	backend := terminal.NewContainerBackend(engine.serve(t))
+
+	proc, err := backend.Spawn(terminal.Spec{Command: []string{"bash", "-l"}, ContainerID: "web-1"})
+	assert.NoError(t, err)
+	assert.Equal(t, [][]string{{"bash", "-l"}}, engine.commands)
+
+	// Input reaches the exec instance and its output comes back
+	_, err = proc.Write([]byte("hello"))
+	assert.NoError(t, err)
+	output := make([]byte, 5)
+	_, err = proc.Read(output)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(output))
+
+	assert.NoError(t, proc.Resize(180, 50))
+	assert.Equal(t, []string{"180x50"}, engine.resizes)
+
+	// Signals are typed as control characters
+	assert.NoError(t, proc.Signal(syscall.SIGINT))
+	assert.Eventually(t, func() bool {
+		received := engine.receivedBytes()
+		return len(received) > 0 && received[len(received)-1] == 0x03
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, terminal.ErrUnsupportedSignal, proc.Signal(syscall.SIGTERM))
+
+	assert.NoError(t, proc.Close())
+	assert.NoError(t, proc.Wait())
+	assert.Eventually(t, func() bool {
+		engine.mu.Lock()
+		defer engine.mu.Unlock()
+		return engine.exited
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestContainerBackendUnknownContainer(t *testing.T) {
+	engine := &fakeEngine{}
+	backend := terminal.NewContainerBackend(engine.serve(t))
+
+	_, err := backend.Spawn(terminal.Spec{Command: []string{"bash"}, ContainerID: "missing"})
+	assert.EqualError(t, err, "container engine: No such container: missing")
+
+	_, err = backend.Spawn(terminal.Spec{Command: []string{"bash"}})
+	assert.Error(t, err)
+}
+
+func TestRegistryRunsSessionsOnContainerBackend(t *testing.T) {
+	engine := &fakeEngine{}
+	registry := terminal.NewRegistry(time.Minute)
+	registry.Backends[models.BackendContainer] = terminal.NewContainerBackend(engine.serve(t))
+	defer registry.Terminate(1, models.TerminatedByUser)
+
+	_, err := registry.Start(1, models.BackendContainer, terminal.Spec{Command: []string{"bash"}, ContainerID: "web-1"})
+	assert.NoError(t, err)
+
+	conn := dialFramed(t, startServer(t, registry))
+	defer conn.Close()
+
+	sendFrame(conn, terminal.OpData, "echo from container")
+	readFrameUntil(t, conn, terminal.OpData, "echo from container")
+
+	sendFrame(conn, terminal.OpResize, terminal.ResizeMessage{Cols: 120, Rows: 40})
+	assert.Eventually(t, func() bool {
+		engine.mu.Lock()
+		defer engine.mu.Unlock()
+		return len(engine.resizes) == 1 && engine.resizes[0] == "120x40"
+	}, time.Second, 10*time.Millisecond)
+
+	_, err = registry.Start(2, "unknown", terminal.Spec{Command: []string{"bash"}})
+	assert.Error(t, err)
+}
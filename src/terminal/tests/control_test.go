@@ -0,0 +1,171 @@
+package terminal
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"let-me-in/models"
+	"let-me-in/terminal"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+// readSessionControl reads frames until a control message of the given type arrives.
+func readSessionControl(t *testing.T, conn *websocket.Conn, controlType string) terminal.SessionControl {
+	for {
+		var control terminal.SessionControl
+		assert.NoError(t, json.Unmarshal(readFrameUntil(t, conn, terminal.OpControl, "").Payload, &control))
+		if control.Type == controlType {
+			return control
+		}
+	}
+}
+
+// readDriver reads control messages until participant is announced as the driver.
+func readDriver(t *testing.T, conn *websocket.Conn, participant uint) terminal.SessionControl {
+	for {
+		if driver := readSessionControl(t, conn, terminal.ControlDriver); driver.Participant == participant {
+			return driver
+		}
+	}
+}
+
+func TestDriverHandoff(t *testing.T) {
+	events := &eventRecorder{}
+	registry := terminal.NewRegistry(time.Minute)
+	registry.OnSessionEvent = events.record
+	defer registry.Terminate(1, models.TerminatedByUser)
+	_, err := registry.Start(1, models.BackendLocal, bash)
+	assert.NoError(t, err)
+
+	owner := dialFramed(t, startServer(t, registry))
+	defer owner.Close()
+	ownerWelcome := readSessionControl(t, owner, terminal.ControlWelcome)
+	assert.Equal(t, terminal.SessionControl{Type: terminal.ControlDriver, Participant: ownerWelcome.Participant, UserID: 1},
+		readSessionControl(t, owner, terminal.ControlDriver))
+
+	guest := dialFramed(t, startObserverServer(t, registry, 7))
+	defer guest.Close()
+	guestWelcome := readSessionControl(t, guest, terminal.ControlWelcome)
+	assert.Equal(t, ownerWelcome.Participant, guestWelcome.Driver)
+
+	// Asking for control lets the owner know
+	sendFrame(guest, terminal.OpControl, terminal.SessionControl{Type: terminal.ControlRequest})
+	requested := readSessionControl(t, owner, terminal.ControlRequested)
+	assert.Equal(t, guestWelcome.Participant, requested.Participant)
+	assert.Equal(t, uint(7), requested.UserID)
+
+	// Only the owner or the driver may hand control over
+	sendFrame(guest, terminal.OpControl, terminal.SessionControl{Type: terminal.ControlGrant, Participant: guestWelcome.Participant})
+	assert.Contains(t, string(readFrameUntil(t, guest, terminal.OpError, "").Payload), "only the owner or the driver")
+
+	sendFrame(owner, terminal.OpControl, terminal.SessionControl{Type: terminal.ControlGrant, Participant: guestWelcome.Participant})
+	for _, conn := range []*websocket.Conn{owner, guest} {
+		assert.Equal(t, uint(7), readDriver(t, conn, guestWelcome.Participant).UserID)
+	}
+
+	// Now the guest types and the owner watches
+	sendFrame(guest, terminal.OpData, "echo guest-$((1+1))\n")
+	readFrameUntil(t, owner, terminal.OpData, "guest-2")
+	sendFrame(owner, terminal.OpData, "echo owner\n")
+	assert.Contains(t, string(readFrameUntil(t, owner, terminal.OpError, "").Payload), "read-only")
+
+	// The owner takes control back
+	sendFrame(owner, terminal.OpControl, terminal.SessionControl{Type: terminal.ControlRevoke})
+	for _, conn := range []*websocket.Conn{owner, guest} {
+		readDriver(t, conn, ownerWelcome.Participant)
+	}
+	sendFrame(guest, terminal.OpData, "echo guest\n")
+	assert.Contains(t, string(readFrameUntil(t, guest, terminal.OpError, "").Payload), "read-only")
+	sendFrame(owner, terminal.OpData, "echo owner-$((2+2))\n")
+	readFrameUntil(t, guest, terminal.OpData, "owner-4")
+
+	assert.Equal(t, []string{
+		"7:" + models.SessionEventObserverAttached,
+		"7:" + models.SessionEventControlGranted,
+		"7:" + models.SessionEventControlRevoked,
+	}, events.list())
+}
+
+func TestControlReturnsToOwnerWhenDriverLeaves(t *testing.T) {
+	events := &eventRecorder{}
+	registry := terminal.NewRegistry(time.Minute)
+	registry.OnSessionEvent = events.record
+	defer registry.Terminate(1, models.TerminatedByUser)
+	_, err := registry.Start(1, models.BackendLocal, bash)
+	assert.NoError(t, err)
+
+	owner := dialFramed(t, startServer(t, registry))
+	defer owner.Close()
+	ownerWelcome := readSessionControl(t, owner, terminal.ControlWelcome)
+
+	observerURL := startObserverServer(t, registry, 7)
+	first := dialFramed(t, observerURL)
+	defer first.Close()
+	firstWelcome := readSessionControl(t, first, terminal.ControlWelcome)
+	second := dialFramed(t, observerURL)
+	defer second.Close()
+	secondWelcome := readSessionControl(t, second, terminal.ControlWelcome)
+
+	// Control can be passed along by whoever drives
+	sendFrame(owner, terminal.OpControl, terminal.SessionControl{Type: terminal.ControlGrant, Participant: firstWelcome.Participant})
+	readDriver(t, first, firstWelcome.Participant)
+	sendFrame(first, terminal.OpControl, terminal.SessionControl{Type: terminal.ControlGrant, Participant: secondWelcome.Participant})
+	readDriver(t, second, secondWelcome.Participant)
+
+	second.Close()
+	readDriver(t, first, ownerWelcome.Participant)
+	sendFrame(owner, terminal.OpData, "echo owner-$((2+2))\n")
+	readFrameUntil(t, owner, terminal.OpData, "owner-4")
+
+	assert.Eventually(t, func() bool { return len(events.list()) == 7 }, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, []string{
+		"7:" + models.SessionEventObserverAttached,
+		"7:" + models.SessionEventObserverAttached,
+		"7:" + models.SessionEventControlGranted,
+		"7:" + models.SessionEventControlRevoked,
+		"7:" + models.SessionEventControlGranted,
+		"7:" + models.SessionEventControlRevoked,
+		"7:" + models.SessionEventObserverDetached,
+	}, events.list())
+}
+
+func TestReadOnlyObserversCannotTakeControl(t *testing.T) {
+	events := &eventRecorder{}
+	registry := terminal.NewRegistry(time.Minute)
+	registry.OnSessionEvent = events.record
+	defer registry.Terminate(1, models.TerminatedByUser)
+	_, err := registry.Start(1, models.BackendLocal, bash)
+	assert.NoError(t, err)
+
+	owner := dialFramed(t, startServer(t, registry))
+	defer owner.Close()
+	readSessionControl(t, owner, terminal.ControlWelcome)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		registry.Observe(1, terminal.Observer{ShareID: 3, ReadOnly: true}, conn)
+	}))
+	defer server.Close()
+	guest := dialFramed(t, "ws"+strings.TrimPrefix(server.URL, "http"))
+	defer guest.Close()
+	guestWelcome := readSessionControl(t, guest, terminal.ControlWelcome)
+
+	sendFrame(guest, terminal.OpControl, terminal.SessionControl{Type: terminal.ControlRequest})
+	assert.Contains(t, string(readFrameUntil(t, guest, terminal.OpError, "").Payload), "can't take control")
+
+	sendFrame(owner, terminal.OpControl, terminal.SessionControl{Type: terminal.ControlGrant, Participant: guestWelcome.Participant})
+	assert.Contains(t, string(readFrameUntil(t, owner, terminal.OpError, "").Payload), "participant is read-only")
+
+	// Guests show up in the audit trail by their share link
+	assert.Equal(t, []string{"share 3:" + models.SessionEventObserverAttached}, events.list())
+}
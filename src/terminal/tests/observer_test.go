@@ -0,0 +1,214 @@
+package terminal
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"let-me-in/models"
+	"let-me-in/terminal"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+// startObserverServer serves a WebSocket endpoint that attaches every connection to
+// session 1 of registry as an observer acting for userID.
+func startObserverServer(t *testing.T, registry *terminal.Registry, userID uint) string {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		registry.Observe(1, terminal.Observer{UserID: userID}, conn)
+	}))
+	t.Cleanup(server.Close)
+	return "ws" + strings.TrimPrefix(server.URL, "http")
+}
+
+type eventRecorder struct {
+	mu     sync.Mutex
+	events []string
+}
+
+func (e *eventRecorder) record(id, userID, shareID uint, event string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if shareID != 0 {
+		e.events = append(e.events, fmt.Sprintf("share %d:%s", shareID, event))
+		return
+	}
+	e.events = append(e.events, fmt.Sprintf("%d:%s", userID, event))
+}
+
+func (e *eventRecorder) list() []string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]string(nil), e.events...)
+}
+
+func TestObserversSeeOutputButCannotWrite(t *testing.T) {
+	events := &eventRecorder{}
+	registry := terminal.NewRegistry(time.Minute)
+	registry.OnSessionEvent = events.record
+	defer registry.Terminate(1, models.TerminatedByUser)
+	_, err := registry.Start(1, models.BackendLocal, bash)
+	assert.NoError(t, err)
+
+	owner := dialFramed(t, startServer(t, registry))
+	defer owner.Close()
+	sendFrame(owner, terminal.OpData, "echo before-$((1+1))\n")
+	readFrameUntil(t, owner, terminal.OpData, "before-2")
+
+	// Observers get the scrollback, then live output
+	observerURL := startObserverServer(t, registry, 7)
+	first := dialFramed(t, observerURL)
+	defer first.Close()
+	second := dial(t, observerURL)
+	defer second.Close()
+	readFrameUntil(t, first, terminal.OpData, "before-2")
+	readUntil(t, second, "before-2")
+
+	sendFrame(owner, terminal.OpData, "echo live-$((2+2))\n")
+	readFrameUntil(t, first, terminal.OpData, "live-4")
+	readUntil(t, second, "live-4")
+
+	// Input from observers never reaches the terminal
+	sendFrame(first, terminal.OpData, "echo observer-$((3+3))\n")
+	assert.Contains(t, string(readFrameUntil(t, first, terminal.OpError, "").Payload), "read-only")
+	sendFrame(first, terminal.OpResize, terminal.ResizeMessage{Cols: 10, Rows: 10})
+	assert.Contains(t, string(readFrameUntil(t, first, terminal.OpError, "").Payload), "read-only")
+	second.WriteMessage(websocket.TextMessage, []byte("echo raw-$((4+4))\n"))
+	sendFrame(first, terminal.OpPing, "still here")
+	readFrameUntil(t, first, terminal.OpPong, "still here")
+
+	sendFrame(owner, terminal.OpData, "stty size; echo done-$((5+5))\n")
+	output := string(readFrameUntil(t, owner, terminal.OpData, "done-10").Payload)
+	assert.NotContains(t, output, "observer-6")
+	assert.NotContains(t, output, "raw-8")
+	assert.NotContains(t, output, "10 10")
+
+	first.Close()
+	assert.Eventually(t, func() bool { return len(events.list()) == 3 }, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, []string{
+		"7:" + models.SessionEventObserverAttached,
+		"7:" + models.SessionEventObserverAttached,
+		"7:" + models.SessionEventObserverDetached,
+	}, events.list())
+}
+
+func TestObserverThatStopsReadingIsDisconnected(t *testing.T) {
+	registry := terminal.NewRegistry(time.Minute)
+	defer registry.Terminate(1, models.TerminatedByUser)
+	_, err := registry.Start(1, models.BackendLocal, bash)
+	assert.NoError(t, err)
+
+	owner := dialFramed(t, startServer(t, registry))
+	defer owner.Close()
+	readFrameUntil(t, owner, terminal.OpControl, "")
+
+	// Never reads
+	observer := dialFramed(t, startObserverServer(t, registry, 7))
+	defer observer.Close()
+
+	// Far more output than the socket buffers and the queue hold, the owner still gets it all
+	sendFrame(owner, terminal.OpData, "seq 1 1000000; echo flood-$((6+6))\n")
+	owner.SetReadDeadline(time.Now().Add(30 * time.Second))
+	var tail string
+	for !strings.Contains(tail, "flood-12") {
+		_, msg, err := owner.ReadMessage()
+		if !assert.NoError(t, err) {
+			return
+		}
+		tail = tail[max(0, len(tail)-32):] + string(msg)
+	}
+
+	// The observer was let go, and gets the end of its stream
+	observer.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		if _, _, err := observer.ReadMessage(); err != nil {
+			assert.NotContains(t, err.Error(), "timeout")
+			break
+		}
+	}
+}
+
+func TestObserversDoNotKeepSessionAlive(t *testing.T) {
+	registry := terminal.NewRegistry(200 * time.Millisecond)
+	defer registry.Terminate(1, models.TerminatedByUser)
+	_, err := registry.Start(1, models.BackendLocal, bash)
+	assert.NoError(t, err)
+
+	observer := dialFramed(t, startObserverServer(t, registry, 7))
+	defer observer.Close()
+
+	// The observer is disconnected once the session times out without its owner
+	observer.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		if _, _, err := observer.ReadMessage(); err != nil {
+			break
+		}
+	}
+	assert.Nil(t, registry.Get(1))
+}
+
+func TestObserveRequiresRunningSession(t *testing.T) {
+	registry := terminal.NewRegistry(time.Minute)
+	assert.Equal(t, terminal.ErrSessionNotFound, registry.Observe(1, terminal.Observer{UserID: 7}, nil))
+}
+
+func TestDisconnectShare(t *testing.T) {
+	events := &eventRecorder{}
+	registry := terminal.NewRegistry(time.Minute)
+	registry.OnSessionEvent = events.record
+	defer registry.Terminate(1, models.TerminatedByUser)
+	_, err := registry.Start(1, models.BackendLocal, bash)
+	assert.NoError(t, err)
+
+	owner := dialFramed(t, startServer(t, registry))
+	defer owner.Close()
+
+	// Guests connect through the share link in the URL
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		var shareID uint
+		fmt.Sscan(r.URL.Query().Get("share"), &shareID)
+		registry.Observe(1, terminal.Observer{ShareID: shareID, ReadOnly: true}, conn)
+	}))
+	defer server.Close()
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+	revoked := dialFramed(t, url+"?share=3")
+	defer revoked.Close()
+	other := dialFramed(t, url+"?share=4")
+	defer other.Close()
+	observer := dialFramed(t, startObserverServer(t, registry, 7))
+	defer observer.Close()
+	assert.Eventually(t, func() bool { return len(events.list()) == 3 }, 5*time.Second, 10*time.Millisecond)
+
+	registry.DisconnectShare(1, 3)
+	revoked.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		if _, _, err := revoked.ReadMessage(); err != nil {
+			assert.NotContains(t, err.Error(), "timeout")
+			break
+		}
+	}
+	assert.Eventually(t, func() bool {
+		list := events.list()
+		return list[len(list)-1] == "share 3:"+models.SessionEventObserverDetached
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// Everyone else keeps watching
+	sendFrame(owner, terminal.OpData, "echo still-$((3+3))\n")
+	readFrameUntil(t, other, terminal.OpData, "still-6")
+	readFrameUntil(t, observer, terminal.OpData, "still-6")
+}
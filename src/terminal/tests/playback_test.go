@@ -0,0 +1,168 @@
+package terminal
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"let-me-in/terminal"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+const testCast = `{"version": 2, "width": 80, "height": 24, "timestamp": 1700000000}
+[0.1, "o", "first "]
+[0.2, "r", "100x30"]
+[0.5, "o", "second"]
+[0.6, "i", "typed"]
+[1.0, "o", " third"]
+`
+
+// startPlayback serves the test recording, starting at the given speed and position.
+func startPlayback(t *testing.T, speed, at float64) *websocket.Conn {
+	path := filepath.Join(t.TempDir(), "session.cast")
+	assert.NoError(t, os.WriteFile(path, []byte(testCast), 0600))
+
+	recording, err := terminal.LoadRecording(path)
+	assert.NoError(t, err)
+	assert.Equal(t, 1.0, recording.Duration())
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		recording.Play(conn, speed, at)
+	}))
+	t.Cleanup(server.Close)
+
+	conn := dialFramed(t, "ws"+strings.TrimPrefix(server.URL, "http"))
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func readFrame(t *testing.T, conn *websocket.Conn) terminal.Frame {
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, msg, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatalf("failed to read frame: %v", err)
+	}
+	frame, err := terminal.DecodeFrame(msg)
+	assert.NoError(t, err)
+	return frame
+}
+
+func readControl(t *testing.T, conn *websocket.Conn) terminal.PlaybackControl {
+	var control terminal.PlaybackControl
+	assert.NoError(t, json.Unmarshal(readFrameUntil(t, conn, terminal.OpControl, "").Payload, &control))
+	return control
+}
+
+func assertResize(t *testing.T, frame terminal.Frame, cols, rows uint16) {
+	assert.Equal(t, terminal.OpResize, frame.Op)
+	var resize terminal.ResizeMessage
+	assert.NoError(t, json.Unmarshal(frame.Payload, &resize))
+	assert.Equal(t, terminal.ResizeMessage{Cols: cols, Rows: rows}, resize)
+}
+
+func TestPlaybackReplaysOutputAndResizes(t *testing.T) {
+	start := time.Now()
+	conn := startPlayback(t, 4, 0)
+
+	assertResize(t, readFrame(t, conn), 80, 24)
+	assertResize(t, readFrame(t, conn), 80, 24)
+	assert.Equal(t, "\x1bc", string(readFrame(t, conn).Payload))
+	assert.Equal(t, "first ", string(readFrame(t, conn).Payload))
+	assertResize(t, readFrame(t, conn), 100, 30)
+	assert.Equal(t, "second", string(readFrame(t, conn).Payload))
+	// Input events are not replayed
+	assert.Equal(t, " third", string(readFrame(t, conn).Payload))
+
+	assert.Equal(t, terminal.PlaybackControl{Type: terminal.ControlEnd, At: 1}, readControl(t, conn))
+	elapsed := time.Since(start)
+	assert.GreaterOrEqual(t, elapsed, 250*time.Millisecond)
+	assert.Less(t, elapsed, time.Second)
+}
+
+func TestPlaybackSeek(t *testing.T) {
+	conn := startPlayback(t, 1, 0.7)
+
+	assertResize(t, readFrame(t, conn), 80, 24)
+	assertResize(t, readFrame(t, conn), 100, 30)
+	assert.Equal(t, "\x1bcfirst second", string(readFrame(t, conn).Payload))
+
+	// Seeking back redraws the screen as it was at that time
+	sendFrame(conn, terminal.OpControl, terminal.PlaybackControl{Type: terminal.ControlSeek, At: 0.15})
+	assertResize(t, readFrame(t, conn), 80, 24)
+	assert.Equal(t, "\x1bcfirst ", string(readFrame(t, conn).Payload))
+	status := readControl(t, conn)
+	assert.Equal(t, terminal.ControlStatus, status.Type)
+	assert.Equal(t, 0.15, status.At)
+	assert.Equal(t, 1.0, status.Duration)
+}
+
+func TestPlaybackSeekPastTheEnd(t *testing.T) {
+	conn := startPlayback(t, 1, 5)
+
+	assert.Equal(t, "\x1bcfirst second third", string(readFrameUntil(t, conn, terminal.OpData, "").Payload))
+	assert.Equal(t, terminal.PlaybackControl{Type: terminal.ControlEnd, At: 1}, readControl(t, conn))
+
+	sendFrame(conn, terminal.OpControl, terminal.PlaybackControl{Type: terminal.ControlSeek, At: 0.3})
+	readFrameUntil(t, conn, terminal.OpData, "\x1bcfirst ")
+	assert.Equal(t, terminal.ControlStatus, readControl(t, conn).Type)
+
+	// Seeking past the end again ends the playback again, without waiting for the events
+	// in between
+	sendFrame(conn, terminal.OpControl, terminal.PlaybackControl{Type: terminal.ControlSeek, At: 2})
+	readFrameUntil(t, conn, terminal.OpData, "\x1bcfirst second third")
+	assert.Equal(t, terminal.PlaybackControl{Type: terminal.ControlEnd, At: 1}, readControl(t, conn))
+	status := readControl(t, conn)
+	assert.Equal(t, terminal.ControlStatus, status.Type)
+	assert.Equal(t, 1.0, status.At)
+}
+
+func TestPlaybackPause(t *testing.T) {
+	conn := startPlayback(t, 1, 0.5)
+	readFrameUntil(t, conn, terminal.OpData, "second")
+	start := time.Now()
+
+	sendFrame(conn, terminal.OpControl, terminal.PlaybackControl{Type: terminal.ControlPause})
+	assert.True(t, readControl(t, conn).Paused)
+	time.Sleep(700 * time.Millisecond)
+
+	sendFrame(conn, terminal.OpControl, terminal.PlaybackControl{Type: terminal.ControlResume})
+	assert.False(t, readControl(t, conn).Paused)
+
+	// The remaining half second is played after the pause
+	readFrameUntil(t, conn, terminal.OpData, " third")
+	assert.GreaterOrEqual(t, time.Since(start), 1100*time.Millisecond)
+}
+
+func TestPlaybackSpeed(t *testing.T) {
+	conn := startPlayback(t, 1, 0.5)
+	readFrameUntil(t, conn, terminal.OpData, "second")
+
+	sendFrame(conn, terminal.OpControl, terminal.PlaybackControl{Type: terminal.ControlSpeed, Speed: 100})
+	assert.Contains(t, string(readFrameUntil(t, conn, terminal.OpError, "").Payload), "speed must be")
+
+	sendFrame(conn, terminal.OpControl, terminal.PlaybackControl{Type: terminal.ControlSpeed, Speed: 10})
+	assert.Equal(t, 10.0, readControl(t, conn).Speed)
+	start := time.Now()
+	readFrameUntil(t, conn, terminal.OpData, " third")
+	assert.Less(t, time.Since(start), 300*time.Millisecond)
+}
+
+func TestPlaybackRejectsInput(t *testing.T) {
+	conn := startPlayback(t, 1, 1)
+	readFrameUntil(t, conn, terminal.OpData, "third")
+
+	sendFrame(conn, terminal.OpData, "ls\n")
+	assert.Contains(t, string(readFrameUntil(t, conn, terminal.OpError, "").Payload), "only accepts control frames")
+}
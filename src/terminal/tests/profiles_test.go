@@ -0,0 +1,94 @@
+package terminal
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"let-me-in/models"
+	"let-me-in/terminal"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+func writeProfiles(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "profiles.json")
+	assert.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+	return path
+}
+
+func TestLoadProfiles(t *testing.T) {
+	path := writeProfiles(t, `{
+		"bash": {"command": ["bash"]},
+		"rails": {"command": ["bin/rails", "console"], "dir": "/srv/app", "term": "xterm"}
+	}`)
+
+	profiles, err := terminal.LoadProfiles(path)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"bash", "rails"}, profiles.Names())
+	assert.Equal(t, "xterm-256color", profiles["bash"].Term)
+	assert.Equal(t, "xterm", profiles["rails"].Term)
+	assert.Equal(t, "/srv/app", profiles["rails"].Dir)
+}
+
+func TestLoadProfilesRejectsInvalidProfiles(t *testing.T) {
+	testCases := []struct {
+		name    string
+		content string
+	}{
+		{name: "Malformed JSON", content: `{"bash": `},
+		{name: "Missing command", content: `{"bash": {"dir": "/tmp"}}`},
+		{name: "Empty program", content: `{"bash": {"command": [""]}}`},
+		{name: "Invalid name", content: `{"../bash": {"command": ["bash"]}}`},
+		{name: "Uppercase name", content: `{"Bash": {"command": ["bash"]}}`},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := terminal.LoadProfiles(writeProfiles(t, tc.content))
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestProfileSpecEnvironment(t *testing.T) {
+	t.Setenv("PROFILE_ALLOWED", "passed")
+	t.Setenv("PROFILE_SECRET", "hidden")
+	t.Setenv("PROFILE_OVERRIDDEN", "server")
+
+	profile := terminal.Profile{
+		Command:  []string{"bash"},
+		Dir:      "/tmp",
+		EnvAllow: []string{"PROFILE_ALLOWED", "PROFILE_OVERRIDDEN", "PROFILE_UNSET"},
+		Env:      map[string]string{"PROFILE_OVERRIDDEN": "profile"},
+		Term:     "vt100",
+	}
+
+	spec := profile.Spec("web-1")
+	assert.Equal(t, []string{"bash"}, spec.Command)
+	assert.Equal(t, "/tmp", spec.Dir)
+	assert.Equal(t, "web-1", spec.ContainerID)
+	assert.Equal(t, []string{"PROFILE_ALLOWED=passed", "PROFILE_OVERRIDDEN=profile", "TERM=vt100"}, spec.Env)
+}
+
+func TestLocalBackendAppliesProfile(t *testing.T) {
+	t.Setenv("PROFILE_SECRET", "hidden")
+	dir := t.TempDir()
+
+	profile := terminal.DefaultProfiles()[terminal.DefaultProfile]
+	profile.Dir = dir
+	profile.Env = map[string]string{"GREETING": "hello-profile"}
+
+	registry := terminal.NewRegistry(time.Minute)
+	defer registry.Terminate(1, models.TerminatedByUser)
+	_, err := registry.Start(1, models.BackendLocal, profile.Spec(""))
+	assert.NoError(t, err)
+
+	conn := dial(t, startServer(t, registry))
+	defer conn.Close()
+
+	conn.WriteMessage(websocket.TextMessage, []byte("echo \"$GREETING:$TERM:${PROFILE_SECRET:-unset}:$(pwd)\"\n"))
+	readUntil(t, conn, "hello-profile:xterm-256color:unset:"+dir+"\r\n")
+}
@@ -0,0 +1,145 @@
+package terminal
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"let-me-in/models"
+	"let-me-in/terminal"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+func dialFramed(t *testing.T, url string) *websocket.Conn {
+	dialer := websocket.Dialer{Subprotocols: []string{terminal.Subprotocol}}
+	conn, _, err := dialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	assert.Equal(t, terminal.Subprotocol, conn.Subprotocol())
+	return conn
+}
+
+func sendFrame(conn *websocket.Conn, op byte, payload interface{}) {
+	var data []byte
+	switch p := payload.(type) {
+	case string:
+		data = []byte(p)
+	default:
+		data, _ = json.Marshal(p)
+	}
+	conn.WriteMessage(websocket.BinaryMessage, terminal.EncodeFrame(op, data))
+}
+
+// readFrameUntil reads frames until one with opcode op arrives, collecting the output seen
+// on the way, and fails if want is not part of that output or payload.
+func readFrameUntil(t *testing.T, conn *websocket.Conn, op byte, want string) terminal.Frame {
+	var output strings.Builder
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		msgType, msg, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("did not receive %q, got %q: %v", want, output.String(), err)
+		}
+		assert.Equal(t, websocket.BinaryMessage, msgType)
+		frame, err := terminal.DecodeFrame(msg)
+		assert.NoError(t, err)
+		output.Write(frame.Payload)
+		if frame.Op == op && strings.Contains(output.String(), want) {
+			return frame
+		}
+	}
+}
+
+func TestResizeFrame(t *testing.T) {
+	registry := terminal.NewRegistry(time.Minute)
+	defer registry.Terminate(1, models.TerminatedByUser)
+	_, err := registry.Start(1, models.BackendLocal, bash)
+	assert.NoError(t, err)
+
+	conn := dialFramed(t, startServer(t, registry))
+	defer conn.Close()
+
+	sendFrame(conn, terminal.OpResize, terminal.ResizeMessage{Cols: 180, Rows: 50})
+	sendFrame(conn, terminal.OpData, "stty size\n")
+	readFrameUntil(t, conn, terminal.OpData, "50 180\r\n")
+}
+
+func TestPingFrame(t *testing.T) {
+	registry := terminal.NewRegistry(time.Minute)
+	defer registry.Terminate(1, models.TerminatedByUser)
+	_, err := registry.Start(1, models.BackendLocal, bash)
+	assert.NoError(t, err)
+
+	conn := dialFramed(t, startServer(t, registry))
+	defer conn.Close()
+
+	sendFrame(conn, terminal.OpPing, "hello")
+	frame := readFrameUntil(t, conn, terminal.OpPong, "")
+	assert.Equal(t, "hello", string(frame.Payload))
+}
+
+func TestSignalFrameInterruptsForegroundProcess(t *testing.T) {
+	registry := terminal.NewRegistry(time.Minute)
+	defer registry.Terminate(1, models.TerminatedByUser)
+	_, err := registry.Start(1, models.BackendLocal, bash)
+	assert.NoError(t, err)
+
+	conn := dialFramed(t, startServer(t, registry))
+	defer conn.Close()
+
+	sendFrame(conn, terminal.OpData, "echo ready-$((1+1))\n")
+	readFrameUntil(t, conn, terminal.OpData, "ready-2")
+
+	sendFrame(conn, terminal.OpData, "sleep 30\n")
+	time.Sleep(300 * time.Millisecond)
+	sendFrame(conn, terminal.OpSignal, terminal.SignalMessage{Signal: "SIGINT"})
+
+	// The shell only gets to this command if sleep was interrupted
+	sendFrame(conn, terminal.OpData, "echo after-$((1+1))\n")
+	readFrameUntil(t, conn, terminal.OpData, "after-2")
+}
+
+func TestInvalidFramesReportErrors(t *testing.T) {
+	registry := terminal.NewRegistry(time.Minute)
+	defer registry.Terminate(1, models.TerminatedByUser)
+	_, err := registry.Start(1, models.BackendLocal, bash)
+	assert.NoError(t, err)
+
+	conn := dialFramed(t, startServer(t, registry))
+	defer conn.Close()
+
+	testCases := []struct {
+		name    string
+		op      byte
+		payload interface{}
+		want    string
+	}{
+		{name: "Unknown opcode", op: 'z', payload: "", want: "unknown opcode"},
+		{name: "Bad resize", op: terminal.OpResize, payload: "not json", want: "invalid resize message"},
+		{name: "Unknown signal", op: terminal.OpSignal, payload: terminal.SignalMessage{Signal: "SIGFOO"}, want: "unsupported signal"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			sendFrame(conn, tc.op, tc.payload)
+			frame := readFrameUntil(t, conn, terminal.OpError, tc.want)
+
+			var message terminal.ErrorMessage
+			assert.NoError(t, json.Unmarshal(frame.Payload, &message))
+			assert.Contains(t, message.Message, tc.want)
+		})
+	}
+}
+
+func TestParseSignal(t *testing.T) {
+	for _, name := range []string{"SIGINT", "sigint", "INT", "int"} {
+		_, ok := terminal.ParseSignal(name)
+		assert.True(t, ok, name)
+	}
+	_, ok := terminal.ParseSignal("SIGSEGV")
+	assert.False(t, ok)
+}
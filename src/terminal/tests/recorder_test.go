@@ -0,0 +1,129 @@
+package terminal
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"let-me-in/models"
+	"let-me-in/terminal"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type castEvent struct {
+	Time float64
+	Type string
+	Data string
+}
+
+// readCast parses an asciicast v2 file.
+func readCast(t *testing.T, path string) (terminal.RecordingHeader, []castEvent) {
+	file, err := os.Open(path)
+	assert.NoError(t, err)
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	assert.True(t, scanner.Scan())
+	var header terminal.RecordingHeader
+	assert.NoError(t, json.Unmarshal(scanner.Bytes(), &header))
+
+	var events []castEvent
+	for scanner.Scan() {
+		var raw []interface{}
+		assert.NoError(t, json.Unmarshal(scanner.Bytes(), &raw))
+		assert.Len(t, raw, 3)
+		events = append(events, castEvent{Time: raw[0].(float64), Type: raw[1].(string), Data: raw[2].(string)})
+	}
+	return header, events
+}
+
+func TestRecorderWritesAsciicast(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "session.cast")
+	recorder, err := terminal.NewRecorder(path, terminal.RecordingHeader{Title: "Session 1"})
+	assert.NoError(t, err)
+
+	recorder.Output([]byte("hello "))
+	// "é" split across two reads is written once complete
+	recorder.Output([]byte{0xc3})
+	recorder.Output([]byte{0xa9, '!'})
+	recorder.Input([]byte("ls\r"))
+	recorder.Resize(180, 50)
+	assert.NoError(t, recorder.Close())
+
+	header, events := readCast(t, path)
+	assert.Equal(t, 2, header.Version)
+	assert.Equal(t, 80, header.Width)
+	assert.Equal(t, 24, header.Height)
+	assert.Equal(t, "Session 1", header.Title)
+	assert.NotZero(t, header.Timestamp)
+
+	assert.Equal(t, []castEvent{
+		{Type: "o", Data: "hello "},
+		{Type: "o", Data: "é!"},
+		{Type: "i", Data: "ls\r"},
+		{Type: "r", Data: "180x50"},
+	}, withoutTimes(events))
+
+	for i := 1; i < len(events); i++ {
+		assert.GreaterOrEqual(t, events[i].Time, events[i-1].Time)
+	}
+}
+
+func TestRecorderRefusesToOverwrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "session.cast")
+	assert.NoError(t, os.WriteFile(path, []byte("existing"), 0o600))
+
+	_, err := terminal.NewRecorder(path, terminal.RecordingHeader{})
+	assert.Error(t, err)
+}
+
+func TestRegistryRecordsSessions(t *testing.T) {
+	registry := terminal.NewRegistry(time.Minute)
+	registry.RecordingsDir = t.TempDir()
+	registry.RecordInput = true
+	var recording string
+	registry.OnRecording = func(id uint, path string) { recording = path }
+
+	_, err := registry.Start(1, models.BackendLocal, bash)
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(recording, registry.RecordingsDir))
+
+	conn := dialFramed(t, startServer(t, registry))
+	sendFrame(conn, terminal.OpResize, terminal.ResizeMessage{Cols: 100, Rows: 30})
+	sendFrame(conn, terminal.OpData, "echo recorded-$((6*7))\n")
+	readFrameUntil(t, conn, terminal.OpData, "recorded-42")
+	conn.Close()
+	registry.Terminate(1, models.TerminatedByUser)
+
+	header, events := readCast(t, recording)
+	assert.Equal(t, "xterm-256color", header.Env["TERM"])
+
+	var output, input strings.Builder
+	var resizes []string
+	for _, event := range events {
+		switch event.Type {
+		case "o":
+			output.WriteString(event.Data)
+		case "i":
+			input.WriteString(event.Data)
+		case "r":
+			resizes = append(resizes, event.Data)
+		}
+	}
+	assert.Contains(t, output.String(), "recorded-42")
+	assert.Equal(t, "echo recorded-$((6*7))\n", input.String())
+	assert.Equal(t, []string{"100x30"}, resizes)
+}
+
+func withoutTimes(events []castEvent) []castEvent {
+	out := make([]castEvent, len(events))
+	for i, event := range events {
+		out[i] = castEvent{Type: event.Type, Data: event.Data}
+	}
+	return out
+}
@@ -0,0 +1,218 @@
+package terminal
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"let-me-in/models"
+	"let-me-in/terminal"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+var upgrader = websocket.Upgrader{Subprotocols: []string{terminal.Subprotocol}}
+
+var bash = terminal.DefaultProfiles()[terminal.DefaultProfile].Spec("")
+
+// startServer serves a WebSocket endpoint that attaches every connection to session 1 of
+// registry as its owner, user 1.
+func startServer(t *testing.T, registry *terminal.Registry) string {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		registry.Attach(1, 1, conn)
+	}))
+	t.Cleanup(server.Close)
+	return "ws" + strings.TrimPrefix(server.URL, "http")
+}
+
+func dial(t *testing.T, url string) *websocket.Conn {
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	return conn
+}
+
+// readUntil reads messages from conn until their concatenation contains want.
+func readUntil(t *testing.T, conn *websocket.Conn, want string) string {
+	var output strings.Builder
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for !strings.Contains(output.String(), want) {
+		_, msg, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("did not receive %q, got %q: %v", want, output.String(), err)
+		}
+		output.Write(msg)
+	}
+	return output.String()
+}
+
+type statusRecorder struct {
+	mu       sync.Mutex
+	statuses []string
+}
+
+func (s *statusRecorder) record(id uint, status, reason string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.statuses = append(s.statuses, status)
+}
+
+func (s *statusRecorder) last() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.statuses) == 0 {
+		return ""
+	}
+	return s.statuses[len(s.statuses)-1]
+}
+
+func TestSessionSurvivesReconnect(t *testing.T) {
+	registry := terminal.NewRegistry(time.Minute)
+	statuses := &statusRecorder{}
+	registry.OnStatusChange = statuses.record
+	defer registry.Terminate(1, models.TerminatedByUser)
+
+	_, err := registry.Start(1, models.BackendLocal, bash)
+	assert.NoError(t, err)
+	url := startServer(t, registry)
+
+	// Leave some state behind in the shell, then drop the connection
+	conn := dial(t, url)
+	conn.WriteMessage(websocket.TextMessage, []byte("MARKER=still-here\n"))
+	time.Sleep(200 * time.Millisecond)
+	conn.Close()
+
+	assert.Eventually(t, func() bool { return statuses.last() == models.SessionDisconnected }, 2*time.Second, 10*time.Millisecond)
+	assert.NotNil(t, registry.Get(1))
+
+	// A new connection reaches the same shell
+	conn = dial(t, url)
+	defer conn.Close()
+	conn.WriteMessage(websocket.TextMessage, []byte("echo $MARKER\n"))
+	readUntil(t, conn, "still-here\r\n")
+	assert.Equal(t, models.SessionActive, statuses.last())
+}
+
+func TestSessionTerminatedAfterTimeout(t *testing.T) {
+	registry := terminal.NewRegistry(200 * time.Millisecond)
+	statuses := &statusRecorder{}
+	registry.OnStatusChange = statuses.record
+
+	_, err := registry.Start(1, models.BackendLocal, bash)
+	assert.NoError(t, err)
+	url := startServer(t, registry)
+
+	conn := dial(t, url)
+	conn.Close()
+
+	// The session leaves the registry before the status change is reported
+	assert.Eventually(t, func() bool { return statuses.last() == models.SessionTerminated }, 2*time.Second, 10*time.Millisecond)
+	assert.Nil(t, registry.Get(1))
+}
+
+func TestNewConnectionReplacesPreviousOne(t *testing.T) {
+	registry := terminal.NewRegistry(time.Minute)
+	defer registry.Terminate(1, models.TerminatedByUser)
+
+	_, err := registry.Start(1, models.BackendLocal, bash)
+	assert.NoError(t, err)
+	url := startServer(t, registry)
+
+	first := dial(t, url)
+	defer first.Close()
+	time.Sleep(100 * time.Millisecond)
+	second := dial(t, url)
+	defer second.Close()
+
+	// The first connection gets closed by the server
+	first.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		if _, _, err := first.ReadMessage(); err != nil {
+			netErr, ok := err.(net.Error)
+			assert.False(t, ok && netErr.Timeout(), "first connection was not closed")
+			break
+		}
+	}
+
+	second.WriteMessage(websocket.TextMessage, []byte("echo second\n"))
+	readUntil(t, second, "second\r\n")
+}
+
+func TestActivityReportedWhileTrafficFlows(t *testing.T) {
+	registry := terminal.NewRegistry(time.Minute)
+	registry.ActivityInterval = time.Hour
+	activity := make(chan uint, 10)
+	registry.OnActivity = func(id uint) { activity <- id }
+	defer registry.Terminate(1, models.TerminatedByUser)
+
+	_, err := registry.Start(1, models.BackendLocal, bash)
+	assert.NoError(t, err)
+	conn := dial(t, startServer(t, registry))
+	defer conn.Close()
+
+	conn.WriteMessage(websocket.TextMessage, []byte("echo one\n"))
+	readUntil(t, conn, "one\r\n")
+	conn.WriteMessage(websocket.TextMessage, []byte("echo two\n"))
+	readUntil(t, conn, "two\r\n")
+
+	// Activity is reported once per interval, however much traffic there is
+	select {
+	case id := <-activity:
+		assert.Equal(t, uint(1), id)
+	case <-time.After(2 * time.Second):
+		t.Fatal("activity was not reported")
+	}
+	time.Sleep(100 * time.Millisecond)
+	assert.Len(t, activity, 0)
+}
+
+// gatedBackend spawns local processes once release is closed.
+type gatedBackend struct {
+	release chan struct{}
+}
+
+func (b gatedBackend) Spawn(spec terminal.Spec) (terminal.Process, error) {
+	<-b.release
+	return terminal.LocalBackend{}.Spawn(spec)
+}
+
+func TestSlowStartDoesNotBlockRegistry(t *testing.T) {
+	registry := terminal.NewRegistry(time.Minute)
+	gate := gatedBackend{release: make(chan struct{})}
+	registry.Backends["gated"] = gate
+	defer registry.Terminate(1, models.TerminatedByUser)
+	defer registry.Terminate(2, models.TerminatedByUser)
+
+	started := make(chan *terminal.Session, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			s, err := registry.Start(1, "gated", bash)
+			assert.NoError(t, err)
+			started <- s
+		}()
+	}
+
+	// Other sessions are unaffected while session 1 spawns
+	assert.Eventually(t, func() bool {
+		_, err := registry.Start(2, models.BackendLocal, bash)
+		return err == nil && registry.Get(2) != nil
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Nil(t, registry.Get(1))
+
+	close(gate.release)
+	first, second := <-started, <-started
+	assert.NotNil(t, first)
+	assert.Same(t, first, second)
+	assert.Same(t, first, registry.Get(1))
+}